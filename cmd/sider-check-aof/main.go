@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tidwall/sider/server"
+)
+
+func main() {
+	var fix bool
+	var file string
+	switch len(os.Args) {
+	case 2:
+		file = os.Args[1]
+	case 3:
+		if os.Args[1] != "--fix" {
+			usage()
+		}
+		fix = true
+		file = os.Args[2]
+	default:
+		usage()
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open file: %s\n", file)
+		os.Exit(1)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot stat file: %s\n", file)
+		os.Exit(1)
+	}
+	size := fi.Size()
+	pos, cerr := server.CheckAOF(bufio.NewReader(f))
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", size, pos, size-pos)
+	if cerr == nil {
+		fmt.Printf("AOF is valid\n")
+		return
+	}
+	fmt.Printf("%v at offset %d\n", cerr, pos)
+	if !fix {
+		fmt.Printf("AOF is not valid. Use the --fix option to try fixing it.\n")
+		os.Exit(1)
+	}
+	fmt.Printf("This will shrink the AOF from %d bytes, with %d bytes, to %d bytes\n",
+		size, size-pos, pos)
+	fmt.Printf("Continue? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Printf("Aborting...\n")
+		os.Exit(1)
+	}
+	if err := f.Truncate(pos); err != nil {
+		fmt.Printf("Failed to truncate AOF: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully truncated AOF\n")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [--fix] <file.aof>\n", path.Base(os.Args[0]))
+	os.Exit(1)
+}
@@ -0,0 +1,5 @@
+module github.com/tidwall/sider
+
+go 1.23
+
+require github.com/yuin/gopher-lua v1.1.2
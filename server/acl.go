@@ -0,0 +1,646 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The users of the ACL are never changed once they're in s.acl. ACL SETUSER
+// applies the rules to a copy and swaps it in, so the clients read their user
+// and check the permissions of each command without a lock.
+
+// aclUser is a user of the ACL.
+type aclUser struct {
+	name        string
+	enabled     bool
+	nopass      bool
+	passwords   []string        // the sha256 hashes of the passwords
+	allKeys     bool            // any key, otherwise the keys matching keys
+	keys        []*pattern      // the key patterns
+	allCommands bool            // +@all and no commands were removed since
+	commands    map[string]bool // the allowed commands
+	rules       []string        // the command rules, as given to ACL SETUSER
+}
+
+// aclCategories are the ACL categories. The categories of each command are
+// set by register, from its command group and its flags.
+var aclCategories = []string{
+	"keyspace", "read", "write", "string", "list", "set", "sortedset",
+	"hash", "pubsub", "admin", "dangerous", "connection", "transaction",
+	"scripting",
+}
+
+// commandCategories returns the ACL categories of a command. The commands
+// that take the read lock are @read, and the commands that take the write
+// lock are @write. The @admin commands are @dangerous too.
+func commandCategories(cmd *command, group string) []string {
+	categories := []string{group}
+	if cmd.read {
+		categories = append(categories, "read")
+	}
+	if cmd.write {
+		categories = append(categories, "write")
+	}
+	if group == "admin" {
+		categories = append(categories, "dangerous")
+	}
+	return categories
+}
+
+func hashPassword(pass string) string {
+	h := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(h[:])
+}
+
+// newACLUser returns a user without passwords, keys or commands, which is
+// off, like a user that is created by ACL SETUSER.
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name:     name,
+		commands: make(map[string]bool),
+		rules:    []string{"-@all"},
+	}
+}
+
+// newDefaultUser returns the default user, which may run any command on any
+// key. The password is requirepass, and none when requirepass is empty.
+func (s *Server) newDefaultUser() *aclUser {
+	u := newACLUser("default")
+	u.enabled = true
+	u.allKeys = true
+	s.aclSetCommands(u, "+@all")
+	u.setRequirePass(s.cfg.requirepass)
+	return u
+}
+
+func (u *aclUser) clone() *aclUser {
+	nu := *u
+	nu.passwords = append([]string(nil), u.passwords...)
+	nu.keys = append([]*pattern(nil), u.keys...)
+	nu.rules = append([]string(nil), u.rules...)
+	nu.commands = make(map[string]bool, len(u.commands))
+	for name := range u.commands {
+		nu.commands[name] = true
+	}
+	return &nu
+}
+
+// setRequirePass replaces the passwords with the password of requirepass.
+func (u *aclUser) setRequirePass(pass string) {
+	u.passwords = nil
+	u.nopass = pass == ""
+	if pass != "" {
+		u.passwords = []string{hashPassword(pass)}
+	}
+}
+
+// checkPassword returns true when the user may authenticate with the
+// password.
+func (u *aclUser) checkPassword(pass string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(pass)
+	for _, pw := range u.passwords {
+		if pw == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAllowed returns true when the user may access the key.
+func (u *aclUser) keyAllowed(key string) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, p := range u.keys {
+		if p.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) flags() []string {
+	var flags []string
+	if u.enabled {
+		flags = append(flags, "on")
+	} else {
+		flags = append(flags, "off")
+	}
+	if u.allKeys {
+		flags = append(flags, "allkeys")
+	}
+	if u.allCommands {
+		flags = append(flags, "allcommands")
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// describe returns the user as the rules that create it, which is the line
+// of ACL LIST and of the aclfile.
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name}
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, pw := range u.passwords {
+		parts = append(parts, "#"+pw)
+	}
+	if u.allKeys {
+		parts = append(parts, "~*")
+	}
+	for _, p := range u.keys {
+		parts = append(parts, "~"+p.value)
+	}
+	parts = append(parts, u.rules...)
+	return strings.Join(parts, " ")
+}
+
+// categoryCommands returns the names of the commands in the category, or
+// false for an unknown category.
+func (s *Server) categoryCommands(category string) ([]string, bool) {
+	var names []string
+	found := category == "all"
+	for _, cat := range aclCategories {
+		if cat == category {
+			found = true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	for name, cmd := range s.cmds {
+		if name != cmd.name {
+			// the upper case name
+			continue
+		}
+		if category == "all" {
+			names = append(names, name)
+			continue
+		}
+		for _, cat := range cmd.categories {
+			if cat == category {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// aclSetCommands applies a command rule, like +get, -@write or +@all.
+func (s *Server) aclSetCommands(u *aclUser, rule string) error {
+	allow := rule[0] == '+'
+	name := strings.ToLower(rule[1:])
+	var names []string
+	if strings.HasPrefix(name, "@") {
+		var ok bool
+		if names, ok = s.categoryCommands(name[1:]); !ok {
+			return errors.New("Unknown command or category name in ACL")
+		}
+	} else {
+		cmd, ok := s.cmds[name]
+		if !ok {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		names = []string{cmd.name}
+	}
+	for _, name := range names {
+		if allow {
+			u.commands[name] = true
+		} else {
+			delete(u.commands, name)
+		}
+	}
+	switch {
+	case name == "@all":
+		// the earlier rules don't matter anymore
+		u.allCommands = allow
+		u.rules = []string{rule[:1] + name}
+	default:
+		if !allow {
+			u.allCommands = false
+		}
+		u.rules = append(u.rules, rule[:1]+name)
+	}
+	return nil
+}
+
+// aclApply applies a rule of ACL SETUSER to the user.
+func (s *Server) aclApply(u *aclUser, rule string) error {
+	switch lrule := strings.ToLower(rule); {
+	case lrule == "on":
+		u.enabled = true
+	case lrule == "off":
+		u.enabled = false
+	case lrule == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lrule == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lrule == "allkeys" || rule == "~*":
+		u.allKeys = true
+		u.keys = nil
+	case lrule == "resetkeys":
+		u.allKeys = false
+		u.keys = nil
+	case lrule == "allcommands":
+		return s.aclSetCommands(u, "+@all")
+	case lrule == "nocommands":
+		return s.aclSetCommands(u, "-@all")
+	case lrule == "reset":
+		*u = *newACLUser(u.name)
+	case rule == "":
+		return errors.New("Syntax error")
+	case rule[0] == '>' || rule[0] == '#':
+		hash := rule[1:]
+		if rule[0] == '>' {
+			hash = hashPassword(rule[1:])
+		} else if !validPasswordHash(hash) {
+			return errors.New("The password hash must be exactly 64 " +
+				"characters and contain only lowercase hexadecimal characters")
+		}
+		u.nopass = false
+		for _, pw := range u.passwords {
+			if pw == hash {
+				return nil
+			}
+		}
+		u.passwords = append(u.passwords, hash)
+	case rule[0] == '<' || rule[0] == '!':
+		hash := rule[1:]
+		if rule[0] == '<' {
+			hash = hashPassword(rule[1:])
+		}
+		for i, pw := range u.passwords {
+			if pw == hash {
+				u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("The password you are trying to remove from the " +
+			"user does not exist")
+	case rule[0] == '~':
+		if u.allKeys {
+			return errors.New("Adding a pattern after the * pattern (or the " +
+				"'allkeys' flag) is not valid and does not have any effect. " +
+				"Try 'resetkeys' to start with an empty list of patterns")
+		}
+		u.keys = append(u.keys, parsePattern(rule[1:]))
+	case len(rule) > 1 && (rule[0] == '+' || rule[0] == '-'):
+		return s.aclSetCommands(u, rule)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func validPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if (hash[i] < '0' || hash[i] > '9') && (hash[i] < 'a' || hash[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// aclSetUser adds or replaces the user, and moves the clients of the replaced
+// user to the new user. The caller must hold the write lock.
+func (s *Server) aclSetUser(u *aclUser) {
+	old := s.acl[u.name]
+	s.acl[u.name] = u
+	if old == nil {
+		return
+	}
+	for c := range s.clients {
+		if c.user.Load() == old {
+			c.user.Store(u)
+		}
+	}
+}
+
+// aclReplace replaces all the users, for ACL LOAD. The clients of the users
+// that are gone are disconnected. The caller must hold the write lock.
+func (s *Server) aclReplace(c *client, users map[string]*aclUser) {
+	s.acl = users
+	for uc := range s.clients {
+		u := uc.user.Load()
+		if u == nil {
+			continue
+		}
+		if nu, ok := users[u.name]; ok {
+			uc.user.Store(nu)
+		} else {
+			uc.kill(c)
+		}
+	}
+}
+
+// aclAuth returns the user for the username and the password, or nil when
+// they are wrong or the user is off.
+func (s *Server) aclAuth(name, pass string) *aclUser {
+	u, ok := s.acl[name]
+	if !ok || !u.checkPassword(pass) {
+		return nil
+	}
+	return u
+}
+
+// defaultNoPass returns true when the clients are authenticated as the
+// default user without AUTH.
+func (s *Server) defaultNoPass() bool {
+	u := s.acl["default"]
+	return u.enabled && u.nopass
+}
+
+// userName returns the name of the user of the client.
+func (c *client) userName() string {
+	if u := c.user.Load(); u != nil {
+		return u.name
+	}
+	return "default"
+}
+
+// aclCheck returns true when the user of the client may run the command on
+// its keys, otherwise it replies with an error. AUTH and HELLO are allowed
+// for any user, to switch users. The master has no user.
+func (c *client) aclCheck(cmd *command) bool {
+	u := c.user.Load()
+	if u == nil || cmd.name == "auth" || cmd.name == "hello" {
+		return true
+	}
+	var msg string
+	if !u.commands[cmd.name] {
+		msg = "NOPERM this user has no permissions to run the '" +
+			cmd.name + "' command"
+	} else if !u.allKeys {
+		// a command with keys that can't be known is denied, unless the user
+		// may access all keys
+		keys, complete := cmd.allKeys(c.args)
+		for i := 0; complete && i < len(keys); i++ {
+			complete = u.keyAllowed(keys[i])
+		}
+		if !complete {
+			msg = "NOPERM this user has no permissions to access one " +
+				"of the keys used as arguments"
+		}
+	}
+	if msg == "" {
+		return true
+	}
+	c.replyUniqueError(msg)
+	cmd.stats.rejected.Add(1)
+	if c.multi {
+		c.multiAbort = true
+	}
+	return false
+}
+
+// loadACLFile reads the users of the aclfile. The default user is added when
+// it's not in the file.
+func (s *Server) loadACLFile() (map[string]*aclUser, error) {
+	f, err := os.Open(s.cfg.aclfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]*aclUser)
+	sc := bufio.NewScanner(f)
+	for ln := 1; sc.Scan(); ln++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: line should start with user keyword",
+				s.cfg.aclfile, ln)
+		}
+		if _, ok := users[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: Duplicate user '%s' found",
+				s.cfg.aclfile, ln, fields[1])
+		}
+		u := newACLUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := s.aclApply(u, rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: Error in applying operation "+
+					"'%s': %v", s.cfg.aclfile, ln, rule, err)
+			}
+		}
+		users[u.name] = u
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := users["default"]; !ok {
+		users["default"] = s.newDefaultUser()
+	}
+	return users, nil
+}
+
+// saveACLFile writes the users to the aclfile, replacing the file once all
+// of the users are written.
+func (s *Server) saveACLFile() error {
+	var lines []string
+	for _, u := range s.acl {
+		lines = append(lines, u.describe())
+	}
+	sort.Strings(lines)
+	tmp := s.cfg.aclfile + ".tmp"
+	data := strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.cfg.aclfile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func aclCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	s := c.s
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("Unknown ACL subcommand or wrong number of arguments " +
+			"for '" + c.args[1] + "'")
+	case "setuser":
+		if len(c.args) < 3 {
+			c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		var u *aclUser
+		if old, ok := s.acl[c.args[2]]; ok {
+			u = old.clone()
+		} else {
+			u = newACLUser(c.args[2])
+		}
+		for _, rule := range c.args[3:] {
+			if err := s.aclApply(u, rule); err != nil {
+				c.replyError("Error in ACL SETUSER modifier '" + rule + "': " + err.Error())
+				return
+			}
+		}
+		s.aclSetUser(u)
+		c.replyString("OK")
+	case "getuser":
+		if len(c.args) != 3 {
+			c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		u, ok := s.acl[c.args[2]]
+		if !ok {
+			c.replyNull()
+			return
+		}
+		c.replyMapLen(4)
+		c.replyBulk("flags")
+		flags := u.flags()
+		c.replyMultiBulkLen(len(flags))
+		for _, flag := range flags {
+			c.replyBulk(flag)
+		}
+		c.replyBulk("passwords")
+		c.replyMultiBulkLen(len(u.passwords))
+		for _, pw := range u.passwords {
+			c.replyBulk(pw)
+		}
+		c.replyBulk("commands")
+		c.replyBulk(strings.Join(u.rules, " "))
+		c.replyBulk("keys")
+		if u.allKeys {
+			c.replyMultiBulkLen(1)
+			c.replyBulk("*")
+		} else {
+			c.replyMultiBulkLen(len(u.keys))
+			for _, p := range u.keys {
+				c.replyBulk(p.value)
+			}
+		}
+	case "deluser":
+		if len(c.args) < 3 {
+			c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		for _, name := range c.args[2:] {
+			if name == "default" {
+				c.replyError("The 'default' user cannot be removed")
+				return
+			}
+		}
+		var n int
+		for _, name := range c.args[2:] {
+			u, ok := s.acl[name]
+			if !ok {
+				continue
+			}
+			delete(s.acl, name)
+			for uc := range s.clients {
+				if uc.user.Load() == u {
+					uc.kill(c)
+				}
+			}
+			n++
+		}
+		c.replyInt(n)
+	case "list", "users":
+		if len(c.args) != 2 {
+			c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		var names []string
+		for name := range s.acl {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.replyMultiBulkLen(len(names))
+		for _, name := range names {
+			if strings.ToLower(c.args[1]) == "list" {
+				c.replyBulk(s.acl[name].describe())
+			} else {
+				c.replyBulk(name)
+			}
+		}
+	case "whoami":
+		if len(c.args) != 2 {
+			c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		c.replyBulk(c.userName())
+	case "cat":
+		switch len(c.args) {
+		default:
+			c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+		case 2:
+			c.replyMultiBulkLen(len(aclCategories))
+			for _, cat := range aclCategories {
+				c.replyBulk(cat)
+			}
+		case 3:
+			names, ok := s.categoryCommands(strings.ToLower(c.args[2]))
+			if !ok || c.args[2] == "all" {
+				c.replyError("Unknown category '" + c.args[2] + "'")
+				return
+			}
+			c.replyMultiBulkLen(len(names))
+			for _, name := range names {
+				c.replyBulk(name)
+			}
+		}
+	case "load", "save":
+		if len(c.args) != 2 {
+			c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		if s.cfg.aclfile == "" {
+			c.replyError("This instance is not configured to use an ACL " +
+				"file. You may want to specify users via the ACL SETUSER " +
+				"command and then issue a CONFIG REWRITE (assuming you have " +
+				"a configuration file set) in order to store users in the " +
+				"configuration.")
+			return
+		}
+		if strings.ToLower(c.args[1]) == "load" {
+			users, err := s.loadACLFile()
+			if err != nil {
+				c.replyError(err.Error())
+				return
+			}
+			s.aclReplace(c, users)
+		} else if err := s.saveACLFile(); err != nil {
+			s.lwarningf("Saving the ACL file: %v", err)
+			c.replyError("There was an error trying to save the ACLs. " +
+				"Please check the server logs for more information")
+			return
+		}
+		c.replyString("OK")
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func testMakeACLClient(t testing.TB, rules ...string) (*client, *bytes.Buffer) {
+	s := &Server{cmds: make(map[string]*command)}
+	s.commandTable()
+	u := newACLUser("test")
+	for _, rule := range rules {
+		if err := s.aclApply(u, rule); err != nil {
+			t.Fatalf("rule '%v': %v", rule, err)
+		}
+	}
+	var buf bytes.Buffer
+	c := &client{s: s, wr: &buf}
+	c.user.Store(u)
+	return c, &buf
+}
+
+func testACLCheck(t *testing.T, c *client, buf *bytes.Buffer, expect string, args ...string) {
+	buf.Reset()
+	c.args = args
+	ok := c.aclCheck(c.s.cmds[strings.ToLower(args[0])])
+	if ok != (expect == "") || !strings.Contains(buf.String(), expect) {
+		t.Fatalf("%v: expected '%v', got ok='%v', reply='%v'",
+			strings.Join(args, " "), expect, ok, strings.TrimSpace(buf.String()))
+	}
+}
+
+func TestACLKeyPatterns(t *testing.T) {
+	const noKey = "NOPERM this user has no permissions to access one of the keys"
+	c, buf := testMakeACLClient(t, "on", "nopass", "~z:*", "+@all")
+	testACLCheck(t, c, buf, "", "GET", "z:1")
+	testACLCheck(t, c, buf, noKey, "GET", "other")
+	testACLCheck(t, c, buf, "", "MSET", "z:1", "a", "z:2", "b")
+	testACLCheck(t, c, buf, noKey, "MSET", "z:1", "a", "other", "b")
+
+	// the source keys of ZUNIONSTORE and ZINTERSTORE are checked
+	testACLCheck(t, c, buf, "", "ZUNIONSTORE", "z:dst", "2", "z:a", "z:b")
+	testACLCheck(t, c, buf, noKey, "ZUNIONSTORE", "z:dst", "2", "z:a", "secret")
+	testACLCheck(t, c, buf, noKey, "ZINTERSTORE", "z:dst", "1", "secret", "WEIGHTS", "1")
+	testACLCheck(t, c, buf, noKey, "ZUNIONSTORE", "secret", "1", "z:a")
+
+	// a command with keys that can't be known is denied
+	testACLCheck(t, c, buf, noKey, "ZUNIONSTORE", "z:dst", "3", "z:a")
+	testACLCheck(t, c, buf, noKey, "SORT", "z:list", "BY", "secret:*")
+	testACLCheck(t, c, buf, "", "SORT", "z:list", "STORE", "z:dst")
+	testACLCheck(t, c, buf, noKey, "SORT", "z:list", "STORE", "secret")
+}
+
+func TestACLCommands(t *testing.T) {
+	c, buf := testMakeACLClient(t, "on", "nopass", "allkeys", "+@read")
+	testACLCheck(t, c, buf, "", "GET", "key")
+	testACLCheck(t, c, buf, "", "ZRANGE", "key", "0", "-1")
+	testACLCheck(t, c, buf, "NOPERM this user has no permissions to run the 'set' command",
+		"SET", "key", "value")
+	testACLCheck(t, c, buf, "NOPERM this user has no permissions to run the 'zunionstore' command",
+		"ZUNIONSTORE", "dst", "1", "key")
+	testACLCheck(t, c, buf, "", "AUTH", "test", "pass")
+}
+
+const testNoKeyPerm = "-NOPERM this user has no permissions to access one of the keys used as arguments"
+
+func TestACL(t *testing.T) {
+	ts := testStartServer(t)
+	a := ts.dial()
+	a.expect("default", "ACL", "WHOAMI")
+	a.expect("*[user default on nopass ~* +@all]", "ACL", "LIST")
+	a.expect("-ERR AUTH <password> called without any password configured for the default user. "+
+		"Are you sure your configuration is correct?", "AUTH", "x")
+	a.expect("+OK", "ACL", "SETUSER", "alice", "on", ">secret", "~cached:*", "+get", "+set", "+acl")
+	a.expect("*[alice,default]", "ACL", "USERS")
+	a.expect("-WRONGPASS invalid username-password pair or user is disabled.",
+		"AUTH", "alice", "bad")
+
+	b := ts.dial()
+	b.expect("+OK", "AUTH", "alice", "secret")
+	b.expect("alice", "ACL", "WHOAMI")
+	b.expect("+OK", "SET", "cached:1", "v")
+	b.expect("v", "GET", "cached:1")
+	b.expect(testNoKeyPerm, "GET", "other")
+	b.expect("-NOPERM this user has no permissions to run the 'del' command", "DEL", "cached:1")
+	if !strings.Contains(a.do("CLIENT", "LIST"), " user=alice ") {
+		t.Fatalf("expected a client of alice")
+	}
+
+	// the changes apply to the connected clients
+	a.expect("+OK", "ACL", "SETUSER", "alice", "+@keyspace")
+	b.expect(":1", "DEL", "cached:1")
+	a.expect("+OK", "ACL", "SETUSER", "alice", "-@all", "+@string")
+	b.expect("-NOPERM this user has no permissions to run the 'del' command", "DEL", "cached:1")
+
+	// the commands in transactions and scripts are checked
+	a.expect("+OK", "ACL", "SETUSER", "alice", "+multi", "+exec", "+eval")
+	b.expect("+OK", "MULTI")
+	b.expect(testNoKeyPerm, "SET", "x", "1")
+	b.expect("-EXECABORT Transaction discarded because of previous errors.", "EXEC")
+	b.expect(testNoKeyPerm, "EVAL", "return redis.call('set', 'x', '1')", "0")
+
+	a.expect("-ERR Error in ACL SETUSER modifier 'bogus': Syntax error",
+		"ACL", "SETUSER", "bob", "bogus")
+	a.expect("-ERR Error in ACL SETUSER modifier '+nope': Unknown command or category name in ACL",
+		"ACL", "SETUSER", "bob", "+nope")
+	a.expect("-ERR Error in ACL SETUSER modifier '<x': "+
+		"The password you are trying to remove from the user does not exist",
+		"ACL", "SETUSER", "bob", "<x")
+	a.expect("(nil)", "ACL", "GETUSER", "bob")
+	a.expect("+OK", "ACL", "SETUSER", "bob")
+	a.expect("*[flags,*[off],passwords,*[],commands,-@all,keys,*[]]", "ACL", "GETUSER", "bob")
+	a.expect("-WRONGPASS invalid username-password pair or user is disabled.", "AUTH", "bob", "")
+	if got := a.do("ACL", "CAT"); !strings.Contains(got, ",sortedset,") {
+		t.Fatalf("expected '%v' in '%v'", "sortedset", got)
+	}
+	if got := a.do("ACL", "CAT", "hash"); !strings.Contains(got, "hset") ||
+		strings.Contains(got, "append") {
+		t.Fatalf("expected the hash commands, got '%v'", got)
+	}
+
+	// requirepass is the password of the default user
+	a.expect("+OK", "CONFIG", "SET", "requirepass", "pw")
+	c := ts.dial()
+	c.expect("-NOAUTH Authentication required.", "PING")
+	c.expect("+OK", "AUTH", "pw")
+	c.expect("default", "ACL", "WHOAMI")
+	c.expect("+OK", "AUTH", "default", "pw")
+	c.expect("-ERR The 'default' user cannot be removed", "ACL", "DELUSER", "default")
+	c.expect("+OK", "CONFIG", "SET", "requirepass", "")
+
+	// the clients of a deleted user are closed
+	c.expect(":1", "ACL", "DELUSER", "alice")
+	if got := b.do("PING"); !strings.HasPrefix(got, "ERR:") {
+		t.Fatalf("expected the client to be closed, got '%v'", got)
+	}
+	c.expect("-ERR This instance is not configured to use an ACL file. "+
+		"You may want to specify users via the ACL SETUSER command and then issue a "+
+		"CONFIG REWRITE (assuming you have a configuration file set) in order to store "+
+		"users in the configuration.", "ACL", "SAVE")
+}
+
+func TestACLFile(t *testing.T) {
+	file := path.Join(t.TempDir(), "users.acl")
+	if err := ioutil.WriteFile(file, []byte("user carol on >pw ~* +@read\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts := testStartServer(t, "--aclfile", file)
+	a := ts.dial()
+	a.expect("*[carol,default]", "ACL", "USERS")
+	b := ts.dial()
+	b.expect("+OK", "AUTH", "carol", "pw")
+	b.expect("(nil)", "GET", "k")
+	b.expect("-NOPERM this user has no permissions to run the 'set' command", "SET", "k", "v")
+
+	a.expect("+OK", "ACL", "SETUSER", "dave", "on", "nopass", "allkeys", "allcommands")
+	a.expect("+OK", "ACL", "SAVE")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "user dave on nopass ~* +@all\n") {
+		t.Fatalf("expected the user dave, got '%v'", string(data))
+	}
+
+	// the users that aren't loaded are closed
+	if err := ioutil.WriteFile(file, []byte("user dave on nopass ~* +@all\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a.expect("+OK", "ACL", "LOAD")
+	a.expect("*[dave,default]", "ACL", "USERS")
+	if got := b.do("PING"); !strings.HasPrefix(got, "ERR:") {
+		t.Fatalf("expected the client to be closed, got '%v'", got)
+	}
+	if err := ioutil.WriteFile(file, []byte("bogus\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.do("ACL", "LOAD"); !strings.Contains(got, "line should start with user keyword") {
+		t.Fatalf("expected an error, got '%v'", got)
+	}
+	a.expect("*[dave,default]", "ACL", "USERS")
+}
+
+func TestACLVariableKeys(t *testing.T) {
+	ts := testStartServer(t)
+	a := ts.dial()
+	a.expect("+OK", "ACL", "SETUSER", "eve", "on", "nopass", "~z:*", "+@all")
+	a.expect(":1", "ZADD", "secret", "1", "a")
+	b := ts.dial()
+	b.expect("+OK", "AUTH", "eve", "x")
+	b.expect(testNoKeyPerm, "ZUNIONSTORE", "z:out", "1", "secret")
+	b.expect(testNoKeyPerm, "ZINTERSTORE", "z:out", "x", "secret")
+	b.expect(":0", "ZUNIONSTORE", "z:out", "1", "z:in")
+	b.expect(testNoKeyPerm, "SORT", "z:l", "STORE", "secret")
+	b.expect(testNoKeyPerm, "SORT", "z:l", "BY", "secret_*")
+	b.expect("*[]", "SORT", "z:l", "BY", "nosort")
+	if got := a.do("ACL", "CAT", "write"); !strings.Contains(got, "flushdb") ||
+		strings.Contains(got, ",get,") {
+		t.Fatalf("expected the write commands, got '%v'", got)
+	}
+}
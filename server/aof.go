@@ -2,25 +2,93 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// openAOF opens the appendonly.aof file and loads it.
-// There is also a background goroutine that syncs every seconds.
+// openAOF opens the appendonly.aof file and loads it. When the AOF is empty
+// and there is a snapshot file, such as a dump.rdb copied from Redis, the
+// snapshot is loaded and written to the AOF instead.
 func (s *Server) openAOF() error {
 	f, err := os.OpenFile(s.aofPath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
 	s.aof = f
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		loaded, err := s.loadRDB()
+		if err != nil {
+			return err
+		}
+		if loaded {
+			wr := bufio.NewWriter(s.aof)
+			if err := s.writeSnapshot(wr); err != nil {
+				return err
+			}
+			s.aofdbnum = 0
+			if err := wr.Flush(); err != nil {
+				return err
+			}
+			return s.resetAOFSize()
+		}
+	}
+	if err := s.loadAOF(); err != nil {
+		return err
+	}
+	return s.resetAOFSize()
+}
+
+// resetAOFSize records the current size of the aof file as the base size,
+// which is the size that the automatic rewrite growth is measured against.
+func (s *Server) resetAOFSize() error {
+	size, err := s.aof.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	s.aofsize = size
+	s.aofbasesize = size
+	return nil
+}
+
+// autoRewriteAOF starts a background rewrite when the aof is larger than
+// auto-aof-rewrite-min-size and it has grown by auto-aof-rewrite-percentage
+// since the last rewrite. Called once a second from the expire loop. The
+// caller must hold the write lock.
+func (s *Server) autoRewriteAOF() {
+	pct := s.cfg.autoAOFRewritePercentage
+	if s.aof == nil || s.aofrewrite || pct == 0 {
+		return
+	}
+	if s.aofsize < s.cfg.autoAOFRewriteMinSize {
+		return
+	}
+	base := s.aofbasesize
+	if base == 0 {
+		base = 1
+	}
+	growth := s.aofsize*100/base - 100
+	if growth >= int64(pct) {
+		s.lnoticef("Starting automatic rewriting of AOF on %d%% growth", growth)
+		s.rewriteAOF()
+	}
+}
+
+// startAOFSyncLoop runs a background routine which syncs the aof file once
+// per second when appendfsync is everysec. The sync happens outside of the
+// lock so that a slow disk does not stall the clients.
+func (s *Server) startAOFSyncLoop() {
 	go func() {
 		t := time.NewTicker(time.Second)
 		defer t.Stop()
@@ -30,11 +98,46 @@ func (s *Server) openAOF() error {
 				s.mu.Unlock()
 				return
 			}
-			s.aof.Sync()
+			f := s.aof
+			pending := s.aofpending && s.cfg.appendfsync == "everysec"
+			if pending {
+				s.aofpending = false
+			}
 			s.mu.Unlock()
+			if f != nil && pending {
+				// The file may be swapped out by a rewrite while syncing,
+				// in which case the sync fails harmlessly.
+				f.Sync()
+			}
 		}
 	}()
-	return s.loadAOF()
+}
+
+// startAOF turns on the aof at runtime. The aof file is recreated from the
+// dataset by a background rewrite while new commands are appended to it.
+func (s *Server) startAOF() error {
+	f, err := os.OpenFile(s.aofPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.aof = f
+	s.aofdbnum = 0
+	s.aofsize = 0
+	s.aofbasesize = 0
+	s.rewriteAOF()
+	return nil
+}
+
+// stopAOF turns off the aof at runtime. Pending commands are still fed to
+// the replicas.
+func (s *Server) stopAOF() error {
+	if err := s.flushAOF(); err != nil {
+		return err
+	}
+	s.aof.Sync()
+	err := s.aof.Close()
+	s.aof = nil
+	return err
 }
 
 func writeBulk(wr io.Writer, arg string) {
@@ -71,43 +174,117 @@ func (a dbsByNumber) Swap(i, j int) {
 	a[i], a[j] = a[j], a[i]
 }
 
-type keyItemByKey struct {
-	keys  []string
-	items []dbItem
-}
-
-func (a *keyItemByKey) Len() int {
-	return len(a.keys)
-}
-
-func (a *keyItemByKey) Less(i, j int) bool {
-	return a.keys[i] < a.keys[j]
+// writeItemCommands writes the commands that are needed to recreate a key.
+// Values with many members are broken up into batches.
+func writeItemCommands(wr io.Writer, key string, value interface{}) error {
+	var strs []interface{}
+	batch := func(cmd string, args ...interface{}) {
+		if len(strs) == 0 {
+			strs = append(strs, cmd, key)
+		}
+		strs = append(strs, args...)
+		if len(strs) >= 20 {
+			writeMultiBulk(wr, strs...)
+			strs = nil
+		}
+	}
+	switch v := value.(type) {
+	default:
+		return errors.New("invalid type in database")
+	case string:
+		writeMultiBulk(wr, "SET", key, v)
+	case *list:
+		v.ascend(func(v string) bool {
+			batch("RPUSH", v)
+			return true
+		})
+	case *set:
+		v.ascend(func(v string) bool {
+			batch("SADD", v)
+			return true
+		})
+	case *zset:
+		v.ascend(func(member string, score float64) bool {
+			batch("ZADD", formatScore(score), member)
+			return true
+		})
+	case *hash:
+		v.ascend(func(field, value string) bool {
+			batch("HSET", field, value)
+			return true
+		})
+	}
+	if len(strs) != 0 {
+		writeMultiBulk(wr, strs...)
+	}
+	return nil
 }
 
-func (a *keyItemByKey) Swap(i, j int) {
-	a.keys[i], a.keys[j] = a.keys[j], a.keys[i]
-	a.items[i], a.items[j] = a.items[j], a.items[i]
+// aofEntry encodes a key of a snapshot as the commands that recreate it.
+func aofEntry(buf *bytes.Buffer, key string, value interface{}, expires time.Time) error {
+	if err := writeItemCommands(buf, key, value); err != nil {
+		return err
+	}
+	if !expires.IsZero() {
+		writeMultiBulk(buf, "PEXPIREAT", key, expires.UnixNano()/int64(time.Millisecond))
+	}
+	return nil
 }
 
 // rewriteAOF triggers a background rewrite of the AOF file.
 // Returns true if the process was started, or false if the the process a
-// rewrite is already in progress. There are a number of locks and unlocks which
-// is required to keep the server running in the foreground and background. We
-// process in chunks and try not to hang on to locks for longer than we need.
-// The rewrite process will slow down the main server a little bit but it
-// shouldn't be too noticeable.
+// rewrite is already in progress. The dataset is written from a snapshot that
+// is taken right away, and the commands that are appended to the active AOF
+// in the meantime are copied to the end of the new file. The snapshot is
+// encoded in chunks so that the clients aren't stalled. The caller must hold
+// the write lock.
 func (s *Server) rewriteAOF() bool {
 	if s.aofrewrite {
 		return false
 	}
 	s.aofrewrite = true
+	s.aofrewriteStart = time.Now()
 	s.lnoticef("Background append only file rewriting started")
+
+	// Flush the pending commands and get the size of the active AOF file,
+	// and the last DB num that was used when the previous command was
+	// written. The commands after this position are the changes that occur
+	// after the snapshot, which are copied to the rewritten AOF at the end.
+	var err error
+	var lastpos int64
+	var snap *snapshot
+	var lastdbnum int
+	dbnum := -1 // the database of the last SELECT in the rewritten AOF
+	if s.aof == nil {
+		err = errors.New("appendonly was turned off")
+	} else if err = s.flushAOF(); err == nil {
+		lastpos, err = s.aof.Seek(0, 1)
+	}
+
+	// Create a temporary aof file for writting the new commands to. If this
+	// process is successful then this file will become the active AOF.
+	tempName := path.Join(path.Dir(s.aofPath),
+		fmt.Sprintf("temp-rewrite-%d.aof", os.Getpid()))
+	var f *os.File
+	if err == nil {
+		f, err = os.Create(tempName)
+	}
+	if err == nil {
+		lastdbnum = s.aofdbnum
+		s.ldebugf("AOF starting pos: %v, dbnum: %v", lastpos, lastdbnum)
+		snap = s.newSnapshot(func(buf *bytes.Buffer, sd *snapshotDB) {
+			// If the first command is `SELECT 0` then skip this write.
+			if !(dbnum == -1 && sd.db.num == 0) {
+				writeMultiBulk(buf, "SELECT", sd.db.num)
+			}
+			dbnum = sd.db.num
+		}, aofEntry)
+	}
 	go func() {
 		// We use one err variable for the entire process. When we encounter an
 		// error we should assign this variable and return. Before calling
 		// return there we should be in lock mode (s.mu.Lock()).
-		var err error
-		s.mu.Lock()
+		err := err
 		defer func() {
 			if err == nil {
 				s.lnoticef("Background AOF rewrite finished successfully")
@@ -115,17 +292,12 @@ func (s *Server) rewriteAOF() bool {
 				s.lnoticef("Background AOF rewrite failed: %v", err)
 			}
 			s.aofrewrite = false
+			s.aofrewriteErr = err
+			s.aofrewriteTime = time.Since(s.aofrewriteStart)
 			s.mu.Unlock()
 		}()
-
-		// Create a temporary aof file for writting the new commands to. If this
-		// process is successful then this file will become the active AOF.
-
-		tempName := path.Join(path.Dir(s.aofPath),
-			fmt.Sprintf("temp-rewrite-%d.aof", os.Getpid()))
-		var f *os.File
-		f, err = os.Create(tempName)
 		if err != nil {
+			s.mu.Lock()
 			return
 		}
 		defer func() {
@@ -140,181 +312,21 @@ func (s *Server) rewriteAOF() bool {
 		// writes to the file.
 		wr := bufio.NewWriter(f)
 
-		// Get the size of the active AOF file, and get the last DB num that was
-		// used when the previous command was written. These both will be used
-		// to return to the active AOF file and sync the remaining commands
-		// which reflect changes that have occured since the start of the
-		// rewrite.
-		var lastpos int64
-		lastpos, err = s.aof.Seek(0, 1)
-		if err != nil {
-			return
-		}
-		lastdbnum := s.aofdbnum
-		s.ldebugf("AOF starting pos: %v, dbnum: %v", lastpos, lastdbnum)
-		s.mu.Unlock()
-
-		// From here until near the end of the process we will only use read
-		// locks since we are not mutating the database during the rewrite.
-		// This will allow for other clients to do reading commands such as
-		// GET without penalty. Writing command such as SET will see a slight
-		// delay, but we refresh the read locks often enough that the won't
-		// be much of a performance hit.
-
-		// Read all dbs into a local array
-		s.mu.RLock()
-		dbs := make([]*database, len(s.dbs))
-		var i int
-		for _, db := range s.dbs {
-			dbs[i] = db
-			i++
-		}
-		s.mu.RUnlock()
-
-		// Sort the dbs by number.
-		sort.Sort(dbsByNumber(dbs))
-
-		dbnum := -1
-
-		// Use single time for all expires.
-		now := time.Now()
-
-		// Loop though local db array proessing each one. Since we are iterating
-		// a map there the order of the databases will be random.
-		for _, db := range dbs {
-			s.mu.RLock()
-			if len(db.items) == 0 {
-				s.mu.RUnlock()
-				continue // skip empty databases
-			}
-			// write a SELECT command. If the first command is `SELECT 0` then
-			// skip this write.
-			if !(dbnum == -1 && db.num == 0) {
-				writeMultiBulk(wr, "SELECT", db.num)
-			}
-			dbnum = db.num
-			// collect db items (keys) into local variables
-			var msets []interface{}
-
-			keys := make([]string, len(db.items))
-			items := make([]dbItem, len(db.items))
-			expires := make(map[string]time.Time)
-			expireKeys := make([]string, len(expires))
-			i := 0
-			for key, item := range db.items {
-				items[i] = item
-				keys[i] = key
-				i++
-			}
-			i = 0
-			for key, t := range db.expires {
-				expires[key] = t
-				expireKeys[i] = key
-				i++
-			}
-			// Sort the keys and let the lock breath for a moment
-			s.mu.RUnlock()
-			sort.Strings(expireKeys)
-			sort.Sort(&keyItemByKey{keys, items})
-			s.mu.RLock()
-			for i := 0; i < len(keys); i++ {
-				key := keys[i]
-				item := items[i]
-				if i%100 == 0 {
-					// let the lock breath for a moment
-					s.mu.RUnlock()
-					err = wr.Flush()
-					if err != nil {
-						s.mu.Lock() // lock write on error
-						return
-					}
-					s.mu.RLock()
-				}
-				expired := false
-				if item.expires {
-					if t, ok := expires[key]; ok {
-						seconds := int((t.Sub(now) / time.Second) + 1)
-						if seconds <= 0 {
-							expired = true
-						}
-					}
-				}
-				if !expired {
-					switch v := item.value.(type) {
-					default:
-						s.mu.RUnlock() // unlock read
-						s.mu.Lock()    // lock write on error
-						err = errors.New("invalid type in database")
-					case string:
-						if len(msets) == 0 {
-							msets = append(msets, "MSET", key, v)
-						} else {
-							msets = append(msets, key, v)
-						}
-						if len(msets) >= 20 {
-							writeMultiBulk(wr, msets...)
-							msets = nil
-						}
-					case *list:
-						var strs []interface{}
-						v.ascend(func(v string) bool {
-							if len(strs) == 0 {
-								strs = append(strs, "RPUSH", v)
-							} else {
-								strs = append(strs, v)
-							}
-							if len(strs) >= 20 {
-								writeMultiBulk(wr, strs...)
-								strs = nil
-							}
-							return true
-						})
-						if len(strs) != 0 {
-							writeMultiBulk(wr, strs...)
-							strs = nil
-						}
-					case *set:
-						var strs []interface{}
-						v.ascend(func(v string) bool {
-							if len(strs) == 0 {
-								strs = append(strs, "SADD", v)
-							} else {
-								strs = append(strs, v)
-							}
-							if len(strs) >= 20 {
-								writeMultiBulk(wr, strs...)
-								strs = nil
-							}
-							return true
-						})
-						if len(strs) != 0 {
-							writeMultiBulk(wr, strs...)
-							strs = nil
-						}
-					}
-				}
-			}
-			if len(msets) != 0 {
-				writeMultiBulk(wr, msets...)
-				msets = nil
-			}
-			// write expires
-			for _, key := range expireKeys {
-				t := expires[key]
-				seconds := int((t.Sub(now) / time.Second) + 1)
-				if seconds > 0 {
-					writeMultiBulk(wr, "EXPIRE", key, seconds)
-				}
-			}
-			s.mu.RUnlock()
+		// The snapshot only holds the lock while a chunk is encoded. Writing
+		// commands such as SET will see a slight delay, because the keys that
+		// they change are encoded first, with the values from the start of
+		// the rewrite.
+		err = s.streamSnapshot(snap, func(p []byte) error {
+			_, err := wr.Write(p)
+			return err
+		})
+		if err == nil {
+			err = wr.Flush()
 		}
-		err = wr.Flush()
+		s.mu.Lock()
 		if err != nil {
-			s.mu.Lock() // relock on error
 			return
 		}
-		// time.Sleep(time.Second * 10) // artifical delay
-		s.mu.Lock()
 
 		// The base aof has been rewritten. There may have been new aof
 		// commands since the start of the rewrite. Let's find out!
@@ -363,6 +375,12 @@ func (s *Server) rewriteAOF() bool {
 			return
 		}
 
+		// The aof may have been turned off while rewriting.
+		if s.aof == nil {
+			err = errors.New("appendonly was turned off")
+			return
+		}
+
 		// Finally switch out the aof files, failures here can by sucky
 		if err = os.Rename(tempName, s.aofPath); err != nil {
 			return
@@ -380,6 +398,10 @@ func (s *Server) rewriteAOF() bool {
 		}
 		s.aof.Close()
 		s.aof = nf
+		if err = s.resetAOFSize(); err != nil {
+			s.fatalError(err)
+			return
+		}
 
 		// We are really really done. Celebrate with a bag of Funyuns!
 
@@ -387,41 +409,69 @@ func (s *Server) rewriteAOF() bool {
 	return true
 }
 
-// flushAOF flushes the
+// flushAOF flushes the pending commands of each database to the aof file
+// and to the replication stream.
 func (s *Server) flushAOF() error {
+	var wrote bool
 	if s.dbs[s.aofdbnum] != nil {
 		db := s.dbs[s.aofdbnum]
 		if db.aofbuf.Len() > 0 {
-			if _, err := s.aof.Write(db.aofbuf.Bytes()); err != nil {
+			if err := s.writeAOF(db.aofbuf.Bytes()); err != nil {
 				return err
 			}
+			s.feedReplicas(db.aofbuf.Bytes())
 			db.aofbuf.Reset()
+			wrote = true
 		}
 	}
 	for num, db := range s.dbs {
 		if db.aofbuf.Len() > 0 {
 			selstr := strconv.FormatInt(int64(num), 10)
 			lenstr := strconv.FormatInt(int64(len(selstr)), 10)
-			if _, err := s.aof.WriteString("*2\r\n$6\r\nSELECT\r\n$" + lenstr +
-				"\r\n" + selstr + "\r\n"); err != nil {
+			selcmd := "*2\r\n$6\r\nSELECT\r\n$" + lenstr + "\r\n" + selstr + "\r\n"
+			if err := s.writeAOF([]byte(selcmd)); err != nil {
 				return err
 			}
-			if _, err := s.aof.Write(db.aofbuf.Bytes()); err != nil {
+			s.feedReplicas([]byte(selcmd))
+			if err := s.writeAOF(db.aofbuf.Bytes()); err != nil {
 				return err
 			}
+			s.feedReplicas(db.aofbuf.Bytes())
 			db.aofbuf.Reset()
 			s.aofdbnum = num
+			wrote = true
 		}
 	}
+	if wrote && s.aof != nil {
+		if s.cfg.appendfsync == "always" {
+			// The clients get their replies after this returns, so the
+			// commands are on disk before they are acknowledged.
+			return s.aof.Sync()
+		}
+		s.aofpending = true
+	}
 	return nil
 }
 
+// writeAOF writes data to the aof file, unless appendonly is turned off.
+func (s *Server) writeAOF(data []byte) error {
+	if s.aof == nil {
+		return nil
+	}
+	n, err := s.aof.Write(data)
+	s.aofsize += int64(n)
+	s.aofwriteErr = err
+	return err
+}
+
 func (s *Server) closeAOF() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.flushAOF()
-	s.aof.Sync()
-	s.aof.Close()
+	if s.aof != nil {
+		s.aof.Sync()
+		s.aof.Close()
+	}
 	s.aofclosed = true
 }
 
@@ -434,26 +484,146 @@ func (s *Server) loadAOF() error {
 		s.aofdbnum = c.db.num
 	}()
 	var read int
+	var pos int64           // the file position of the next command
+	var multipos int64 = -1 // the file position of an open MULTI
+	var truncated bool      // the file ends with a partial command
+	var queue []queuedCommand
 	for {
 		raw, args, _, err := rd.readCommand()
 		if err != nil {
 			if err == io.EOF {
+				truncated = len(rd.buf) > 0
 				break
 			}
-			s.lwarningf("%v", err)
+			s.lwarningf("Bad file format reading the append only file: %v", err)
+			s.lwarningf("Make a backup of your AOF file, then use " +
+				"./sider-check-aof --fix <filename>")
 			return err
 		}
-		c.args = args
-		c.raw = raw
+		pos += int64(len(raw))
 		commandName := autocase(args[0])
-		if cmd, ok := s.cmds[commandName]; ok {
-			cmd.funct(c)
-		} else {
+		cmd, ok := s.cmds[commandName]
+		if !ok {
 			return errors.New("unknown command '" + args[0] + "'")
 		}
+		switch cmd.name {
+		case "multi":
+			multipos = pos - int64(len(raw))
+			queue = nil
+		case "exec":
+			for _, q := range queue {
+				c.args, c.raw = q.args, q.raw
+				q.cmd.funct(c)
+			}
+			multipos = -1
+			queue = nil
+		default:
+			if multipos != -1 {
+				queue = append(queue, queuedCommand{
+					cmd:  cmd,
+					args: append([]string(nil), args...),
+					raw:  append([]byte(nil), raw...),
+				})
+			} else {
+				c.args = args
+				c.raw = raw
+				cmd.funct(c)
+			}
+		}
 		read++
 	}
+	if truncated {
+		// The last command was only partially written, most likely from a
+		// power loss or a full disk.
+		if !s.cfg.aofLoadTruncated {
+			s.lwarningf("Unexpected end of file reading the append only file. " +
+				"You can: 1) Make a backup of your AOF file, then use " +
+				"./sider-check-aof --fix <filename>. 2) Alternatively you " +
+				"can set the 'aof-load-truncated' configuration option to " +
+				"yes and restart the server.")
+			return errors.New("unexpected end of file reading the append only file")
+		}
+		s.lwarningf("!!! Warning: short read while loading the AOF file %s!!!", s.aofPath)
+		s.lwarningf("!!! Truncating the AOF at offset %d !!!", pos)
+		if err := s.aof.Truncate(pos); err != nil {
+			return err
+		}
+		if _, err := s.aof.Seek(pos, 0); err != nil {
+			return err
+		}
+		s.lwarningf("AOF loaded anyway because aof-load-truncated is enabled")
+	}
+	if multipos != -1 {
+		// The AOF ends in the middle of a transaction, most likely from a
+		// crash while writing. Drop the partial transaction from the file.
+		s.lwarningf("Revert incomplete MULTI/EXEC transaction in AOF file")
+		if err := s.aof.Truncate(multipos); err != nil {
+			return err
+		}
+		if _, err := s.aof.Seek(multipos, 0); err != nil {
+			return err
+		}
+	}
 	s.lnoticef("DB loaded from disk: %.3f seconds",
 		float64(time.Now().Sub(start))/float64(time.Second))
 	return nil
 }
+
+// CheckAOF validates an append only file. Returns the offset of the end of
+// the last complete command, which is the offset that the file can be
+// truncated to. A non-nil error describes the problem that was found at
+// that offset.
+func CheckAOF(rd io.Reader) (int64, error) {
+	counter := &countingReader{rd: rd}
+	cr := newCommandReader(counter)
+	var pos int64           // the offset after the last valid command
+	var multipos int64 = -1 // the offset of an open MULTI
+	for {
+		raw, args, _, err := cr.readCommand()
+		if err != nil {
+			if err != io.EOF {
+				return pos, err
+			}
+			if len(cr.buf) > 0 {
+				return pos, errors.New("unexpected end of file")
+			}
+			break
+		}
+		// Inline commands are converted by the reader, which makes the raw
+		// command larger than the bytes that were read from the file.
+		if counter.n-int64(len(cr.buf))-pos != int64(len(raw)) {
+			return pos, errors.New("expected a multibulk command")
+		}
+		if len(args) == 0 {
+			return pos, errors.New("empty command")
+		}
+		switch strings.ToLower(args[0]) {
+		case "multi":
+			if multipos != -1 {
+				return pos, errors.New("unexpected MULTI inside of a transaction")
+			}
+			multipos = pos
+		case "exec":
+			if multipos == -1 {
+				return pos, errors.New("unexpected EXEC without MULTI")
+			}
+			multipos = -1
+		}
+		pos += int64(len(raw))
+	}
+	if multipos != -1 {
+		return multipos, errors.New("reached EOF before reading EXEC for MULTI")
+	}
+	return pos, nil
+}
+
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendOnly(t *testing.T) {
+	ts := testStartServer(t, "--appendonly", "no", "--appendfsync", "always")
+	c := ts.dial()
+	aofPath := path.Join(ts.dir, "appendonly.aof")
+	c.expect("*[appendonly,no]", "CONFIG", "GET", "appendonly")
+	c.expect("*[appendfsync,always]", "CONFIG", "GET", "appendfsync")
+	c.expect("+OK", "SET", "a", "1")
+	if _, err := os.Stat(aofPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no aof, got '%v'", err)
+	}
+
+	// turning it on writes the dataset and then the commands
+	c.expect("+OK", "CONFIG", "SET", "appendonly", "yes")
+	c.expect("+OK", "SET", "b", "2")
+	c.wait("+OK", "CONFIG", "SET", "appendonly", "no")
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("\r\na\r\n")) || !bytes.Contains(data, []byte("\r\nb\r\n")) {
+		t.Fatalf("expected the keys in the aof, got '%q'", data)
+	}
+	c.expect("+OK", "SET", "c", "3")
+	if data, _ := ioutil.ReadFile(aofPath); bytes.Contains(data, []byte("\r\nc\r\n")) {
+		t.Fatalf("expected no writes to the aof, got '%q'", data)
+	}
+	c.expect("-ERR Invalid argument 'sometimes' for CONFIG SET 'appendfsync'",
+		"CONFIG", "SET", "appendfsync", "sometimes")
+	for _, policy := range []string{"everysec", "no", "always"} {
+		c.expect("+OK", "CONFIG", "SET", "appendfsync", policy)
+		c.expect("*[appendfsync,"+policy+"]", "CONFIG", "GET", "appendfsync")
+	}
+
+	// without the aof the snapshot is loaded
+	c.expect("+OK", "SAVE")
+	ts.restart()
+	c = ts.dial()
+	c.expect("*[1,2,3]", "MGET", "a", "b", "c")
+}
+
+func TestAOFAutoRewrite(t *testing.T) {
+	ts := testStartServer(t, "--auto-aof-rewrite-min-size", "1kb",
+		"--auto-aof-rewrite-percentage", "100")
+	c := ts.dial()
+	info := c.do("INFO", "persistence")
+	if got := testInfoField(info, "aof_last_rewrite_time_sec"); got != "-1" {
+		t.Fatalf("expected '%v', got '%v'", "-1", got)
+	}
+	for i := 0; i < 200; i++ {
+		c.expect("+OK", "SET", "k", "a value that is overwritten")
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		info = c.do("INFO", "persistence")
+		if testInfoField(info, "aof_last_rewrite_time_sec") != "-1" &&
+			testInfoField(info, "aof_rewrite_in_progress") == "0" {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected a rewrite, got '%v'", info)
+		}
+	}
+	if testInfoField(info, "aof_base_size") != testInfoField(info, "aof_current_size") {
+		t.Fatalf("expected the base size to be the current size, got '%v'", info)
+	}
+	c.expect("*[auto-aof-rewrite-min-size,1024]", "CONFIG", "GET", "auto-aof-rewrite-min-size")
+	c.expect("+OK", "CONFIG", "SET", "auto-aof-rewrite-percentage", "0")
+	c.expect("-ERR Invalid argument 'x' for CONFIG SET 'auto-aof-rewrite-min-size'",
+		"CONFIG", "SET", "auto-aof-rewrite-min-size", "x")
+}
+
+func TestAOFRewriteWhileWriting(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	const n = 100000
+	for i := 0; i < n; i++ {
+		c.send("RPUSH", "k"+strconv.Itoa(i), "a")
+	}
+	for i := 0; i < n; i++ {
+		c.read()
+	}
+
+	// the writes while the aof is rewritten are applied once
+	c.expect("+Background append only file rewriting started", "BGREWRITEAOF")
+	for i := n - 1; i >= 0; i-- {
+		c.send("RPUSH", "k"+strconv.Itoa(i), "b")
+		c.send("INCR", "counter")
+	}
+	for i := 0; i < 2*n; i++ {
+		c.read()
+	}
+	c.waitInfo("persistence", "aof_rewrite_in_progress", "0")
+	ts.restart()
+	c = ts.dial()
+	c.expect(strconv.Itoa(n), "GET", "counter")
+	for i := 0; i < n; i++ {
+		c.send("LLEN", "k"+strconv.Itoa(i))
+	}
+	for i := 0; i < n; i++ {
+		if got := c.read(); got != ":2" {
+			t.Fatalf("k%d: expected '%v', got '%v'", i, ":2", got)
+		}
+	}
+}
+
+func testMakeAOF(t testing.TB, commands ...[]string) []byte {
+	var buf bytes.Buffer
+	for _, args := range commands {
+		vals := make([]interface{}, len(args))
+		for i, arg := range args {
+			vals[i] = arg
+		}
+		writeMultiBulk(&buf, vals...)
+	}
+	return buf.Bytes()
+}
+
+func testCheckAOF(t *testing.T, data []byte, expectPos int, expectErr string) {
+	pos, err := CheckAOF(bytes.NewReader(data))
+	var errstr string
+	if err != nil {
+		errstr = err.Error()
+	}
+	if pos != int64(expectPos) || errstr != expectErr {
+		t.Fatalf("expected pos='%v', err='%v', got pos='%v', err='%v'",
+			expectPos, expectErr, pos, errstr)
+	}
+}
+
+func TestCheckAOF(t *testing.T) {
+	set := testMakeAOF(t, []string{"SET", "key", "value"})
+	data := testMakeAOF(t,
+		[]string{"SELECT", "0"},
+		[]string{"SET", "key", "value"},
+		[]string{"MULTI"},
+		[]string{"INCR", "n"},
+		[]string{"EXEC"},
+	)
+	testCheckAOF(t, data, len(data), "")
+	testCheckAOF(t, nil, 0, "")
+
+	// a command that is cut anywhere is truncated to the previous one
+	for i := 1; i < len(set); i++ {
+		truncated := append(append([]byte(nil), set...), set[:i]...)
+		testCheckAOF(t, truncated, len(set), "unexpected end of file")
+	}
+
+	// a transaction without EXEC is truncated to before the MULTI
+	multi := testMakeAOF(t, []string{"MULTI"}, []string{"INCR", "n"})
+	testCheckAOF(t, append(append([]byte(nil), set...), multi...),
+		len(set), "reached EOF before reading EXEC for MULTI")
+
+	exec := testMakeAOF(t, []string{"EXEC"})
+	testCheckAOF(t, append(append([]byte(nil), set...), exec...),
+		len(set), "unexpected EXEC without MULTI")
+
+	inline := []byte("SET key value\r\n")
+	_, err := CheckAOF(bytes.NewReader(append(append([]byte(nil), set...), inline...)))
+	if err == nil || !strings.Contains(err.Error(), "multibulk") {
+		t.Fatalf("expected a multibulk error, got '%v'", err)
+	}
+}
+
+func TestAOFLoadTruncated(t *testing.T) {
+	ts := testStartServer(t)
+	ts.shutdown()
+	aofPath := path.Join(ts.dir, "appendonly.aof")
+	set := testMakeAOF(t, []string{"SET", "a", "1"})
+	cut := testMakeAOF(t, []string{"SET", "b", "2"})
+	err := ioutil.WriteFile(aofPath, append(append([]byte(nil), set...), cut[:10]...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server doesn't start when it can't load a truncated aof
+	err = Start(&Options{
+		Args:           []string{"--port", "0", "--aof-load-truncated", "no"},
+		AppendOnlyPath: aofPath,
+		LogWriter:      ioutil.Discard,
+	})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// the aof is truncated to the last command and then appended to
+	ts.start()
+	c := ts.dial()
+	c.expect("1", "GET", "a")
+	c.expect("(nil)", "GET", "b")
+	c.expect("+OK", "SET", "c", "3")
+	ts.shutdown()
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := append(set, testMakeAOF(t, []string{"SET", "c", "3"})...)
+	if !bytes.Equal(data, expect) {
+		t.Fatalf("expected '%q', got '%q'", expect, data)
+	}
+	testCheckAOF(t, data, len(data), "")
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"strconv"
+	"time"
+)
+
+// blockedState is the state of a client that is blocked by BLPOP, BRPOP or
+// BRPOPLPUSH until one of the keys has an element, or the timeout passes.
+type blockedState struct {
+	db      *database
+	keys    []string
+	left    bool          // pop from the left side of the list
+	target  string        // the destination list of BRPOPLPUSH
+	timeout time.Duration // zero blocks forever
+	served  chan struct{} // closed when the client is served
+}
+
+// commandResult is a command that was read while the client was blocked.
+type commandResult struct {
+	raw   []byte
+	args  []string
+	flush bool
+	err   error
+}
+
+// rewriteRaw replaces the raw command bytes, which are written to the aof,
+// with another command that has the same effect.
+func (c *client) rewriteRaw(args ...interface{}) {
+	var buf bytes.Buffer
+	writeMultiBulk(&buf, args...)
+	c.raw = buf.Bytes()
+}
+
+// block adds the client to the end of the waiting queue of each key. The
+// client waits in waitBlocked after the lock is released.
+func (c *client) block(keys []string, left bool, target string, timeout time.Duration) {
+	bs := &blockedState{
+		db:      c.db,
+		left:    left,
+		target:  target,
+		timeout: timeout,
+		served:  make(chan struct{}),
+	}
+	for _, key := range keys {
+		var dup bool
+		for _, k := range bs.keys {
+			if k == key {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			bs.keys = append(bs.keys, key)
+			c.db.blocked[key] = append(c.db.blocked[key], c)
+		}
+	}
+	c.blocked = bs
+}
+
+// unblock removes the client from the waiting queues of its keys.
+func (c *client) unblock() {
+	bs := c.blocked
+	if bs == nil {
+		return
+	}
+	for _, key := range bs.keys {
+		clients := bs.db.blocked[key]
+		for i, bc := range clients {
+			if bc == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(bs.db.blocked, key)
+		} else {
+			bs.db.blocked[key] = clients
+		}
+	}
+	c.blocked = nil
+}
+
+// replyBlockedTimeout replies to a client whose block timed out.
+func (c *client) replyBlockedTimeout(bs *blockedState) {
+	if bs.target != "" {
+		c.replyNull()
+	} else {
+		c.replyNullArray()
+	}
+}
+
+// serveBlocked serves the clients that are blocked on keys that were pushed
+// to, in the order that the clients blocked. Called after each write
+// command, under the write lock.
+func (s *Server) serveBlocked() {
+	for _, db := range s.dbs {
+		for len(db.readyKeys) > 0 {
+			key := db.readyKeys[0]
+			db.readyKeys = db.readyKeys[1:]
+			for len(db.blocked[key]) > 0 {
+				l, ok := db.getList(key, false)
+				if !ok || l == nil {
+					break
+				}
+				c := db.blocked[key][0]
+				bs := c.blocked
+				c.unblock()
+				if bs.target != "" {
+					if _, ok := db.getList(bs.target, false); !ok {
+						c.replyTypeError()
+						close(bs.served)
+						continue
+					}
+				}
+				c.popBlocked(key, bs.left, bs.target)
+				db.aofbuf.Write(c.raw)
+				db.touch(key)
+				if bs.target != "" {
+					db.touch(bs.target)
+				}
+				s.dirty++
+				close(bs.served)
+			}
+		}
+		db.readyKeys = nil
+	}
+}
+
+// popBlocked pops an element from the list at key, which must not be empty,
+// and replies to the client. BRPOPLPUSH pushes the element to the target.
+// The command is rewritten to the non-blocking pop for the aof.
+func (c *client) popBlocked(key string, left bool, target string) {
+	c.db.preserve(key)
+	if target != "" {
+		c.db.preserve(target)
+	}
+	l, _ := c.db.getList(key, false)
+	var value string
+	if left {
+		value, _ = l.lpop()
+	} else {
+		value, _ = l.rpop()
+	}
+	if l.len() == 0 {
+		c.db.del(key)
+	}
+	if target != "" {
+		l2, _ := c.db.getList(target, true)
+		l2.lpush(value)
+		c.rewriteRaw("RPOPLPUSH", key, target)
+		c.replyBulk(value)
+	} else {
+		if left {
+			c.rewriteRaw("LPOP", key)
+		} else {
+			c.rewriteRaw("RPOP", key)
+		}
+		c.replyMultiBulkLen(2)
+		c.replyBulk(key)
+		c.replyBulk(value)
+	}
+	c.dirty++
+}
+
+// waitBlocked waits until a blocked client is served by a push, times out,
+// or disconnects. The next command is read in the background to notice a
+// disconnect, and it's returned for the caller to run next.
+func (c *client) waitBlocked(bs *blockedState, rd *commandReader,
+	wr *bufio.Writer) (next chan commandResult, err error) {
+	s := c.s
+	s.mu.Lock()
+	c.setIdleDeadline() // blocked clients don't time out
+	err = wr.Flush()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	read := make(chan commandResult, 1)
+	go func() {
+		var r commandResult
+		r.raw, r.args, r.flush, r.err = rd.readCommand()
+		read <- r
+	}()
+	var timeout <-chan time.Time
+	if bs.timeout > 0 {
+		t := time.NewTimer(bs.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for done := false; !done; {
+		select {
+		case <-bs.served:
+			done = true
+		case <-timeout:
+			done = true
+		case r := <-read:
+			if r.err != nil {
+				// the client is gone
+				s.mu.Lock()
+				c.unblock()
+				s.mu.Unlock()
+				return nil, r.err
+			}
+			// a pipelined command, which runs after the client is unblocked
+			next = make(chan commandResult, 1)
+			next <- r
+			read = nil
+		}
+	}
+	if next == nil {
+		next = read
+	}
+	s.mu.Lock()
+	if c.blocked == bs {
+		c.unblock()
+		c.replyBlockedTimeout(bs)
+	}
+	err = wr.Flush()
+	s.mu.Unlock()
+	return next, err
+}
+
+// unblockAll replies with an error to all blocked clients.
+func (s *Server) unblockAll(msg string) {
+	for c := range s.clients {
+		if bs := c.blocked; bs != nil {
+			c.unblock()
+			c.replyUniqueError(msg)
+			close(bs.served)
+		}
+	}
+}
+
+// blockingPop is the implementation of BLPOP and BRPOP.
+func blockingPop(c *client, left bool) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	timeout, ok := c.blockTimeout(c.args[len(c.args)-1])
+	if !ok {
+		return
+	}
+	keys := c.args[1 : len(c.args)-1]
+	for _, key := range keys {
+		l, ok := c.db.getList(key, false)
+		if !ok {
+			c.replyTypeError()
+			return
+		}
+		if l != nil {
+			c.popBlocked(key, left, "")
+			return
+		}
+	}
+	if c.mblock != nil {
+		// inside of EXEC or a script, which can't block
+		c.replyNullArray()
+		return
+	}
+	c.block(copyStrings(keys), left, "", timeout)
+}
+
+// blockTimeout parses the timeout of a blocking command, in seconds.
+func (c *client) blockTimeout(arg string) (time.Duration, bool) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(secs) {
+		c.replyError("timeout is not a float or out of range")
+		return 0, false
+	}
+	if secs < 0 {
+		c.replyError("timeout is negative")
+		return 0, false
+	}
+	if secs*float64(time.Second) >= math.MaxInt64 {
+		c.replyError("timeout is out of range")
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+func copyStrings(strs []string) []string {
+	cstrs := make([]string, len(strs))
+	for i, s := range strs {
+		cstrs[i] = string(append([]byte(nil), s...))
+	}
+	return cstrs
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestBlockingPop(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect(":2", "RPUSH", "q", "a", "b")
+	c.expect("*[q,a]", "BLPOP", "none", "q", "0")
+	c.expect("*[q,b]", "BRPOP", "q", "0")
+	c.expect("(nil)", "BLPOP", "q", "0.01")
+	c.expect("(nil)", "BRPOPLPUSH", "q", "dst", "0.01")
+	c.expect("+OK", "SET", "str", "v")
+	c.expect("-WRONGTYPE Operation against a key holding the wrong kind of value",
+		"BLPOP", "str", "0")
+
+	// the clients are served in the order that they blocked
+	w1, w2, w3 := ts.dial(), ts.dial(), ts.dial()
+	w1.send("BLPOP", "k1", "k2", "0")
+	c.waitInfo("clients", "blocked_clients", "1")
+	w2.send("BRPOP", "k2", "0")
+	c.waitInfo("clients", "blocked_clients", "2")
+	w3.send("BRPOPLPUSH", "k2", "dst", "0")
+	c.waitInfo("clients", "blocked_clients", "3")
+	c.expect(":3", "LPUSH", "k2", "x", "y", "z")
+	for _, tt := range []struct {
+		c      *testConn
+		expect string
+	}{{w1, "*[k2,z]"}, {w2, "*[k2,x]"}, {w3, "y"}} {
+		if got := tt.c.read(); got != tt.expect {
+			t.Fatalf("expected '%v', got '%v'", tt.expect, got)
+		}
+	}
+	c.expect("*[y]", "LRANGE", "dst", "0", "-1")
+	c.expect(":0", "EXISTS", "k2")
+
+	// the commands after a blocking command wait for it
+	w1.send("BLPOP", "p", "0")
+	w1.send("PING")
+	c.waitInfo("clients", "blocked_clients", "1")
+	c.expect(":1", "RPUSH", "p", "v")
+	if got := w1.read(); got != "*[p,v]" {
+		t.Fatalf("expected '%v', got '%v'", "*[p,v]", got)
+	}
+	if got := w1.read(); got != "+PONG" {
+		t.Fatalf("expected '%v', got '%v'", "+PONG", got)
+	}
+
+	// a client that disconnects stops waiting
+	w3.send("BLPOP", "gone", "0")
+	c.waitInfo("clients", "blocked_clients", "1")
+	w3.conn.Close()
+	c.waitInfo("clients", "blocked_clients", "0")
+	c.expect(":1", "RPUSH", "gone", "v")
+	c.expect(":1", "LLEN", "gone")
+
+	// nothing blocks in a transaction
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "BLPOP", "empty", "0")
+	c.expect("+QUEUED", "BRPOPLPUSH", "empty", "x", "0")
+	c.expect("*[(nil),(nil)]", "EXEC")
+
+	// a push in a script serves the blocked clients
+	w1.send("BLPOP", "sq", "0")
+	c.waitInfo("clients", "blocked_clients", "1")
+	c.expect(":1", "EVAL", "return redis.call('rpush', 'sq', 's')", "0")
+	if got := w1.read(); got != "*[sq,s]" {
+		t.Fatalf("expected '%v', got '%v'", "*[sq,s]", got)
+	}
+
+	// the pops are written instead of the blocking commands
+	ts.restart()
+	data, err := ioutil.ReadFile(path.Join(ts.dir, "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aof := strings.ToUpper(string(data)); strings.Contains(aof, "BLPOP") ||
+		strings.Contains(aof, "BRPOP") {
+		t.Fatalf("expected no blocking commands, got '%q'", data)
+	}
+	c = ts.dial()
+	c.expect("*[y]", "LRANGE", "dst", "0", "-1")
+	c.expect(":0", "EXISTS", "k2")
+	c.expect(":0", "EXISTS", "q")
+	c.expect(":1", "LLEN", "gone")
+	c.expect(":0", "EXISTS", "sq")
+}
+
+func TestBlockingPopSameKey(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect(":2", "RPUSH", "r", "a", "b")
+	c.expect("b", "RPOPLPUSH", "r", "r")
+	c.expect("*[b,a]", "LRANGE", "r", "0", "-1")
+	c.expect("a", "BRPOPLPUSH", "r", "r", "0")
+	c.expect("*[a,b]", "LRANGE", "r", "0", "-1")
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("-ERR timeout is out of range", "BLPOP", "k", "1e20")
+	c.expect("-ERR timeout is out of range", "BRPOPLPUSH", "k", "d", "inf")
+	c.expect("-ERR timeout is not a float or out of range", "BRPOP", "k", "nan")
+	c.expect("-ERR timeout is not a float or out of range", "BLPOP", "k", "x")
+	c.expect("-ERR timeout is negative", "BRPOP", "k", "-1")
+	c.expect("(nil)", "BLPOP", "k", "0.01")
+	c.waitInfo("clients", "blocked_clients", "0")
+}
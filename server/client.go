@@ -2,11 +2,17 @@ package server
 
 import (
 	"io"
+	"io/ioutil"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type client struct {
+	conn    net.Conn  // the client connection
 	wr      io.Writer // client writer
 	s       *Server   // shared server
 	db      *database // the active database
@@ -18,6 +24,54 @@ type client struct {
 	errd    bool      // flag that indicates that the last command was an error
 	authd   int       // 0 = no auth checked, 1 = protected checked, 2 = pass checked
 
+	user atomic.Pointer[aclUser] // the ACL user, nil for the master
+
+	channels map[string]bool // subscribed pubsub channels
+	patterns map[string]bool // subscribed pubsub patterns
+
+	multi      bool            // the client is inside a MULTI block
+	multiAbort bool            // a command failed to queue, EXEC will abort
+	queue      []queuedCommand // commands queued for EXEC
+	watching   []watchedKey    // keys watched for EXEC
+	watchDirty bool            // a watched key was modified
+
+	master   bool // the client is the replication link to the master
+	replPort int  // the listening port of a replica
+
+	depth  int       // the nesting depth of call, for EXEC and scripts
+	mblock *multiAOF // the aof block of the running EXEC or script
+
+	blocked *blockedState // set while blocked by BLPOP, BRPOP or BRPOPLPUSH
+
+	id       int64                   // the unique id of the client
+	name     string                  // the name set by CLIENT SETNAME
+	created  time.Time               // the time the client connected
+	lastTime atomic.Int64            // the time of the last command, in unix nanoseconds
+	lastCmd  atomic.Pointer[command] // the last command
+	out      io.Writer               // the writer of the replies, when they're on
+	replyOff bool                    // replies are off by CLIENT REPLY OFF
+	skipNext bool                    // CLIENT REPLY SKIP skips the next reply
+	skipping bool                    // the reply of the current command is skipped
+	closing  bool                    // close the connection after the reply
+	resp     int                     // the protocol set by HELLO, RESP3 when 3
+	unix     bool                    // connected to the unix socket
+
+	outMu    sync.Mutex    // held while writing to the connection writer
+	pushMu   sync.Mutex    // guards pushes and pushFull
+	pushes   []byte        // pubsub messages waiting for the pusher
+	pushFull bool          // the pushes went over pushLimit
+	pushWake chan struct{} // wakes the pusher
+}
+
+// updateReplies points the client writer at the connection, or discards the
+// replies when they're turned off by CLIENT REPLY. The caller must hold the
+// write lock, publishers check replyOff.
+func (c *client) updateReplies() {
+	if c.replyOff || c.skipping {
+		c.wr = ioutil.Discard
+	} else {
+		c.wr = c.out
+	}
 }
 
 // flushAOF checks if the the client has any dirty markers and
@@ -42,18 +96,18 @@ func (c *client) authenticate(cmd *command) bool {
 	c.s.mu.RLock()
 	defer c.s.mu.RUnlock()
 	if c.authd == 0 {
-		if c.s.protected() {
-			if !strings.HasPrefix(c.addr, "127.0.0.1:") && !strings.HasPrefix(c.addr, "[::1]:") {
-				c.replyProtectedError()
-				return false
-			}
+		if c.s.protected() && !c.local() {
+			c.replyProtectedError()
+			return false
 		}
 		c.authd = 1
 	}
-	if c.s.cfg.requirepass == "" {
+	if c.s.defaultNoPass() {
+		c.user.Store(c.s.acl["default"])
+		c.authd = 2
 		return true
 	}
-	if cmd.name != "auth" {
+	if cmd.name != "auth" && cmd.name != "hello" {
 		c.replyNoAuthError()
 		return false
 	}
@@ -61,6 +115,13 @@ func (c *client) authenticate(cmd *command) bool {
 	return false
 }
 
+// local returns true for the clients of the loopback interface and the unix
+// socket, which are allowed in protected mode.
+func (c *client) local() bool {
+	return c.unix || strings.HasPrefix(c.addr, "127.0.0.1:") ||
+		strings.HasPrefix(c.addr, "[::1]:")
+}
+
 func (c *client) replyString(s string) {
 	io.WriteString(c.wr, "+"+s+"\r\n")
 }
@@ -72,6 +133,10 @@ func (c *client) replyBulk(s string) {
 	io.WriteString(c.wr, "$"+strconv.FormatInt(int64(len(s)), 10)+"\r\n"+s+"\r\n")
 }
 func (c *client) replyNull() {
+	if c.resp == 3 {
+		io.WriteString(c.wr, "_\r\n")
+		return
+	}
 	io.WriteString(c.wr, "$-1\r\n")
 }
 func (c *client) replyInt(n int) {
@@ -80,6 +145,95 @@ func (c *client) replyInt(n int) {
 func (c *client) replyMultiBulkLen(n int) {
 	io.WriteString(c.wr, "*"+strconv.FormatInt(int64(n), 10)+"\r\n")
 }
+
+// protocol returns the protocol version of the client, which is 2 until it's
+// switched by HELLO.
+func (c *client) protocol() int {
+	if c.resp == 3 {
+		return 3
+	}
+	return 2
+}
+
+// The RESP3 types are written as their RESP2 equivalents to the clients that
+// didn't switch protocols with HELLO 3.
+
+// replyNullArray replies with the null of commands that reply with arrays.
+func (c *client) replyNullArray() {
+	if c.resp == 3 {
+		io.WriteString(c.wr, "_\r\n")
+		return
+	}
+	io.WriteString(c.wr, "*-1\r\n")
+}
+
+// replyMapLen starts a map of n pairs, which is a flat array in RESP2.
+func (c *client) replyMapLen(n int) {
+	if c.resp == 3 {
+		io.WriteString(c.wr, "%"+strconv.FormatInt(int64(n), 10)+"\r\n")
+		return
+	}
+	c.replyMultiBulkLen(n * 2)
+}
+func (c *client) replySetLen(n int) {
+	if c.resp == 3 {
+		io.WriteString(c.wr, "~"+strconv.FormatInt(int64(n), 10)+"\r\n")
+		return
+	}
+	c.replyMultiBulkLen(n)
+}
+
+// replyPushLen starts an out of band message, like a pubsub message.
+func (c *client) replyPushLen(n int) {
+	if c.resp == 3 {
+		io.WriteString(c.wr, ">"+strconv.FormatInt(int64(n), 10)+"\r\n")
+		return
+	}
+	c.replyMultiBulkLen(n)
+}
+func (c *client) replyDouble(f float64) {
+	if c.resp == 3 {
+		io.WriteString(c.wr, ","+formatScore(f)+"\r\n")
+		return
+	}
+	c.replyBulk(formatScore(f))
+}
+
+// replyBool replies with a boolean, which is 1 or 0 in RESP2.
+func (c *client) replyBool(b bool) {
+	if c.resp == 3 {
+		if b {
+			io.WriteString(c.wr, "#t\r\n")
+		} else {
+			io.WriteString(c.wr, "#f\r\n")
+		}
+		return
+	}
+	if b {
+		c.replyInt(1)
+	} else {
+		c.replyInt(0)
+	}
+}
+
+// replyVerbatim replies with a verbatim string of a three letter format,
+// like "txt", which is a bulk string in RESP2.
+func (c *client) replyVerbatim(format, s string) {
+	if c.resp == 3 {
+		io.WriteString(c.wr, "="+strconv.FormatInt(int64(len(s)+4), 10)+
+			"\r\n"+format+":"+s+"\r\n")
+		return
+	}
+	c.replyBulk(s)
+}
+func (c *client) replyBigNumber(s string) {
+	if c.resp == 3 {
+		io.WriteString(c.wr, "("+s+"\r\n")
+		return
+	}
+	c.replyBulk(s)
+}
+
 func (c *client) replyError(s string) {
 	c.replyUniqueError("ERR " + s)
 }
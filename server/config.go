@@ -2,9 +2,11 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"strconv"
@@ -17,6 +19,30 @@ type config struct {
 	bindIsLocal   bool
 	protectedMode bool
 	requirepass   string
+	loglevel      string
+	dbfilename    string
+	appendonly    bool
+	appendfsync   string
+
+	autoAOFRewritePercentage int
+	autoAOFRewriteMinSize    int64
+	aofLoadTruncated         bool
+	hz                       int
+	maxmemory                int64
+	maxmemoryPolicy          string
+	slowlogLogSlowerThan     int64
+	slowlogMaxLen            int
+	timeout                  int // close idle clients after seconds, zero is never
+	tcpKeepalive             int // tcp keepalive period in seconds, zero is off
+	maxclients               int
+	tlsPort                  int
+	tlsCertFile              string
+	tlsKeyFile               string
+	tlsCAFile                string
+	tlsAuthClients           string // yes, no or optional
+	unixsocket               string
+	unixsocketperm           os.FileMode // zero keeps the default permissions
+	aclfile                  string
 
 	kvm  map[string]string
 	file string
@@ -32,16 +58,218 @@ func (err *cfgerr) Error() string {
 	return fmt.Sprintf("Fatal config file error: '%s \"%s\"': %s", err.property, err.value, err.message)
 }
 
-func fillBoolConfigOption(configMap map[string]string, configKey string, defaultValue bool) {
-	switch strings.ToLower(configMap[configKey]) {
+type directiveKind int
+
+const (
+	stringDirective directiveKind = iota
+	boolDirective                 // yes or no
+	intDirective                  // an integer from min to max
+	memoryDirective               // a memory size, like 64mb
+	enumDirective                 // one of enum, case insensitive
+)
+
+// directive is a configuration directive. The value is read from the config
+// file and the command line, and shown by CONFIG GET as the string in
+// config.kvm.
+type directive struct {
+	name     string
+	kind     directiveKind
+	def      string   // the default value
+	min, max int64    // the range of an int directive
+	clamp    bool     // an int outside of the range is clamped, not invalid
+	base     int      // the base of an int directive, 10 when zero
+	enum     []string // the values of an enum directive
+	invalid  string   // the config file error for an invalid value
+	mutable  bool     // may be changed with CONFIG SET
+
+	// field returns a pointer to the field of the config, which is a *string,
+	// *bool, *int, *int64 or *os.FileMode.
+	field func(cfg *config) interface{}
+	// check validates the value after the kind, returning the error.
+	check func(v string) error
+	// apply is called by CONFIG SET after the field is changed. It returns
+	// false after replying with an error, and the field is restored.
+	apply func(c *client) bool
+}
+
+// directives are the configuration directives, in the order of CONFIG GET.
+var directives = []*directive{
+	{name: "bind", kind: stringDirective,
+		field: func(cfg *config) interface{} { return &cfg.bind }},
+	{name: "port", kind: intDirective, def: "6379", max: 65535,
+		invalid: "Invalid port",
+		field:   func(cfg *config) interface{} { return &cfg.port }},
+	{name: "protected-mode", kind: boolDirective, def: "yes", mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.protectedMode }},
+	{name: "loglevel", kind: enumDirective, def: "notice", mutable: true,
+		enum:  logLevels,
+		field: func(cfg *config) interface{} { return &cfg.loglevel },
+		apply: applyLogLevel},
+	{name: "requirepass", kind: stringDirective, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.requirepass },
+		apply: applyRequirePass},
+	{name: "dbfilename", kind: stringDirective, def: "dump.rdb", mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.dbfilename },
+		check: checkDBFilename, apply: applyDBFilename},
+	{name: "appendonly", kind: boolDirective, def: "yes", mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.appendonly },
+		apply: applyAppendOnly},
+	{name: "appendfsync", kind: enumDirective, def: "everysec", mutable: true,
+		enum:  []string{"always", "everysec", "no"},
+		field: func(cfg *config) interface{} { return &cfg.appendfsync }},
+	{name: "auto-aof-rewrite-percentage", kind: intDirective, def: "100",
+		max: math.MaxInt32, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.autoAOFRewritePercentage }},
+	{name: "auto-aof-rewrite-min-size", kind: memoryDirective, def: "64mb",
+		mutable: true,
+		field:   func(cfg *config) interface{} { return &cfg.autoAOFRewriteMinSize }},
+	{name: "aof-load-truncated", kind: boolDirective, def: "yes", mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.aofLoadTruncated }},
+	{name: "hz", kind: intDirective, def: "10", min: 1, max: 500, clamp: true,
+		mutable: true,
+		field:   func(cfg *config) interface{} { return &cfg.hz }},
+	{name: "maxmemory", kind: memoryDirective, def: "0", mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.maxmemory }},
+	{name: "maxmemory-policy", kind: enumDirective, def: "noeviction",
+		enum: maxmemoryPolicies, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.maxmemoryPolicy }},
+	{name: "slowlog-log-slower-than", kind: intDirective, def: "10000",
+		min: math.MinInt64, max: math.MaxInt64, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.slowlogLogSlowerThan },
+		apply: applySlowlog},
+	{name: "slowlog-max-len", kind: intDirective, def: "128",
+		max: math.MaxInt32, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.slowlogMaxLen },
+		apply: applySlowlog},
+	{name: "timeout", kind: intDirective, def: "0", max: math.MaxInt32,
+		mutable: true,
+		field:   func(cfg *config) interface{} { return &cfg.timeout },
+		apply:   applyTimeout},
+	{name: "tcp-keepalive", kind: intDirective, def: "300",
+		max: math.MaxInt32, mutable: true, // applies to new connections
+		field: func(cfg *config) interface{} { return &cfg.tcpKeepalive }},
+	{name: "maxclients", kind: intDirective, def: "10000", min: 1,
+		max: math.MaxInt32, mutable: true, invalid: "Invalid max clients limit",
+		field: func(cfg *config) interface{} { return &cfg.maxclients },
+		apply: applyMaxclients},
+	{name: "tls-port", kind: intDirective, def: "0", max: 65535,
+		field: func(cfg *config) interface{} { return &cfg.tlsPort }},
+	{name: "tls-cert-file", kind: stringDirective, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.tlsCertFile },
+		apply: applyTLS},
+	{name: "tls-key-file", kind: stringDirective, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.tlsKeyFile },
+		apply: applyTLS},
+	{name: "tls-ca-cert-file", kind: stringDirective, mutable: true,
+		field: func(cfg *config) interface{} { return &cfg.tlsCAFile },
+		apply: applyTLS},
+	{name: "tls-auth-clients", kind: enumDirective, def: "yes", mutable: true,
+		enum:  []string{"yes", "no", "optional"},
+		field: func(cfg *config) interface{} { return &cfg.tlsAuthClients },
+		apply: applyTLS},
+	{name: "unixsocket", kind: stringDirective,
+		field: func(cfg *config) interface{} { return &cfg.unixsocket }},
+	{name: "unixsocketperm", kind: intDirective, def: "0", max: 0777, base: 8,
+		invalid: "Invalid socket file permissions",
+		field:   func(cfg *config) interface{} { return &cfg.unixsocketperm }},
+	{name: "aclfile", kind: stringDirective,
+		field: func(cfg *config) interface{} { return &cfg.aclfile }},
+}
+
+// lookupDirective returns the directive with the name, which is case
+// insensitive, or nil.
+func lookupDirective(name string) *directive {
+	name = strings.ToLower(name)
+	for _, d := range directives {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// parse validates a value of the directive. Returns the value as it's shown
+// by CONFIG GET, and the value for the field of the config.
+func (d *directive) parse(v string) (string, interface{}, bool) {
+	switch d.kind {
+	case boolDirective:
+		switch lv := strings.ToLower(v); lv {
+		case "yes", "no":
+			return lv, lv == "yes", true
+		}
+	case enumDirective:
+		lv := strings.ToLower(v)
+		for _, e := range d.enum {
+			if lv == e {
+				return lv, lv, true
+			}
+		}
+	case intDirective:
+		base := d.base
+		if base == 0 {
+			base = 10
+		}
+		n, err := strconv.ParseInt(v, base, 64)
+		if err != nil {
+			break
+		}
+		if n < d.min || n > d.max {
+			if !d.clamp {
+				break
+			}
+			if n < d.min {
+				n = d.min
+			} else {
+				n = d.max
+			}
+		}
+		return strconv.FormatInt(n, base), n, true
+	case memoryDirective:
+		// the sizes are kept in bytes, like Redis reports them
+		if n, ok := parseMemorySize(v); ok {
+			return strconv.FormatInt(n, 10), n, true
+		}
 	default:
-		if defaultValue {
-			configMap[configKey] = "yes"
-		} else {
-			configMap[configKey] = "no"
+		return v, v, true
+	}
+	return "", nil, false
+}
+
+// invalidMessage returns the config file error for an invalid value.
+func (d *directive) invalidMessage() string {
+	switch {
+	case d.invalid != "":
+		return d.invalid
+	case d.kind == boolDirective:
+		return "argument must be 'yes' or 'no'"
+	case d.kind == enumDirective:
+		msg := "argument must be "
+		for i, e := range d.enum {
+			if i == len(d.enum)-1 {
+				msg += " or "
+			} else if i > 0 {
+				msg += ", "
+			}
+			msg += "'" + e + "'"
 		}
-	case "yes", "no":
-		configMap[configKey] = strings.ToLower(configMap[configKey])
+		return msg
+	}
+	return "Invalid " + d.name
+}
+
+// set stores the value from parse in the field of the config.
+func (d *directive) set(cfg *config, v interface{}) {
+	switch field := d.field(cfg).(type) {
+	case *string:
+		*field = v.(string)
+	case *bool:
+		*field = v.(bool)
+	case *int:
+		*field = int(v.(int64))
+	case *int64:
+		*field = v.(int64)
+	case *os.FileMode:
+		*field = os.FileMode(v.(int64))
 	}
 }
 
@@ -77,20 +305,12 @@ func fillOptions(options *Options) (
 	if configMap == nil {
 		configMap = map[string]string{}
 	}
-	// force valid strings into each config property
-	s := func(s string) string {
-		return s
-	}
-	configMap["bind"] = s(configMap["bind"])
-	configMap["port"] = s(configMap["port"])
-	configMap["protected-mode"] = s(configMap["protected-mode"])
-	configMap["requirepass"] = s(configMap["requirepass"])
-
 	// defaults
-	if configMap["port"] == "" {
-		configMap["port"] = "6379"
+	for _, d := range directives {
+		if _, ok := configMap[d.name]; !ok {
+			configMap[d.name] = d.def
+		}
 	}
-	fillBoolConfigOption(configMap, "protected-mode", true)
 	return options, configMap, configFile, true
 }
 
@@ -98,25 +318,127 @@ func fillConfig(configMap map[string]string, configFile string) (*config, error)
 	cfg := &config{}
 	cfg.file = configFile
 	cfg.kvm = configMap
-	n, err := strconv.ParseUint(configMap["port"], 10, 16)
-	if err != nil {
-		return nil, &cfgerr{"Invalid port", "port", configMap["port"]}
+	for _, d := range directives {
+		v, val, ok := d.parse(configMap[d.name])
+		if !ok {
+			return nil, &cfgerr{d.invalidMessage(), d.name, configMap[d.name]}
+		}
+		if d.check != nil {
+			if err := d.check(v); err != nil {
+				return nil, &cfgerr{err.Error(), d.name, configMap[d.name]}
+			}
+		}
+		configMap[d.name] = v
+		d.set(cfg, val)
 	}
-	cfg.port = int(n)
-	cfg.bind = strings.ToLower(configMap["bind"])
+	cfg.bind = strings.ToLower(cfg.bind)
 	cfg.bindIsLocal = cfg.bind == "" || cfg.bind == "127.0.0.1" || cfg.bind == "::1" || cfg.bind == "localhost"
-	switch strings.ToLower(configMap["protected-mode"]) {
-	default:
-		return nil, &cfgerr{"argument must be 'yes' or 'no'", "protected-mode", configMap["protected-mode"]}
-	case "yes":
-		cfg.protectedMode = true
-	case "no":
-		cfg.protectedMode = false
+	if cfg.port == 0 && cfg.tlsPort == 0 && cfg.unixsocket == "" {
+		return nil, &cfgerr{"Configured to not listen anywhere", "port", configMap["port"]}
 	}
-	cfg.requirepass = configMap["requirepass"]
 	return cfg, nil
 }
 
+func checkDBFilename(v string) error {
+	if v == "" || path.Base(v) != v {
+		return errors.New("dbfilename can't be a path, just a filename")
+	}
+	return nil
+}
+
+func applyDBFilename(c *client) bool {
+	c.s.rdbPath = path.Join(path.Dir(c.s.rdbPath), c.s.cfg.dbfilename)
+	return true
+}
+
+// applyRequirePass changes the password of the default user.
+func applyRequirePass(c *client) bool {
+	u := c.s.acl["default"].clone()
+	u.setRequirePass(c.s.cfg.requirepass)
+	c.s.aclSetUser(u)
+	return true
+}
+
+// applyAppendOnly starts or stops the aof.
+func applyAppendOnly(c *client) bool {
+	s := c.s
+	if s.cfg.appendonly && s.aof == nil {
+		if s.aofrewrite {
+			c.replyError("Background append only file rewriting already in progress")
+			return false
+		}
+		if err := s.startAOF(); err != nil {
+			c.replyError(fmt.Sprintf("Unable to turn on AOF: %v", err))
+			return false
+		}
+	} else if !s.cfg.appendonly && s.aof != nil {
+		if err := s.stopAOF(); err != nil {
+			c.replyError(fmt.Sprintf("Unable to turn off AOF: %v", err))
+			return false
+		}
+	}
+	return true
+}
+
+// applyLogLevel changes the level of the messages that are logged.
+func applyLogLevel(c *client) bool {
+	c.s.setLogLevel(c.s.cfg.loglevel)
+	return true
+}
+
+func applySlowlog(c *client) bool {
+	c.s.slowlog.configure(c.s.cfg)
+	return true
+}
+
+// applyTimeout sets the deadlines of the connected clients for the new
+// timeout.
+func applyTimeout(c *client) bool {
+	for ic := range c.s.clients {
+		if ic != c {
+			ic.setIdleDeadline()
+		}
+	}
+	return true
+}
+
+// applyMaxclients checks that the open files limit allows maxclients.
+func applyMaxclients(c *client) bool {
+	n := uint64(c.s.cfg.maxclients)
+	if limit, _ := raiseOpenFilesLimit(n + reservedFDs); limit != 0 && limit < n+reservedFDs {
+		c.replyError(fmt.Sprintf("The operating system is not able to handle "+
+			"the specified number of clients, try with %d", limit-reservedFDs))
+		return false
+	}
+	return true
+}
+
+// parseMemorySize parses a memory size such as "64mb" into bytes. The units
+// follow Redis, where "k" is 1000 bytes and "kb" is 1024 bytes.
+func parseMemorySize(s string) (int64, bool) {
+	s = strings.ToLower(s)
+	mul := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mul    int64
+	}{
+		{"gb", 1024 * 1024 * 1024}, {"mb", 1024 * 1024}, {"kb", 1024},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000},
+		{"b", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = s[:len(s)-len(unit.suffix)]
+			mul = unit.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, false
+	}
+	return n * mul, true
+}
+
 func loadConfigArgs(options *Options) (config map[string]string, file string, ok bool) {
 	config = make(map[string]string)
 	ln := 2
@@ -141,27 +463,15 @@ func loadConfigArgs(options *Options) (config map[string]string, file string, ok
 				}
 				vals = append(vals, options.Args[i])
 			}
-			i += len(vals)
+			i-- // the next flag is visited by the outer loop
 			if strings.HasPrefix(arg, "--") {
 				arg = arg[2:]
 			}
-			switch arg {
-			default:
+			if lookupDirective(arg) == nil || len(vals) != 1 {
 				printBadConfig(arg, vals, ln, options)
 				return nil, "", false
-			case "port":
-				if len(vals) != 1 {
-					printBadConfig(arg, vals, ln, options)
-					return nil, "", false
-				}
-				config["port"] = vals[0]
-			case "bind":
-				if len(vals) != 1 {
-					printBadConfig(arg, vals, ln, options)
-					return nil, "", false
-				}
-				config["port"] = vals[0]
 			}
+			config[strings.ToLower(arg)] = vals[0]
 			ln++
 		case "--help", "-h":
 			printHelp(options)
@@ -208,17 +518,16 @@ func readConfigFile(file string, config map[string]string, options *Options) (in
 			arg = line[:sp]
 			val = strings.TrimSpace(line[sp:])
 		}
-		config[arg] = val
-		switch arg {
-		default:
+		if len(val) > 1 && val[0] == '"' && val[len(val)-1] == '"' {
+			if uval, err := strconv.Unquote(val); err == nil {
+				val = uval
+			}
+		}
+		if lookupDirective(arg) == nil || val == "" {
 			printBadConfig(line, nil, ln, options)
 			return 0, false
-		case "port", "protected-mode", "bind", "requirepass":
-			if val == "" {
-				printBadConfig(line, nil, ln, options)
-				return 0, false
-			}
 		}
+		config[strings.ToLower(arg)] = val
 		if err == io.EOF {
 			break
 		}
@@ -227,32 +536,70 @@ func readConfigFile(file string, config map[string]string, options *Options) (in
 	return ln + 1, true
 }
 
-func mergeConfigFile(file string, config map[string]string) error {
+// rewriteConfigFile writes the directives to the config file. The lines of
+// the directives in the file are changed in place, keeping the comments and
+// the order of the file. The directives that aren't in the file are added at
+// the end, unless they have the default value.
+func rewriteConfigFile(file string, config map[string]string) error {
 	data, err := ioutil.ReadFile(file)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
-nextkey:
-	for k, v := range config {
-		for i, line := range lines {
-			line = strings.TrimSpace(line)
-			if line == k || strings.HasPrefix(line, k+" ") {
-				if v == "" {
-					// erase line
-					lines = append(lines[:i], lines[i+1:]...)
-				} else {
-					// modify line
-					lines[i] = k + " " + v
-				}
-				continue nextkey
-			}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+	seen := make(map[string]bool)
+	var out []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			out = append(out, line)
+			continue
+		}
+		d := lookupDirective(fields[0])
+		if d == nil {
+			out = append(out, line)
+			continue
 		}
-		if v != "" {
-			lines = append(lines, k+" "+v)
+		if seen[d.name] || config[d.name] == "" {
+			// a repeated directive, or an empty value that can't be read
+			continue
+		}
+		seen[d.name] = true
+		out = append(out, configLine(d.name, config[d.name]))
+	}
+	generated := false
+	for _, d := range directives {
+		def, _, _ := d.parse(d.def)
+		if seen[d.name] || config[d.name] == "" || config[d.name] == def {
+			continue
+		}
+		if !generated {
+			out = append(out, "# Generated by CONFIG REWRITE")
+			generated = true
 		}
+		out = append(out, configLine(d.name, config[d.name]))
+	}
+	tmp := file + ".tmp"
+	data = []byte(strings.Join(out, "\n") + "\n")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// configLine returns the line of a directive for the config file. Values
+// with spaces or quotes are quoted.
+func configLine(name, value string) string {
+	if strings.ContainsAny(value, " \t\"'\\") {
+		value = strconv.Quote(value)
 	}
-	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644)
+	return name + " " + value
 }
 
 func printHelp(options *Options) {
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseMemorySize(t *testing.T) {
+	for _, tt := range []struct {
+		s      string
+		expect int64
+		ok     bool
+	}{
+		{"0", 0, true},
+		{"100", 100, true},
+		{"100b", 100, true},
+		{"1k", 1000, true},
+		{"1kb", 1024, true},
+		{"2m", 2000000, true},
+		{"2MB", 2 * 1024 * 1024, true},
+		{"3g", 3000000000, true},
+		{"3Gb", 3 * 1024 * 1024 * 1024, true},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"8589934591gb", 8589934591 * 1024 * 1024 * 1024, true},
+		{"8589934592gb", 0, false},
+		{"9223372036854775807k", 0, false},
+		{"9223372036854775808", 0, false},
+		{"-1", 0, false},
+		{"-1mb", 0, false},
+		{"", 0, false},
+		{"mb", 0, false},
+		{"1tb", 0, false},
+		{"1.5mb", 0, false},
+	} {
+		n, ok := parseMemorySize(tt.s)
+		if n != tt.expect || ok != tt.ok {
+			t.Fatalf("%v: expected n='%v', ok='%v', got n='%v', ok='%v'",
+				tt.s, tt.expect, tt.ok, n, ok)
+		}
+	}
+}
+
+// testSyncBuffer is a buffer that's safe to write from the server.
+type testSyncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *testSyncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *testSyncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConfigFile(t *testing.T) {
+	file := path.Join(t.TempDir(), "sider.conf")
+	data := "# my settings\nhz 20\n\n# memory\nmaxmemory 1mb\nrequirepass \"a b\"\nHZ 30\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{t: t, dir: t.TempDir(), conf: file,
+		args: []string{"--protected-mode", "no", "--appendonly", "no"}}
+	ts.start()
+	t.Cleanup(ts.shutdown)
+	c := ts.dial()
+	c.expect("+OK", "AUTH", "a b")
+	c.expect("*[hz,30]", "CONFIG", "GET", "hz")
+	c.expect("*[protected-mode,no]", "CONFIG", "GET", "protected-mode")
+	c.expect("*[maxmemory,1048576,maxmemory-policy,noeviction]", "CONFIG", "GET", "maxmemory*")
+	c.expect("*[hz,30,appendonly,no,appendfsync,everysec]",
+		"CONFIG", "GET", "HZ", "append*", "hz")
+	c.expect("*[]", "CONFIG", "GET", "nothing")
+	if got := c.do("CONFIG", "GET", "*"); strings.Count(got, ",")+1 != 2*len(directives) {
+		t.Fatalf("expected %v fields, got '%v'", 2*len(directives), got)
+	}
+
+	c.expect("-ERR Unsupported CONFIG parameter: port", "CONFIG", "SET", "port", "1")
+	c.expect("-ERR Unsupported CONFIG parameter: nothing", "CONFIG", "SET", "nothing", "1")
+	c.expect("-ERR Invalid argument 'maybe' for CONFIG SET 'protected-mode'",
+		"CONFIG", "SET", "protected-mode", "maybe")
+	c.expect("-ERR Invalid argument '1x' for CONFIG SET 'slowlog-max-len'",
+		"CONFIG", "SET", "slowlog-max-len", "1x")
+	c.expect("-ERR Invalid argument '99999999999gb' for CONFIG SET 'maxmemory'",
+		"CONFIG", "SET", "maxmemory", "99999999999gb")
+	c.expect("-ERR dbfilename can't be a path, just a filename",
+		"CONFIG", "SET", "dbfilename", "a/b")
+	c.expect("+OK", "CONFIG", "SET", "hz", "0")
+	c.expect("*[hz,1]", "CONFIG", "GET", "hz")
+	c.expect("+OK", "CONFIG", "SET", "maxmemory-policy", "ALLKEYS-LRU")
+	c.expect("*[maxmemory-policy,allkeys-lru]", "CONFIG", "GET", "maxmemory-policy")
+	c.expect("+OK", "CONFIG", "SET", "Timeout", "5")
+
+	// the rewrite keeps the comments and the order of the file
+	c.expect("+OK", "CONFIG", "SET", "requirepass", "x \"y\"")
+	c.expect("+OK", "CONFIG", "REWRITE")
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "# my settings\nhz 1\n\n# memory\nmaxmemory 1048576\n" +
+		"requirepass \"x \\\"y\\\"\"\n# Generated by CONFIG REWRITE\n" +
+		"port " + strconv.Itoa(ts.port) + "\nprotected-mode no\n" +
+		"dbfilename " + ts.dbfilename + "\nappendonly no\nmaxmemory-policy allkeys-lru\ntimeout 5\n"
+	if string(got) != expect {
+		t.Fatalf("expected '%v', got '%v'", expect, string(got))
+	}
+
+	// the rewritten file is loaded
+	c.do("SHUTDOWN", "NOSAVE")
+	if err := <-ts.done; err != nil {
+		t.Fatal(err)
+	}
+	ts.args = nil
+	ts.start()
+	c = ts.dial()
+	c.expect("+OK", "AUTH", "x \"y\"")
+	c.expect("*[timeout,5]", "CONFIG", "GET", "timeout")
+	c.expect("+OK", "CONFIG", "SET", "requirepass", "")
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"--port", "x"},
+		{"--hz", "1", "2"},
+		{"--bogus", "1"},
+		{"--appendonly", "maybe"},
+		{"--maxclients", "0"},
+		{"--loglevel", "loud"},
+	} {
+		if err := Start(&Options{Args: args, LogWriter: ioutil.Discard}); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestConfigLoglevel(t *testing.T) {
+	var logs testSyncBuffer
+	ts := &testServer{t: t, dir: t.TempDir(), log: &logs, args: []string{"--loglevel", "verbose"}}
+	ts.start()
+	t.Cleanup(ts.shutdown)
+	c := ts.dial()
+	c.expect("*[loglevel,verbose]", "CONFIG", "GET", "loglevel")
+	c.expect("(nil)", "EVAL", "redis.log(redis.LOG_VERBOSE, 'msg-first')", "0")
+	c.expect("(nil)", "EVAL", "redis.log(redis.LOG_DEBUG, 'msg-second')", "0")
+	c.expect("+OK", "CONFIG", "SET", "loglevel", "WARNING")
+	c.expect("*[loglevel,warning]", "CONFIG", "GET", "loglevel")
+	c.expect("(nil)", "EVAL", "redis.log(redis.LOG_NOTICE, 'msg-third')", "0")
+	c.expect("(nil)", "EVAL", "redis.log(redis.LOG_WARNING, 'msg-fourth')", "0")
+	c.expect("-ERR Invalid argument 'loud' for CONFIG SET 'loglevel'",
+		"CONFIG", "SET", "loglevel", "loud")
+	got := logs.String()
+	for msg, logged := range map[string]bool{
+		"msg-first": true, "msg-second": false, "msg-third": false, "msg-fourth": true,
+	} {
+		if strings.Contains(got, msg) != logged {
+			t.Fatalf("%v: expected logged='%v', got '%v'", msg, logged, got)
+		}
+	}
+}
@@ -1,6 +1,16 @@
 package server
 
-import "strconv"
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
 
 func echoCommand(c *client) {
 	if len(c.args) != 2 {
@@ -11,6 +21,21 @@ func echoCommand(c *client) {
 }
 
 func pingCommand(c *client) {
+	if c.subscribed() && c.resp != 3 {
+		switch len(c.args) {
+		default:
+			c.replyAritryError()
+		case 1, 2:
+			c.replyMultiBulkLen(2)
+			c.replyBulk("pong")
+			if len(c.args) == 2 {
+				c.replyBulk(c.args[1])
+			} else {
+				c.replyBulk("")
+			}
+		}
+		return
+	}
 	switch len(c.args) {
 	default:
 		c.replyAritryError()
@@ -34,3 +59,622 @@ func selectCommand(c *client) {
 	c.db = c.s.selectDB(int(num))
 	c.replyString("OK")
 }
+
+// addClient assigns an id to a new client and adds it to the clients. The
+// caller must hold the write lock.
+func (s *Server) addClient(c *client) {
+	s.lastClientID++
+	c.id = s.lastClientID
+	s.clients[c] = true
+}
+
+// helloCommand is HELLO [protover [AUTH username password] [SETNAME name]],
+// which switches the protocol of the client and replies with the server
+// info. Like AUTH, it runs before the client is authenticated.
+func helloCommand(c *client) {
+	resp := c.protocol()
+	if len(c.args) > 1 {
+		n, err := strconv.Atoi(c.args[1])
+		if err != nil {
+			c.replyError("Protocol version is not an integer or out of range")
+			return
+		}
+		if n != 2 && n != 3 {
+			c.replyUniqueError("NOPROTO unsupported protocol version")
+			return
+		}
+		resp = n
+	}
+	var auth bool
+	var user, pass, name string
+	var setname bool
+	for i := 2; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replyError("Syntax error in HELLO option '" + c.args[i] + "'")
+			return
+		case "auth":
+			if i+2 >= len(c.args) {
+				c.replyError("Syntax error in HELLO option '" + c.args[i] + "'")
+				return
+			}
+			auth, user, pass = true, c.args[i+1], c.args[i+2]
+			i += 2
+		case "setname":
+			if i+1 >= len(c.args) {
+				c.replyError("Syntax error in HELLO option '" + c.args[i] + "'")
+				return
+			}
+			name, setname = c.args[i+1], true
+			i++
+		}
+	}
+	if auth {
+		u := c.s.aclAuth(user, pass)
+		if u == nil {
+			c.replyUniqueError("WRONGPASS invalid username-password pair or user is disabled.")
+			return
+		}
+		c.user.Store(u)
+		c.authd = 2
+	} else if c.authd != 2 {
+		c.replyUniqueError("NOAUTH HELLO must be called with the client " +
+			"already authenticated, otherwise the HELLO <proto> AUTH <user> " +
+			"<pass> option can be used to authenticate the client and select " +
+			"the RESP protocol version at the same time")
+		return
+	}
+	if setname {
+		if !validClientName(name) {
+			c.replyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = name
+	}
+	c.resp = resp
+	role := "master"
+	if c.s.follower {
+		role = "replica"
+	}
+	c.replyMapLen(7)
+	c.replyBulk("server")
+	c.replyBulk("redis")
+	c.replyBulk("version")
+	c.replyBulk(c.s.options.Version)
+	c.replyBulk("proto")
+	c.replyInt(c.resp)
+	c.replyBulk("id")
+	c.replyInt(int(c.id))
+	c.replyBulk("mode")
+	c.replyBulk(c.s.mode)
+	c.replyBulk("role")
+	c.replyBulk(role)
+	c.replyBulk("modules")
+	c.replyMultiBulkLen(0)
+}
+
+// validClientName returns false for names with spaces, newlines or special
+// characters.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setIdleDeadline sets the read deadline of the connection, which closes the
+// client after it's idle for the timeout. Like Redis, the monitors, the
+// subscribers, the blocked clients, the replicas and the master are never
+// closed. The caller must hold a lock.
+func (c *client) setIdleDeadline() {
+	if c.conn == nil || c.master {
+		return
+	}
+	var deadline time.Time
+	_, replica := c.s.replicas[c]
+	if c.s.cfg.timeout > 0 && !c.monitor && !c.subscribed() &&
+		c.blocked == nil && !replica {
+		last := time.Unix(0, c.lastTime.Load())
+		deadline = last.Add(time.Duration(c.s.cfg.timeout) * time.Second)
+	}
+	c.conn.SetReadDeadline(deadline)
+}
+
+// setKeepAlive sets the tcp keepalive period of the connection, zero turns
+// keepalive off.
+func setKeepAlive(conn net.Conn, secs int) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if secs == 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(time.Duration(secs) * time.Second)
+}
+
+// reservedFDs is the number of file descriptors that are reserved for the
+// listener, the aof, the rdb and the replication, like Redis.
+const reservedFDs = 32
+
+// raiseOpenFilesLimit raises the open files limit to n, or as close to n as
+// the hard limit allows. Returns the limit, which is unchanged when it's
+// already at least n, or zero when the limit is unknown.
+func raiseOpenFilesLimit(n uint64) (uint64, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	if lim.Cur >= n {
+		return lim.Cur, nil
+	}
+	want := syscall.Rlimit{Cur: n, Max: lim.Max}
+	if want.Max < n {
+		// only a privileged process may raise the hard limit
+		want.Max = n
+	}
+	err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want)
+	if err == nil {
+		return n, nil
+	}
+	if lim.Max > lim.Cur {
+		want = syscall.Rlimit{Cur: lim.Max, Max: lim.Max}
+		if syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want) == nil {
+			return lim.Max, err
+		}
+	}
+	return lim.Cur, err
+}
+
+// adjustOpenFilesLimit raises the open files limit to fit maxclients at
+// startup, or lowers maxclients to fit the limit.
+func (s *Server) adjustOpenFilesLimit() error {
+	maxfiles := uint64(s.cfg.maxclients) + reservedFDs
+	limit, err := raiseOpenFilesLimit(maxfiles)
+	if limit == 0 {
+		s.lwarningf("Unable to obtain the current NOFILE limit (%v), assuming "+
+			"1024 and setting the max clients configuration accordingly.", err)
+		limit = 1024
+	}
+	if limit >= maxfiles {
+		return nil
+	}
+	if limit <= reservedFDs {
+		return fmt.Errorf("Your current 'ulimit -n' of %d is not enough for "+
+			"the server to start. Please increase your open file limit to at "+
+			"least %d. Exiting.", limit, reservedFDs+1)
+	}
+	maxclients := int(limit - reservedFDs)
+	s.lwarningf("You requested maxclients of %d requiring at least %d max "+
+		"file descriptors.", s.cfg.maxclients, maxfiles)
+	if err != nil {
+		s.lwarningf("Server can't set maximum open files to %d because of OS "+
+			"error: %v.", maxfiles, err)
+	}
+	s.lwarningf("Current maximum open files is %d. maxclients has been "+
+		"reduced to %d to compensate for low ulimit. If you need higher "+
+		"maxclients increase 'ulimit -n'.", limit, maxclients)
+	s.cfg.maxclients = maxclients
+	s.cfg.kvm["maxclients"] = strconv.Itoa(maxclients)
+	return nil
+}
+
+// clientType returns the type of the client for CLIENT LIST and CLIENT KILL,
+// which is one of normal, master, replica or pubsub.
+func (c *client) clientType() string {
+	if c.master {
+		return "master"
+	}
+	if _, ok := c.s.replicas[c]; ok {
+		return "replica"
+	}
+	if c.subscribed() {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// parseClientType parses the type argument of CLIENT LIST and CLIENT KILL.
+func parseClientType(typ string) (string, bool) {
+	switch strings.ToLower(typ) {
+	case "normal", "master", "replica", "pubsub":
+		return strings.ToLower(typ), true
+	case "slave":
+		return "replica", true
+	}
+	return "", false
+}
+
+// localAddr returns the address of the server side of the connection.
+func (c *client) localAddr() string {
+	if c.unix {
+		return c.addr
+	}
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.LocalAddr().String()
+}
+
+// clientInfo returns the CLIENT LIST line of the client.
+func (c *client) clientInfo() string {
+	now := time.Now()
+	var flags []byte
+	if c.monitor {
+		flags = append(flags, 'O')
+	}
+	if c.unix {
+		flags = append(flags, 'U')
+	}
+	switch c.clientType() {
+	case "master":
+		flags = append(flags, 'M')
+	case "replica":
+		flags = append(flags, 'S')
+	case "pubsub":
+		flags = append(flags, 'P')
+	}
+	if c.multi {
+		flags = append(flags, 'x')
+	}
+	if c.blocked != nil {
+		flags = append(flags, 'b')
+	}
+	if c.watchDirty {
+		flags = append(flags, 'd')
+	}
+	if len(flags) == 0 {
+		flags = append(flags, 'N')
+	}
+	multi := -1
+	if c.multi {
+		multi = len(c.queue)
+	}
+	cmd := "NULL"
+	if last := c.lastCmd.Load(); last != nil {
+		cmd = last.name
+	}
+	idle := now.Sub(time.Unix(0, c.lastTime.Load()))
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d "+
+		"flags=%s db=%d sub=%d psub=%d multi=%d watch=%d cmd=%s user=%s resp=%d",
+		c.id, c.addr, c.localAddr(), c.name, now.Sub(c.created)/time.Second,
+		idle/time.Second, flags, c.db.num, len(c.channels), len(c.patterns),
+		multi, len(c.watching), cmd, c.userName(), c.protocol())
+}
+
+// sortedClients returns the clients ordered by id.
+func (s *Server) sortedClients() []*client {
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
+
+// mayReplicate returns true for the commands that are paused by CLIENT PAUSE
+// WRITE, which are the commands that may change the dataset.
+func (cmd *command) mayReplicate() bool {
+	switch cmd.name {
+	case "eval", "evalsha", "exec", "publish":
+		return true
+	}
+	return cmd.aof
+}
+
+// paused returns true while the clients are paused by CLIENT PAUSE. The
+// caller must hold a lock.
+func (s *Server) paused() bool {
+	return s.pauseCh != nil && time.Now().Before(s.pauseEnd)
+}
+
+// waitPause waits until the command isn't paused by CLIENT PAUSE. Replicas
+// and the CLIENT command, which ends the pause, are never paused.
+func (c *client) waitPause(cmd *command) {
+	s := c.s
+	if cmd.name == "client" {
+		return
+	}
+	for {
+		s.mu.RLock()
+		_, replica := s.replicas[c]
+		paused := s.paused() && !replica && (s.pauseAll || cmd.mayReplicate())
+		end, unpaused := s.pauseEnd, s.pauseCh
+		s.mu.RUnlock()
+		if !paused {
+			return
+		}
+		t := time.NewTimer(time.Until(end))
+		select {
+		case <-t.C:
+		case <-unpaused:
+		}
+		t.Stop()
+	}
+}
+
+// unpause ends CLIENT PAUSE. The caller must hold the write lock.
+func (s *Server) unpause() {
+	if s.pauseCh != nil {
+		close(s.pauseCh)
+		s.pauseCh = nil
+	}
+}
+
+func clientCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("CLIENT subcommand must be one of ID, INFO, LIST, KILL, " +
+			"SETNAME, GETNAME, PAUSE, UNPAUSE, REPLY")
+	case "id":
+		if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+			return
+		}
+		c.replyInt(int(c.id))
+	case "info":
+		if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+			return
+		}
+		c.replyVerbatim("txt", c.clientInfo()+"\n")
+	case "list":
+		clientListCommand(c)
+	case "kill":
+		clientKillCommand(c)
+	case "setname":
+		if len(c.args) != 3 {
+			c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+			return
+		}
+		if !validClientName(c.args[2]) {
+			c.replyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = c.args[2]
+		c.replyString("OK")
+	case "getname":
+		if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+			return
+		}
+		if c.name == "" {
+			c.replyNull()
+		} else {
+			c.replyBulk(c.name)
+		}
+	case "pause":
+		clientPauseCommand(c)
+	case "unpause":
+		if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+			return
+		}
+		c.s.unpause()
+		c.replyString("OK")
+	case "reply":
+		if len(c.args) != 3 {
+			c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+			return
+		}
+		switch strings.ToLower(c.args[2]) {
+		default:
+			c.replySyntaxError()
+		case "on":
+			c.replyOff, c.skipNext = false, false
+			c.updateReplies()
+			c.replyString("OK")
+		case "off":
+			c.replyOff = true
+			c.updateReplies()
+		case "skip":
+			if !c.replyOff {
+				c.skipNext = true
+			}
+		}
+	}
+}
+
+// clientListCommand is CLIENT LIST [TYPE type] [ID id [id ...]].
+func clientListCommand(c *client) {
+	var typ string
+	var ids map[int64]bool
+	for i := 2; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replySyntaxError()
+			return
+		case "type":
+			if i+1 == len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			var ok bool
+			if typ, ok = parseClientType(c.args[i+1]); !ok {
+				c.replyError("Unknown client type '" + c.args[i+1] + "'")
+				return
+			}
+			i++
+		case "id":
+			if i+1 == len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			ids = make(map[int64]bool)
+			for i++; i < len(c.args); i++ {
+				id, err := strconv.ParseInt(c.args[i], 10, 64)
+				if err != nil || id <= 0 {
+					c.replyError("Invalid client ID")
+					return
+				}
+				ids[id] = true
+			}
+		}
+	}
+	var buf bytes.Buffer
+	for _, lc := range c.s.sortedClients() {
+		if (typ != "" && lc.clientType() != typ) || (ids != nil && !ids[lc.id]) {
+			continue
+		}
+		buf.WriteString(lc.clientInfo())
+		buf.WriteByte('\n')
+	}
+	c.replyVerbatim("txt", buf.String())
+}
+
+// kill closes the connection of the client. The calling client c is closed
+// after its reply.
+func (kc *client) kill(c *client) {
+	if kc == c {
+		c.closing = true
+	} else if kc.conn != nil {
+		kc.conn.Close()
+	}
+}
+
+// clientKillCommand is CLIENT KILL addr, or CLIENT KILL with the filters ID,
+// ADDR, LADDR, TYPE, USER, SKIPME and MAXAGE, which replies with the number of
+// killed clients.
+func clientKillCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+		return
+	}
+	var id int64
+	var addr, laddr, typ, user string
+	var maxAge time.Duration
+	skipme := true
+	old := len(c.args) == 3
+	if old {
+		addr = c.args[2]
+		skipme = false
+	} else {
+		if len(c.args)%2 != 0 {
+			c.replySyntaxError()
+			return
+		}
+		for i := 2; i < len(c.args); i += 2 {
+			val := c.args[i+1]
+			switch strings.ToLower(c.args[i]) {
+			default:
+				c.replySyntaxError()
+				return
+			case "id":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					c.replyError("client-id should be greater than 0")
+					return
+				}
+				id = n
+			case "addr":
+				addr = val
+			case "laddr":
+				laddr = val
+			case "type":
+				var ok bool
+				if typ, ok = parseClientType(val); !ok {
+					c.replyError("Unknown client type '" + val + "'")
+					return
+				}
+			case "user":
+				if _, ok := c.s.acl[val]; !ok {
+					c.replyError("No such user '" + val + "'")
+					return
+				}
+				user = val
+			case "skipme":
+				switch strings.ToLower(val) {
+				default:
+					c.replySyntaxError()
+					return
+				case "yes":
+					skipme = true
+				case "no":
+					skipme = false
+				}
+			case "maxage":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					c.replySyntaxError()
+					return
+				}
+				maxAge = time.Duration(n) * time.Second
+			}
+		}
+	}
+	var killed int
+	for _, kc := range c.s.sortedClients() {
+		if (id != 0 && kc.id != id) || (addr != "" && kc.addr != addr) ||
+			(typ != "" && kc.clientType() != typ) ||
+			(maxAge != 0 && time.Since(kc.created) < maxAge) ||
+			(skipme && kc == c) {
+			continue
+		}
+		if (laddr != "" && kc.localAddr() != laddr) ||
+			(user != "" && kc.userName() != user) {
+			continue
+		}
+		kc.kill(c)
+		killed++
+	}
+	if old {
+		if killed == 0 {
+			c.replyError("No such client")
+		} else {
+			c.replyString("OK")
+		}
+	} else {
+		c.replyInt(killed)
+	}
+}
+
+// clientPauseCommand is CLIENT PAUSE timeout [WRITE|ALL].
+func clientPauseCommand(c *client) {
+	if len(c.args) != 3 && len(c.args) != 4 {
+		c.replyError("Wrong number of arguments for CLIENT " + c.args[1])
+		return
+	}
+	ms, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil || ms < 0 {
+		c.replyError("timeout is not an integer or out of range")
+		return
+	}
+	all := true
+	if len(c.args) == 4 {
+		switch strings.ToLower(c.args[3]) {
+		default:
+			c.replySyntaxError()
+			return
+		case "all":
+		case "write":
+			all = false
+		}
+	}
+	s := c.s
+	end := time.Now().Add(time.Duration(ms) * time.Millisecond)
+	if s.paused() {
+		// a pause never shortens or weakens the running pause
+		if end.Before(s.pauseEnd) {
+			end = s.pauseEnd
+		}
+		all = all || s.pauseAll
+	} else {
+		s.unpause()
+		s.pauseCh = make(chan struct{})
+	}
+	s.pauseEnd, s.pauseAll = end, all
+	c.replyString("OK")
+}
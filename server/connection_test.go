@@ -0,0 +1,247 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClientField returns a field of a client in CLIENT LIST or INFO.
+func testClientField(info, name string) string {
+	for _, field := range strings.Fields(info) {
+		if strings.HasPrefix(field, name+"=") {
+			return field[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+func TestClientCommand(t *testing.T) {
+	ts := testStartServer(t)
+	a := ts.dial()
+	b := ts.dial()
+	ida := strings.TrimPrefix(a.do("CLIENT", "ID"), ":")
+	idb := strings.TrimPrefix(b.do("CLIENT", "ID"), ":")
+	if ida == idb {
+		t.Fatalf("expected different ids, got '%v'", ida)
+	}
+	a.expect("(nil)", "CLIENT", "GETNAME")
+	a.expect("-ERR Client names cannot contain spaces, newlines or special characters.",
+		"CLIENT", "SETNAME", "a b")
+	a.expect("+OK", "CLIENT", "SETNAME", "alpha")
+	a.expect("alpha", "CLIENT", "GETNAME")
+	info := a.do("CLIENT", "INFO")
+	for name, expect := range map[string]string{
+		"id": ida, "name": "alpha", "cmd": "client", "flags": "N",
+	} {
+		if got := testClientField(info, name); got != expect {
+			t.Fatalf("%v: expected '%v', got '%v'", name, expect, got)
+		}
+	}
+	b.expect("+OK", "MULTI")
+	b.expect("+QUEUED", "PING")
+	list := a.do("CLIENT", "LIST", "ID", idb)
+	if strings.Count(list, "\n") != 1 || testClientField(list, "flags") != "x" ||
+		testClientField(list, "multi") != "1" {
+		t.Fatalf("expected the client in a transaction, got '%v'", list)
+	}
+	b.expect("*[+PONG]", "EXEC")
+	if list := a.do("CLIENT", "LIST", "TYPE", "normal"); strings.Count(list, "\n") != 2 {
+		t.Fatalf("expected %v clients, got '%v'", 2, list)
+	}
+	a.expect("-ERR Unknown client type 'x'", "CLIENT", "LIST", "TYPE", "x")
+
+	a.expect(":0", "CLIENT", "KILL", "ID", ida)
+	a.expect("-ERR No such client", "CLIENT", "KILL", "1.2.3.4:5")
+	a.expect(":1", "CLIENT", "KILL", "ID", idb)
+	if got := b.do("PING"); !strings.HasPrefix(got, "ERR:") {
+		t.Fatalf("expected the client to be closed, got '%v'", got)
+	}
+	a.expect("", "CLIENT", "LIST", "ID", idb)
+	c := ts.dial()
+	addr := testClientField(c.do("CLIENT", "INFO"), "addr")
+	a.expect("+OK", "CLIENT", "KILL", addr)
+	if got := c.do("PING"); !strings.HasPrefix(got, "ERR:") {
+		t.Fatalf("expected the client to be closed, got '%v'", got)
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	ts := testStartServer(t)
+	a := ts.dial()
+	b := ts.dial()
+
+	// only the writes wait
+	a.expect("+OK", "CLIENT", "PAUSE", "300", "WRITE")
+	start := time.Now()
+	b.expect("+PONG", "PING")
+	b.expect("(nil)", "GET", "k")
+	if time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("expected the reads to not wait")
+	}
+	b.expect("+OK", "SET", "k", "v")
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("expected the writes to wait")
+	}
+
+	// all the commands wait until CLIENT UNPAUSE
+	a.expect("+OK", "CLIENT", "PAUSE", "10000")
+	b.send("GET", "k")
+	time.Sleep(50 * time.Millisecond)
+	ts.dial().expect("+OK", "CLIENT", "UNPAUSE")
+	if got := b.read(); got != "v" {
+		t.Fatalf("expected '%v', got '%v'", "v", got)
+	}
+	a.expect("-ERR timeout is not an integer or out of range", "CLIENT", "PAUSE", "x")
+}
+
+func TestClientReply(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "SET", "r", "1")
+	c.send("CLIENT", "REPLY", "OFF")
+	c.send("INCR", "r")
+	c.send("CLIENT", "REPLY", "SKIP")
+	c.expect("+OK", "CLIENT", "REPLY", "ON")
+	c.send("CLIENT", "REPLY", "SKIP")
+	c.send("INCR", "r")
+	c.expect("3", "GET", "r")
+}
+
+func TestClientTimeout(t *testing.T) {
+	ts := testStartServer(t, "--timeout", "1")
+	a := ts.dial()
+	a.expect("*[timeout,1]", "CONFIG", "GET", "timeout")
+	a.expect("*[tcp-keepalive,300]", "CONFIG", "GET", "tcp-keepalive")
+	a.expect("-ERR Invalid argument '-1' for CONFIG SET 'timeout'",
+		"CONFIG", "SET", "timeout", "-1")
+	a.expect("+OK", "CONFIG", "SET", "tcp-keepalive", "60")
+
+	// the subscribers and the blocked clients aren't idle
+	sub := ts.dial()
+	sub.expect("*[subscribe,ch,:1]", "SUBSCRIBE", "ch")
+	blocked := ts.dial()
+	blocked.send("BLPOP", "l", "3")
+	time.Sleep(1500 * time.Millisecond)
+	if got := a.do("PING"); !strings.HasPrefix(got, "ERR:") {
+		t.Fatalf("expected the client to be closed, got '%v'", got)
+	}
+	if got := blocked.read(); got != "(nil)" {
+		t.Fatalf("expected '%v', got '%v'", "(nil)", got)
+	}
+	blocked.expect("+PONG", "PING")
+	sub.expect("*[pong,]", "PING")
+
+	// the changes apply to the connected clients
+	b := ts.dial()
+	b.expect("+OK", "CONFIG", "SET", "timeout", "0")
+	c := ts.dial()
+	time.Sleep(1500 * time.Millisecond)
+	c.expect("+PONG", "PING")
+	c.expect("+OK", "CONFIG", "SET", "timeout", "1")
+	time.Sleep(100 * time.Millisecond)
+	if got := b.do("PING"); !strings.HasPrefix(got, "ERR:") {
+		t.Fatalf("expected the client to be closed, got '%v'", got)
+	}
+}
+
+func TestMaxclients(t *testing.T) {
+	ts := testStartServer(t, "--maxclients", "2")
+	a := ts.dial()
+	a.expect("*[maxclients,2]", "CONFIG", "GET", "maxclients")
+	b := ts.dial()
+	b.expect("+PONG", "PING")
+	c := ts.dial()
+	if got := c.read(); got != "-ERR max number of clients reached" {
+		t.Fatalf("expected '%v', got '%v'", "-ERR max number of clients reached", got)
+	}
+	if got := c.read(); !strings.HasPrefix(got, "ERR:") {
+		t.Fatalf("expected the client to be closed, got '%v'", got)
+	}
+	a.waitInfo("stats", "rejected_connections", "1")
+	a.waitInfo("clients", "maxclients", "2")
+	a.expect("-ERR Invalid argument '0' for CONFIG SET 'maxclients'",
+		"CONFIG", "SET", "maxclients", "0")
+	a.expect("+OK", "CONFIG", "SET", "maxclients", "3")
+	ts.dial().expect("+PONG", "PING")
+	a.expect("+OK", "CONFIG", "RESETSTAT")
+	a.waitInfo("stats", "rejected_connections", "0")
+}
+
+func TestRESP3(t *testing.T) {
+	ts := testStartServer(t)
+	a := ts.dial()
+
+	// RESP2 doesn't change
+	a.expect(":1", "HSET", "h", "f", "v")
+	a.expect("*[f,v]", "HGETALL", "h")
+	a.expect("*[hz,10]", "CONFIG", "GET", "hz")
+	a.expect(":1", "ZADD", "z", "1.5", "m")
+	a.expect("1.5", "ZSCORE", "z", "m")
+	a.expect("*[m,1.5]", "ZRANGE", "z", "0", "-1", "WITHSCORES")
+	a.expect("(nil)", "GET", "nokey")
+	a.expect("-NOPROTO unsupported protocol version", "HELLO", "4")
+	if got := a.do("HELLO"); !strings.Contains(got, ",proto,:2,") {
+		t.Fatalf("expected '%v' in '%v'", "proto,:2", got)
+	}
+
+	got := a.do("HELLO", "3", "SETNAME", "three")
+	if !strings.HasPrefix(got, "%[server,redis,version,") ||
+		!strings.Contains(got, ",proto,:3,") || !strings.Contains(got, ",modules,*[]") {
+		t.Fatalf("expected a RESP3 hello, got '%v'", got)
+	}
+	a.expect("three", "CLIENT", "GETNAME")
+	a.expect("%[f,v]", "HGETALL", "h")
+	a.expect("%[hz,10]", "CONFIG", "GET", "hz")
+	a.expect(",1.5", "ZSCORE", "z", "m")
+	a.expect("*[*[m,,1.5]]", "ZRANGE", "z", "0", "-1", "WITHSCORES")
+	a.expect(",2.5", "ZINCRBY", "z", "1", "m")
+	a.expect(":1", "SADD", "s", "x")
+	a.expect("~[x]", "SMEMBERS", "s")
+	a.expect("~[x]", "SUNION", "s")
+	a.expect("_", "GET", "nokey")
+	a.expect("_", "BLPOP", "nolist", "0.01")
+	if got := a.do("INFO", "server"); !strings.HasPrefix(got, "=txt:# Server") {
+		t.Fatalf("expected a verbatim string, got '%v'", got)
+	}
+	if got := a.do("CLIENT", "INFO"); !strings.HasPrefix(got, "=txt:id=") ||
+		testClientField(got, "resp") != "3" {
+		t.Fatalf("expected a verbatim string, got '%v'", got)
+	}
+	a.expect("#t", "DEBUG", "PROTOCOL", "true")
+	a.expect("(1234567999999999999999999999999999999", "DEBUG", "PROTOCOL", "bignum")
+	a.expect("%[:0,#f,:1,#t,:2,#f]", "DEBUG", "PROTOCOL", "map")
+	a.expect(">[server-cpu-usage,:42]", "DEBUG", "PROTOCOL", "push")
+
+	// the messages are pushed, and other commands are allowed
+	a.expect(">[subscribe,ch,:1]", "SUBSCRIBE", "ch")
+	a.expect("+PONG", "PING")
+	a.expect(":1", "SCARD", "s")
+	b := ts.dial()
+	b.expect("*[:0,:0,:1,:1,:2,:0]", "DEBUG", "PROTOCOL", "map")
+	b.expect(":1", "PUBLISH", "ch", "hi")
+	if got := a.read(); got != ">[message,ch,hi]" {
+		t.Fatalf("expected '%v', got '%v'", ">[message,ch,hi]", got)
+	}
+	b.expect("*[subscribe,x,:1]", "SUBSCRIBE", "x")
+	b.expect("-ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context",
+		"SCARD", "s")
+}
+
+func TestHelloAuth(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "CONFIG", "SET", "requirepass", "pw")
+	defer c.expect("+OK", "CONFIG", "SET", "requirepass", "")
+	a := ts.dial()
+	if got := a.do("HELLO", "3"); !strings.HasPrefix(got, "-NOAUTH HELLO must be called") {
+		t.Fatalf("expected '%v', got '%v'", "-NOAUTH", got)
+	}
+	a.expect("-WRONGPASS invalid username-password pair or user is disabled.",
+		"HELLO", "3", "AUTH", "default", "x")
+	a.expect("-NOAUTH Authentication required.", "PING")
+	if got := a.do("HELLO", "3", "AUTH", "default", "pw"); !strings.Contains(got, ",proto,:3,") {
+		t.Fatalf("expected '%v' in '%v'", "proto,:3", got)
+	}
+	a.expect("+PONG", "PING")
+}
@@ -3,26 +3,61 @@ package server
 import (
 	"bytes"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 type dbItem struct {
 	expires bool
 	value   interface{}
+	access  *keyAccess // for eviction
 }
 
 type database struct {
-	num     int
-	items   map[string]dbItem
-	expires map[string]time.Time
-	aofbuf  bytes.Buffer
+	num      int
+	items    map[string]dbItem
+	expires  map[string]time.Time
+	aofbuf   bytes.Buffer
+	watchers map[string]map[*client]bool // clients watching keys
+	keys     scanTable                   // the keys for SCAN
+
+	expireKeys   scanTable // the keys in expires, for sampling
+	expireCursor uint64    // the cursor of the active expire cycle
+
+	blocked   map[string][]*client // clients blocked on keys, in the order they blocked
+	readyKeys []string             // keys with blocked clients that were pushed to
+
+	snapshots []*snapshotDB // the snapshots in progress, see preserve
+
+	hits    atomic.Int64 // lookups that found the key
+	misses  atomic.Int64 // lookups that didn't find the key
+	writing bool         // a write command is running, its lookups aren't counted
+	avgTTL  int64        // estimated average ttl of the expires, in milliseconds
 }
 
 func newDB(num int) *database {
 	return &database{
-		num:     num,
-		items:   make(map[string]dbItem),
-		expires: make(map[string]time.Time),
+		num:      num,
+		items:    make(map[string]dbItem),
+		expires:  make(map[string]time.Time),
+		watchers: make(map[string]map[*client]bool),
+		blocked:  make(map[string][]*client),
+	}
+}
+
+// touch marks the key as modified, which will fail the EXEC of any
+// clients watching the key and wake up any clients blocked on the key.
+func (db *database) touch(key string) {
+	for c := range db.watchers[key] {
+		c.watchDirty = true
+	}
+	db.signalReady(key)
+}
+
+// signalReady queues the key to serve the clients that are blocked on it.
+func (db *database) signalReady(key string) {
+	if len(db.blocked[key]) > 0 {
+		db.readyKeys = append(db.readyKeys, key)
 	}
 }
 
@@ -31,32 +66,77 @@ func (db *database) len() int {
 }
 
 func (db *database) flush() {
+	for key := range db.watchers {
+		if _, ok := db.items[key]; ok {
+			db.touch(key)
+		}
+	}
 	db.items = make(map[string]dbItem)
 	db.expires = make(map[string]time.Time)
+	db.keys.clear()
+	db.expireKeys.clear()
+	db.expireCursor = 0
+}
+
+// removeExpire removes the key from the expires.
+func (db *database) removeExpire(key string) {
+	if _, ok := db.expires[key]; ok {
+		delete(db.expires, key)
+		db.expireKeys.remove(key)
+	}
 }
 
 func (db *database) set(key string, value interface{}) {
-	delete(db.expires, key)
-	db.items[key] = dbItem{value: value}
+	db.removeExpire(key)
+	if _, ok := db.items[key]; !ok {
+		db.keys.add(key)
+	}
+	db.items[key] = dbItem{value: value, access: newKeyAccess()}
+	if _, ok := value.(*list); ok {
+		db.signalReady(key)
+	}
 }
 
+// get returns the value of the key. The lookups of read commands are counted
+// as keyspace hits and misses, and are accesses for the eviction.
 func (db *database) get(key string) (interface{}, bool) {
-	item, ok := db.items[key]
+	item, ok := db.lookup(key)
+	if db.writing {
+		return item.value, ok
+	}
 	if !ok {
+		db.misses.Add(1)
 		return nil, false
 	}
+	db.hits.Add(1)
+	item.access.hit()
+	return item.value, true
+}
+
+// peek returns the value of the key, without counting the lookup or
+// recording an access.
+func (db *database) peek(key string) (interface{}, bool) {
+	item, ok := db.lookup(key)
+	return item.value, ok
+}
+
+func (db *database) lookup(key string) (dbItem, bool) {
+	item, ok := db.items[key]
+	if !ok {
+		return dbItem{}, false
+	}
 	if item.expires {
 		if t, ok := db.expires[key]; ok {
 			if time.Now().After(t) {
-				return nil, false
+				return dbItem{}, false
 			}
 		}
 	}
-	return item.value, true
+	return item, true
 }
 
 func (db *database) getType(key string) string {
-	v, ok := db.get(key)
+	v, ok := db.peek(key)
 	if !ok {
 		return "none"
 	}
@@ -72,6 +152,10 @@ func (db *database) getType(key string) string {
 		return "list"
 	case *set:
 		return "set"
+	case *hash:
+		return "hash"
+	case *zset:
+		return "zset"
 	}
 }
 
@@ -81,12 +165,12 @@ func (db *database) del(key string) (interface{}, bool) {
 		return nil, false
 	}
 	delete(db.items, key)
+	db.keys.remove(key)
 	if item.expires {
-		delete(db.expires, key)
-		if t, ok := db.expires[key]; ok {
-			if time.Now().After(t) {
-				return nil, false
-			}
+		t, ok := db.expires[key]
+		db.removeExpire(key)
+		if ok && time.Now().After(t) {
+			return nil, false
 		}
 	}
 	return item.value, true
@@ -99,10 +183,26 @@ func (db *database) expire(key string, when time.Time) bool {
 	}
 	item.expires = true
 	db.items[key] = item
+	if _, ok := db.expires[key]; !ok {
+		db.expireKeys.add(key)
+	}
 	db.expires[key] = when
 	return true
 }
 
+// persist removes the expiration of the key. Returns true if the key had an
+// expiration.
+func (db *database) persist(key string) bool {
+	if _, expires, ok := db.getExpires(key); !ok || expires.IsZero() {
+		return false
+	}
+	item := db.items[key]
+	item.expires = false
+	db.items[key] = item
+	db.removeExpire(key)
+	return true
+}
+
 func (db *database) getExpires(key string) (interface{}, time.Time, bool) {
 	item, ok := db.items[key]
 	if !ok {
@@ -156,6 +256,42 @@ func (db *database) getSet(key string, create bool) (*set, bool) {
 	return nil, true
 }
 
+func (db *database) getZSet(key string, create bool) (*zset, bool) {
+	value, ok := db.get(key)
+	if ok {
+		switch v := value.(type) {
+		default:
+			return nil, false
+		case *zset:
+			return v, true
+		}
+	}
+	if create {
+		z := newZSet()
+		db.set(key, z)
+		return z, true
+	}
+	return nil, true
+}
+
+func (db *database) getHash(key string, create bool) (*hash, bool) {
+	value, ok := db.get(key)
+	if ok {
+		switch v := value.(type) {
+		default:
+			return nil, false
+		case *hash:
+			return v, true
+		}
+	}
+	if create {
+		h := newHash()
+		db.set(key, h)
+		return h, true
+	}
+	return nil, true
+}
+
 func (db *database) ascend(iterator func(key string, value interface{}) bool) {
 	now := time.Now()
 	for key, item := range db.items {
@@ -177,7 +313,8 @@ func (db *database) update(key string, value interface{}) {
 	if ok {
 		item.value = value
 	} else {
-		item = dbItem{value: value}
+		item = dbItem{value: value, access: newKeyAccess()}
+		db.keys.add(key)
 	}
 	db.items[key] = item
 }
@@ -192,14 +329,23 @@ func (db *database) deleteExpires() bool {
 		if now.Before(t) {
 			continue
 		}
-		delete(db.items, key)
-		db.aofbuf.WriteString("*2\r\n$3\r\nDEL\r\n$")
-		db.aofbuf.WriteString(strconv.FormatInt(int64(len(key)), 10))
-		db.aofbuf.WriteString("\r\n")
-		db.aofbuf.WriteString(key)
-		db.aofbuf.WriteString("\r\n")
-		delete(db.expires, key)
+		db.deleteKey(key)
 		deleted = true
 	}
 	return deleted
 }
+
+// deleteKey deletes a key that expired or was evicted, and writes the DEL to
+// the aof.
+func (db *database) deleteKey(key string) {
+	db.preserve(key)
+	delete(db.items, key)
+	db.keys.remove(key)
+	db.touch(key)
+	db.aofbuf.WriteString("*2\r\n$3\r\nDEL\r\n$")
+	db.aofbuf.WriteString(strconv.FormatInt(int64(len(key)), 10))
+	db.aofbuf.WriteString("\r\n")
+	db.aofbuf.WriteString(key)
+	db.aofbuf.WriteString("\r\n")
+	db.removeExpire(key)
+}
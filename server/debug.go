@@ -27,6 +27,7 @@ func debugCommand(c *client) {
 			"segfault -- Crash the server with sigsegv.",
 			"object <key> -- Show low level info about key and associated value.",
 			"gc -- Force a garbage collection.",
+			"protocol <type> -- Reply with a test value of the RESP3 type.",
 		}
 		c.replyMultiBulkLen(len(msgs))
 		for _, msg := range msgs {
@@ -39,6 +40,58 @@ func debugCommand(c *client) {
 	case "gc":
 		runtime.GC()
 		c.replyString("OK")
+	case "protocol":
+		debugProtocolCommand(c)
+	}
+}
+
+// debugProtocolCommand replies with a value of each type, for testing the
+// clients.
+func debugProtocolCommand(c *client) {
+	if len(c.args) != 3 {
+		replyArgsError(c)
+		return
+	}
+	switch strings.ToLower(c.args[2]) {
+	default:
+		c.replyError("Wrong protocol type name. Please use one of the following: " +
+			"string|integer|double|bignum|null|array|set|map|push|verbatim|true|false")
+	case "string":
+		c.replyBulk("Hello World")
+	case "integer":
+		c.replyInt(12345)
+	case "double":
+		c.replyDouble(3.14159265359)
+	case "bignum":
+		c.replyBigNumber("1234567999999999999999999999999999999")
+	case "null":
+		c.replyNull()
+	case "array":
+		c.replyMultiBulkLen(3)
+		for i := 0; i < 3; i++ {
+			c.replyInt(i)
+		}
+	case "set":
+		c.replySetLen(3)
+		for i := 0; i < 3; i++ {
+			c.replyInt(i)
+		}
+	case "map":
+		c.replyMapLen(3)
+		for i := 0; i < 3; i++ {
+			c.replyInt(i)
+			c.replyBool(i == 1)
+		}
+	case "push":
+		c.replyPushLen(2)
+		c.replyBulk("server-cpu-usage")
+		c.replyInt(42)
+	case "verbatim":
+		c.replyVerbatim("txt", "This is a verbatim\nstring")
+	case "true":
+		c.replyBool(true)
+	case "false":
+		c.replyBool(false)
 	}
 }
 
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"math/rand"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// evictSamples is the number of keys sampled from each database to find
+	// the best key to evict.
+	evictSamples = 5
+	// lfuInitVal is the access counter of a new key, so that new keys aren't
+	// evicted before they have a chance to be accessed.
+	lfuInitVal = 5
+	// lfuLogFactor controls how quickly the logarithmic counter grows.
+	lfuLogFactor = 10
+	// lfuDecayTime is the idle time that decrements the counter by one.
+	lfuDecayTime = time.Minute
+)
+
+// keyAccess is the access metadata of a key, which is used to pick the keys
+// to evict. It's updated by lookups under the read lock, so the fields are
+// accessed atomically.
+type keyAccess struct {
+	atime   int64  // the last access, in unix nanoseconds
+	counter uint32 // the logarithmic access frequency, like Redis LFU
+}
+
+func newKeyAccess() *keyAccess {
+	return &keyAccess{atime: time.Now().UnixNano(), counter: lfuInitVal}
+}
+
+// hit records an access of the key.
+func (a *keyAccess) hit() {
+	now := time.Now().UnixNano()
+	counter := a.frequency(now)
+	if counter < 255 {
+		base := float64(counter) - lfuInitVal
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	atomic.StoreUint32(&a.counter, counter)
+	atomic.StoreInt64(&a.atime, now)
+}
+
+// frequency returns the access counter, decremented once for each
+// lfuDecayTime that the key has been idle.
+func (a *keyAccess) frequency(now int64) uint32 {
+	counter := atomic.LoadUint32(&a.counter)
+	periods := (now - atomic.LoadInt64(&a.atime)) / int64(lfuDecayTime)
+	if periods >= int64(counter) {
+		return 0
+	}
+	return counter - uint32(periods)
+}
+
+// idle returns the nanoseconds since the last access.
+func (a *keyAccess) idle(now int64) int64 {
+	return now - atomic.LoadInt64(&a.atime)
+}
+
+// maxmemoryPolicies are the supported maxmemory policies.
+var maxmemoryPolicies = []string{
+	"noeviction", "allkeys-lru", "volatile-lru", "allkeys-lfu",
+	"volatile-ttl", "allkeys-random",
+}
+
+var memSamples = []metrics.Sample{
+	{Name: "/memory/classes/heap/objects:bytes"},
+	{Name: "/gc/cycles/total:gc-cycles"},
+	{Name: "/gc/heap/allocs:bytes"},
+}
+
+// usedMemory returns the approximate number of bytes in use by the heap, and
+// the number of bytes allocated since the last garbage collection. The heap
+// holds the evicted keys until the next collection, so their estimated sizes
+// are subtracted until then. The caller must hold the write lock.
+func (s *Server) usedMemory() (used, allocated int64) {
+	metrics.Read(memSamples)
+	used = int64(memSamples[0].Value.Uint64())
+	allocs := int64(memSamples[2].Value.Uint64())
+	if cycles := memSamples[1].Value.Uint64(); cycles != s.memGCCycles {
+		s.memGCCycles = cycles
+		s.memGCAllocs = allocs
+		s.memEvicted = 0
+	}
+	return used - s.memEvicted, allocs - s.memGCAllocs
+}
+
+// gcCycles returns the number of completed gc cycles.
+func gcCycles() uint64 {
+	samples := []metrics.Sample{{Name: "/gc/cycles/total:gc-cycles"}}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64()
+}
+
+// freeMemoryIfNeeded evicts keys, following the maxmemory-policy, until the
+// used memory is under maxmemory. Sets s.oom when the memory can't be freed,
+// which refuses the commands that may use more memory. Called before each
+// write command, under the write lock, which is released while the heap is
+// collected.
+func (s *Server) freeMemoryIfNeeded() {
+	s.oom = false
+	if s.cfg.maxmemory <= 0 || s.follower {
+		// followers leave the eviction to the master
+		return
+	}
+	used, allocated := s.usedMemory()
+	if used <= s.cfg.maxmemory {
+		return
+	}
+	if allocated > s.cfg.maxmemory/8 {
+		// Much of the heap may be garbage, which is cheaper to free than
+		// keys. Limiting the collections to one per maxmemory/8 allocated
+		// bytes bounds their cost. The clients that wait for the same
+		// collection share it.
+		cycles := s.memGCCycles
+		s.mu.Unlock()
+		s.memGCMu.Lock()
+		if gcCycles() == cycles {
+			runtime.GC()
+		}
+		s.memGCMu.Unlock()
+		s.mu.Lock()
+		used, _ = s.usedMemory()
+	}
+	var evicted bool
+	for used > s.cfg.maxmemory {
+		db, key, ok := s.evictionCandidate()
+		if !ok {
+			s.oom = true
+			break
+		}
+		item := db.items[key]
+		size := sizeOf(key, item.value)
+		db.deleteKey(key)
+		s.memEvicted += size
+		used -= size
+		s.statEvictedKeys++
+		evicted = true
+	}
+	if evicted {
+		if err := s.flushAOF(); err != nil {
+			s.fatalError(err)
+		}
+	}
+}
+
+// evictionCandidate samples the keys of each database and returns the best
+// key to evict for the maxmemory-policy. Returns false when there are no keys
+// that may be evicted.
+func (s *Server) evictionCandidate() (*database, string, bool) {
+	policy := s.cfg.maxmemoryPolicy
+	if policy == "noeviction" {
+		return nil, "", false
+	}
+	volatile := policy == "volatile-lru" || policy == "volatile-ttl"
+	now := time.Now().UnixNano()
+	var bestDB *database
+	var bestKey string
+	var bestScore int64
+	for _, db := range s.dbs {
+		keys := &db.keys
+		if volatile {
+			keys = &db.expireKeys
+		}
+		keys.sample(evictSamples, func(key string) {
+			var score int64 // higher is better
+			switch policy {
+			case "allkeys-lru", "volatile-lru":
+				score = db.items[key].access.idle(now)
+			case "allkeys-lfu":
+				score = 255 - int64(db.items[key].access.frequency(now))
+			case "volatile-ttl":
+				score = -db.expires[key].UnixNano()
+			case "allkeys-random":
+				score = rand.Int63()
+			}
+			if bestDB == nil || score > bestScore {
+				bestDB, bestKey, bestScore = db, key, score
+			}
+		})
+	}
+	return bestDB, bestKey, bestDB != nil
+}
+
+// sizeOf estimates the number of bytes used by a key and its value.
+func sizeOf(key string, value interface{}) int64 {
+	const overhead = 48 // a rough size of the headers of each entry
+	size := int64(len(key)) + overhead*2
+	switch v := value.(type) {
+	case string:
+		size += int64(len(v))
+	case *list:
+		v.ascend(func(value string) bool {
+			size += int64(len(value)) + overhead
+			return true
+		})
+	case *set:
+		v.ascend(func(member string) bool {
+			size += int64(len(member)) + overhead
+			return true
+		})
+	case *hash:
+		v.ascend(func(field, value string) bool {
+			size += int64(len(field)+len(value)) + overhead
+			return true
+		})
+	case *zset:
+		v.ascend(func(member string, score float64) bool {
+			size += int64(len(member)) + overhead*2
+			return true
+		})
+	}
+	return size
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testOOM = "-OOM command not allowed when used memory > 'maxmemory'."
+
+func TestMaxmemoryEvict(t *testing.T) {
+	ts := testStartServer(t, "--maxmemory-policy", "allkeys-lru")
+	c := ts.dial()
+	c.expect("*[maxmemory,0]", "CONFIG", "GET", "maxmemory")
+	c.expect("*[maxmemory-policy,allkeys-lru]", "CONFIG", "GET", "maxmemory-policy")
+	c.expect("-ERR Invalid argument 'bogus' for CONFIG SET 'maxmemory-policy'",
+		"CONFIG", "SET", "maxmemory-policy", "bogus")
+	used, _ := strconv.Atoi(testInfoField(c.do("INFO", "memory"), "used_memory"))
+	c.expect("+OK", "CONFIG", "SET", "maxmemory", strconv.Itoa(used+4<<20))
+	value := strings.Repeat("x", 10000)
+	for i := 0; i < 2000; i++ {
+		c.expect("+OK", "SET", "k"+strconv.Itoa(i), value)
+	}
+	n, _ := strconv.Atoi(strings.TrimPrefix(c.do("DBSIZE"), ":"))
+	if n == 0 || n >= 2000 {
+		t.Fatalf("expected some keys to be evicted, got %v keys", n)
+	}
+	if got := testInfoField(c.do("INFO", "stats"), "evicted_keys"); got == "0" {
+		t.Fatalf("expected evicted keys, got '%v'", got)
+	}
+	c.expect(":1", "EXISTS", "k1999")
+}
+
+func TestMaxmemoryNoEviction(t *testing.T) {
+	ts := testStartServer(t, "--maxmemory-policy", "noeviction")
+	c := ts.dial()
+	c.expect("+OK", "SET", "k", "v")
+	c.expect("+OK", "CONFIG", "SET", "maxmemory", "1")
+	c.expect(testOOM, "SET", "a", "b")
+	c.expect(testOOM, "LPUSH", "a", "b")
+	c.expect("v", "GET", "k")
+	c.expect(":1", "DEL", "k")
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "SET", "a", "b")
+	c.expect("*["+testOOM+"]", "EXEC")
+	c.expect(testOOM, "EVAL", "return redis.call('set', 'a', 'b')", "0")
+
+	// only the volatile keys are evicted
+	c.expect("+OK", "CONFIG", "SET", "maxmemory-policy", "volatile-ttl")
+	c.expect(testOOM, "SET", "a", "b")
+	c.expect("+OK", "CONFIG", "SET", "maxmemory", "0")
+	c.expect("+OK", "SET", "a", "b")
+	c.expect("+OK", "SET", "t1", "b", "EX", "100")
+	c.expect("+OK", "SET", "t2", "b", "EX", "1000")
+	c.expect("+OK", "CONFIG", "SET", "maxmemory", "1")
+	c.expect(testOOM, "SET", "a", "b")
+	c.expect(":0", "EXISTS", "t1", "t2")
+	c.expect(":1", "EXISTS", "a")
+}
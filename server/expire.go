@@ -0,0 +1,92 @@
+package server
+
+import "time"
+
+const (
+	// expireKeysPerLoop is the number of keys sampled from a database in
+	// each loop of the active expire cycle.
+	expireKeysPerLoop = 20
+	// expireAcceptableStale is the percentage of expired keys in a sample
+	// below which the cycle moves on to the next database.
+	expireAcceptableStale = 10
+	// expireCycleBudget is the percentage of each tick that the cycle may
+	// spend deleting keys.
+	expireCycleBudget = 25
+)
+
+// activeExpireCycle deletes expired keys by sampling the expires of each
+// database, like Redis. A database is sampled again while more than
+// expireAcceptableStale percent of the sampled keys were expired, and the
+// cycle stops when it runs out of time. Keys that are missed are found by
+// later cycles, the lookups already ignore expired keys. The caller must hold
+// the write lock.
+func (s *Server) activeExpireCycle() {
+	if s.follower {
+		// the master sends the deletes
+		return
+	}
+	if s.paused() {
+		// CLIENT PAUSE keeps the dataset unchanged
+		return
+	}
+	start := time.Now()
+	budget := time.Second * expireCycleBudget / 100 / time.Duration(s.cfg.hz)
+	var sampled, expired int
+	var deleted, timedout bool
+	for _, db := range s.dbs {
+		for !timedout && len(db.expires) > 0 {
+			var keys []string
+			var n int
+			var ttlSum, ttlCount int64
+			now := time.Now()
+			db.expireCursor = db.expireKeys.scan(db.expireCursor,
+				expireKeysPerLoop, func(key string) {
+					n++
+					if t := db.expires[key]; now.After(t) {
+						keys = append(keys, key)
+					} else {
+						ttlSum += int64(t.Sub(now) / time.Millisecond)
+						ttlCount++
+					}
+				})
+			if ttlCount > 0 {
+				// a running estimate of the average ttl, for INFO keyspace
+				avg := ttlSum / ttlCount
+				if db.avgTTL == 0 {
+					db.avgTTL = avg
+				} else {
+					db.avgTTL = db.avgTTL/50*49 + avg/50
+				}
+			}
+			for _, key := range keys {
+				db.deleteKey(key)
+			}
+			sampled += n
+			expired += len(keys)
+			if len(keys) > 0 {
+				deleted = true
+			}
+			if time.Since(start) > budget {
+				timedout = true
+			}
+			if n == 0 || len(keys)*100/n <= expireAcceptableStale {
+				break
+			}
+		}
+	}
+	s.statExpiredKeys += expired
+	if timedout {
+		s.statExpiredTimeCapReached++
+	}
+	s.statExpireCycleTime += time.Since(start)
+	if sampled > 0 {
+		// a running average of the expired percentage of the samples
+		perc := float64(expired) / float64(sampled)
+		s.statExpiredStalePerc = perc*0.05 + s.statExpiredStalePerc*0.95
+	}
+	if deleted {
+		if err := s.flushAOF(); err != nil {
+			s.fatalError(err)
+		}
+	}
+}
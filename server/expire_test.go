@@ -0,0 +1,34 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestActiveExpire(t *testing.T) {
+	ts := testStartServer(t, "--hz", "50")
+	c := ts.dial()
+	c.expect("*[hz,50]", "CONFIG", "GET", "hz")
+	for i := 0; i < 5000; i++ {
+		c.send("SET", "k"+strconv.Itoa(i), "v")
+		c.send("PEXPIRE", "k"+strconv.Itoa(i), "100")
+	}
+	for i := 0; i < 10000; i++ {
+		c.read()
+	}
+	c.expect("+OK", "SET", "keep", "v")
+
+	// the keys are deleted without being accessed
+	c.wait(":1", "DBSIZE")
+	c.waitInfo("stats", "expired_keys", "5000")
+	c.waitInfo("server", "hz", "50")
+	c.expect("+OK", "CONFIG", "SET", "hz", "1000")
+	c.expect("*[hz,500]", "CONFIG", "GET", "hz")
+	c.expect("-ERR Invalid argument 'x' for CONFIG SET 'hz'", "CONFIG", "SET", "hz", "x")
+	c.expect("*[0,*[keep]]", "SCAN", "0")
+
+	// the deletes are written to the aof
+	ts.restart()
+	c = ts.dial()
+	c.expect(":1", "DBSIZE")
+}
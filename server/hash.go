@@ -0,0 +1,367 @@
+package server
+
+import (
+	"math"
+	"strconv"
+)
+
+type hash struct {
+	m map[string]string
+}
+
+func newHash() *hash {
+	h := &hash{make(map[string]string)}
+	return h
+}
+
+// set assigns a value to a field. Returns true if the field is new.
+func (h *hash) set(field, value string) bool {
+	_, ok := h.m[field]
+	h.m[field] = value
+	return !ok
+}
+
+func (h *hash) get(field string) (string, bool) {
+	value, ok := h.m[field]
+	return value, ok
+}
+
+func (h *hash) del(field string) bool {
+	if _, ok := h.m[field]; ok {
+		delete(h.m, field)
+		return true
+	}
+	return false
+}
+
+func (h *hash) exists(field string) bool {
+	_, ok := h.m[field]
+	return ok
+}
+
+func (h *hash) len() int {
+	return len(h.m)
+}
+
+func (h *hash) ascend(iterator func(field, value string) bool) {
+	for field, value := range h.m {
+		if !iterator(field, value) {
+			return
+		}
+	}
+}
+
+func hsetCommand(c *client) {
+	if len(c.args) < 4 || (len(c.args)-2)%2 != 0 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], true)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	count := 0
+	for i := 2; i < len(c.args); i += 2 {
+		if h.set(c.args[i], c.args[i+1]) {
+			count++
+		}
+		c.dirty++
+	}
+	c.replyInt(count)
+}
+
+func hsetnxCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], true)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h.exists(c.args[2]) {
+		c.replyInt(0)
+		return
+	}
+	h.set(c.args[2], c.args[3])
+	c.replyInt(1)
+	c.dirty++
+}
+
+func hmsetCommand(c *client) {
+	if len(c.args) < 4 || (len(c.args)-2)%2 != 0 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], true)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	for i := 2; i < len(c.args); i += 2 {
+		h.set(c.args[i], c.args[i+1])
+		c.dirty++
+	}
+	c.replyString("OK")
+}
+
+func hgetCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyNull()
+		return
+	}
+	value, ok := h.get(c.args[2])
+	if !ok {
+		c.replyNull()
+		return
+	}
+	c.replyBulk(value)
+}
+
+func hmgetCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	c.replyMultiBulkLen(len(c.args) - 2)
+	for i := 2; i < len(c.args); i++ {
+		if h == nil {
+			c.replyNull()
+			continue
+		}
+		value, ok := h.get(c.args[i])
+		if !ok {
+			c.replyNull()
+		} else {
+			c.replyBulk(value)
+		}
+	}
+}
+
+func hgetallCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyMapLen(0)
+		return
+	}
+	c.replyMapLen(h.len())
+	h.ascend(func(field, value string) bool {
+		c.replyBulk(field)
+		c.replyBulk(value)
+		return true
+	})
+}
+
+func hkeysvalsGenericCommand(c *client, keys bool) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyMultiBulkLen(0)
+		return
+	}
+	c.replyMultiBulkLen(h.len())
+	h.ascend(func(field, value string) bool {
+		if keys {
+			c.replyBulk(field)
+		} else {
+			c.replyBulk(value)
+		}
+		return true
+	})
+}
+
+func hkeysCommand(c *client) {
+	hkeysvalsGenericCommand(c, true)
+}
+
+func hvalsCommand(c *client) {
+	hkeysvalsGenericCommand(c, false)
+}
+
+func hdelCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyInt(0)
+		return
+	}
+	var count int
+	for i := 2; i < len(c.args); i++ {
+		if h.del(c.args[i]) {
+			count++
+			c.dirty++
+		}
+	}
+	if h.len() == 0 {
+		c.db.del(c.args[1])
+	}
+	c.replyInt(count)
+}
+
+func hlenCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyInt(0)
+		return
+	}
+	c.replyInt(h.len())
+}
+
+func hstrlenCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyInt(0)
+		return
+	}
+	value, _ := h.get(c.args[2])
+	c.replyInt(len(value))
+}
+
+func hexistsCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil || !h.exists(c.args[2]) {
+		c.replyInt(0)
+		return
+	}
+	c.replyInt(1)
+}
+
+func hincrbyCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	delta, err := strconv.ParseInt(c.args[3], 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var n int64
+	if h != nil {
+		if value, ok := h.get(c.args[2]); ok {
+			n, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				c.replyError("hash value is not an integer")
+				return
+			}
+		}
+	}
+	if (delta < 0 && n < math.MinInt64-delta) ||
+		(delta > 0 && n > math.MaxInt64-delta) {
+		c.replyError("increment or decrement would overflow")
+		return
+	}
+	n += delta
+	if h == nil {
+		h, _ = c.db.getHash(c.args[1], true)
+	}
+	h.set(c.args[2], strconv.FormatInt(n, 10))
+	c.replyInt(int(n))
+	c.dirty++
+}
+
+func hincrbyfloatCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	delta, err := strconv.ParseFloat(c.args[3], 64)
+	if err != nil {
+		c.replyError("value is not a valid float")
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var n float64
+	if h != nil {
+		if value, ok := h.get(c.args[2]); ok {
+			n, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				c.replyError("hash value is not a float")
+				return
+			}
+		}
+	}
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		c.replyError("increment would produce NaN or Infinity")
+		return
+	}
+	if h == nil {
+		h, _ = c.db.getHash(c.args[1], true)
+	}
+	value := strconv.FormatFloat(n, 'f', -1, 64)
+	h.set(c.args[2], value)
+	c.replyBulk(value)
+	c.dirty++
+}
@@ -0,0 +1,65 @@
+package server
+
+import "testing"
+
+func TestHashCommands(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect(":2", "HSET", "h", "a", "1", "b", "2")
+	c.expect(":0", "HSET", "h", "a", "3")
+	c.expect("3", "HGET", "h", "a")
+	c.expect("(nil)", "HGET", "h", "z")
+	c.expect("*[3,(nil)]", "HMGET", "h", "a", "z")
+	c.expect(":0", "HSETNX", "h", "a", "4")
+	c.expect(":1", "HSETNX", "h", "c", "4")
+	c.expect(":12", "HINCRBY", "h", "b", "10")
+	c.expect("12.5", "HINCRBYFLOAT", "h", "b", "0.5")
+	c.expect(":1", "HEXISTS", "h", "c")
+	c.expect(":3", "HLEN", "h")
+	c.expect(":4", "HSTRLEN", "h", "b")
+	c.expect("+hash", "TYPE", "h")
+	c.expect(":2", "HDEL", "h", "a", "c", "z")
+	c.expect("*[b,12.5]", "HGETALL", "h")
+	c.expect("*[b]", "HKEYS", "h")
+	c.expect("*[12.5]", "HVALS", "h")
+	c.expect(":1", "HDEL", "h", "b")
+	c.expect(":0", "EXISTS", "h")
+	c.expect("+OK", "SET", "s", "v")
+	c.expect("-WRONGTYPE Operation against a key holding the wrong kind of value",
+		"HGET", "s", "a")
+	c.expect("-ERR wrong number of arguments for 'HSET'", "HSET", "h", "a")
+}
+
+func TestHashIncrBy(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect(":9223372036854775807", "HINCRBY", "h", "f", "9223372036854775807")
+	c.expect("-ERR increment or decrement would overflow", "HINCRBY", "h", "f", "1")
+	c.expect(":-1", "HINCRBY", "h", "f", "-9223372036854775808")
+	c.expect("-ERR increment or decrement would overflow",
+		"HINCRBY", "h", "f", "-9223372036854775808")
+	c.expect("-ERR value is not an integer or out of range", "HINCRBY", "h", "f", "x")
+	c.expect("-ERR increment would produce NaN or Infinity", "HINCRBYFLOAT", "h", "g", "inf")
+	c.expect("-ERR increment would produce NaN or Infinity", "HINCRBYFLOAT", "n", "g", "+inf")
+	c.expect(":0", "EXISTS", "n")
+	c.expect("1.5", "HINCRBYFLOAT", "h", "g", "1.5")
+	c.do("HINCRBYFLOAT", "h", "m", "1.7976931348623157e308")
+	c.expect("-ERR increment would produce NaN or Infinity",
+		"HINCRBYFLOAT", "h", "m", "1.7976931348623157e308")
+	c.expect("1.5", "HGET", "h", "g")
+}
+
+func TestHashAOF(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect(":2", "HSET", "h", "a", "1", "b", "2")
+	c.expect(":1", "RPUSH", "l", "x")
+	c.expect(":1", "SADD", "s", "x")
+	c.rewriteAOF()
+	c.expect(":1", "HSETNX", "h", "c", "3")
+	ts.restart()
+	c = ts.dial()
+	c.expect("*[1,2,3]", "HMGET", "h", "a", "b", "c")
+	c.expect("*[x]", "LRANGE", "l", "0", "-1")
+	c.expect("*[x]", "SMEMBERS", "s")
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -69,11 +70,11 @@ func infoCommand(c *client) {
 			writeInfoCommandStats(c, wr)
 		case "cluster":
 			writeInfoCluster(c, wr)
-		case "Keyspace":
+		case "keyspace":
 			writeInfoKeyspace(c, wr)
 		}
 	}
-	c.replyBulk(wr.String())
+	c.replyVerbatim("txt", wr.String())
 }
 
 var osOnce sync.Once
@@ -97,9 +98,10 @@ func writeInfoServer(c *client, w io.Writer) {
 	fmt.Fprintf(w, "arch_bits:%d\n", ptrSize)
 	fmt.Fprintf(w, "go_version:%s\n", runtime.Version()[2:])
 	fmt.Fprintf(w, "process_id:%d\n", os.Getpid())
-	fmt.Fprintf(w, "tcp_port:%s\n", c.s.l.Addr().String()[strings.LastIndex(c.s.l.Addr().String(), ":")+1:])
+	fmt.Fprintf(w, "tcp_port:%d\n", c.s.cfg.port)
 	fmt.Fprintf(w, "uptime_in_seconds:%d\n", now.Sub(c.s.started)/time.Second)
 	fmt.Fprintf(w, "uptime_in_days:%d\n", now.Sub(c.s.started)/time.Hour/24)
+	fmt.Fprintf(w, "hz:%d\n", c.s.cfg.hz)
 	fmt.Fprintf(w, "executable:%s\n", c.s.executable)
 }
 
@@ -121,34 +123,137 @@ func writeInfoMemory(c *client, w io.Writer) {
 	runtime.ReadMemStats(&m)
 	fmt.Fprintf(w, "used_memory:%d\n", m.Alloc)
 	fmt.Fprintf(w, "used_memory_human:%s\n", human(m.Alloc))
+	fmt.Fprintf(w, "maxmemory:%d\n", c.s.cfg.maxmemory)
+	fmt.Fprintf(w, "maxmemory_human:%s\n", human(uint64(c.s.cfg.maxmemory)))
+	fmt.Fprintf(w, "maxmemory_policy:%s\n", c.s.cfg.maxmemoryPolicy)
 	// total_system_memory:17179869184
 	// total_system_memory_human:16.00G
 }
 func writeInfoPersistence(c *client, w io.Writer) {
-	// aof_enabled:0
-	// aof_rewrite_in_progress:0
-	// aof_rewrite_scheduled:0
-	// aof_last_rewrite_time_sec:-1
-	// aof_current_rewrite_time_sec:-1
-	// aof_last_bgrewrite_status:ok
-	// aof_last_write_status:ok
+	fmt.Fprintf(w, "loading:0\n")
+	fmt.Fprintf(w, "rdb_changes_since_last_save:%d\n", c.s.dirty)
+	fmt.Fprintf(w, "rdb_bgsave_in_progress:%d\n", boolInt(c.s.rdbsaving))
+	fmt.Fprintf(w, "rdb_last_save_time:%d\n", c.s.lastsave.Unix())
+	fmt.Fprintf(w, "rdb_last_bgsave_status:%s\n", errStatus(c.s.lastbgsaveErr))
+	s := c.s
+	fmt.Fprintf(w, "aof_enabled:%d\n", boolInt(s.aof != nil))
+	fmt.Fprintf(w, "aof_rewrite_in_progress:%d\n", boolInt(s.aofrewrite))
+	fmt.Fprintf(w, "aof_rewrite_scheduled:0\n")
+	if s.aofrewriteTime < 0 {
+		fmt.Fprintf(w, "aof_last_rewrite_time_sec:-1\n")
+	} else {
+		fmt.Fprintf(w, "aof_last_rewrite_time_sec:%d\n", s.aofrewriteTime/time.Second)
+	}
+	if s.aofrewrite {
+		fmt.Fprintf(w, "aof_current_rewrite_time_sec:%d\n", time.Since(s.aofrewriteStart)/time.Second)
+	} else {
+		fmt.Fprintf(w, "aof_current_rewrite_time_sec:-1\n")
+	}
+	fmt.Fprintf(w, "aof_last_bgrewrite_status:%s\n", errStatus(s.aofrewriteErr))
+	fmt.Fprintf(w, "aof_last_write_status:%s\n", errStatus(s.aofwriteErr))
+	if s.aof != nil {
+		var buflen int
+		for _, db := range s.dbs {
+			buflen += db.aofbuf.Len()
+		}
+		fmt.Fprintf(w, "aof_current_size:%d\n", s.aofsize)
+		fmt.Fprintf(w, "aof_base_size:%d\n", s.aofbasesize)
+		fmt.Fprintf(w, "aof_pending_rewrite:0\n")
+		fmt.Fprintf(w, "aof_buffer_length:%d\n", buflen)
+		fmt.Fprintf(w, "aof_pending_bio_fsync:%d\n", boolInt(s.aofpending))
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
-func writeInfoStats(c *client, w io.Writer) {}
-func writeInfoReplication(c *client, w io.Writer) {
-	// role:master
-	// connected_slaves:0
-	// master_repl_offset:0
-	// repl_backlog_active:0
-	// repl_backlog_size:1048576
-	// repl_backlog_first_byte_offset:0
-	// repl_backlog_histlen:0
+func errStatus(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
+
+func writeInfoCPU(c *client, w io.Writer) {}
+func writeInfoCommandStats(c *client, w io.Writer) {
+	var names []string
+	for name, cmd := range c.s.cmds {
+		if name == cmd.name && cmd.stats.calls.Load()+cmd.stats.rejected.Load() > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st := &c.s.cmds[name].stats
+		calls, usec := st.calls.Load(), st.usec.Load()
+		var perCall float64
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		fmt.Fprintf(w, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,"+
+			"rejected_calls=%d,failed_calls=%d\n", name, calls, usec, perCall,
+			st.rejected.Load(), st.failed.Load())
+	}
+}
+
+func writeInfoCluster(c *client, w io.Writer) {}
+
+func writeInfoKeyspace(c *client, w io.Writer) {
+	dbs := make([]*database, 0, len(c.s.dbs))
+	for _, db := range c.s.dbs {
+		if db.len() > 0 {
+			dbs = append(dbs, db)
+		}
+	}
+	sort.Sort(dbsByNumber(dbs))
+	for _, db := range dbs {
+		var avgTTL int64
+		if len(db.expires) > 0 {
+			avgTTL = db.avgTTL
+		}
+		fmt.Fprintf(w, "db%d:keys=%d,expires=%d,avg_ttl=%d\n",
+			db.num, db.len(), len(db.expires), avgTTL)
+	}
 }
-func writeInfoCPU(c *client, w io.Writer)          {}
-func writeInfoCommandStats(c *client, w io.Writer) {}
-func writeInfoCluster(c *client, w io.Writer)      {}
-func writeInfoKeyspace(c *client, w io.Writer)     {}
 
 func writeInfoClients(c *client, w io.Writer) {
+	var blocked, pubsub, watching int
+	for bc := range c.s.clients {
+		if bc.blocked != nil {
+			blocked++
+		}
+		if bc.subscribed() {
+			pubsub++
+		}
+		if len(bc.watching) > 0 {
+			watching++
+		}
+	}
 	fmt.Fprintf(w, "connected_clients:%d\n", len(c.s.clients))
+	fmt.Fprintf(w, "maxclients:%d\n", c.s.cfg.maxclients)
+	fmt.Fprintf(w, "blocked_clients:%d\n", blocked)
+	fmt.Fprintf(w, "pubsub_clients:%d\n", pubsub)
+	fmt.Fprintf(w, "watching_clients:%d\n", watching)
+}
+
+func writeInfoStats(c *client, w io.Writer) {
+	s := c.s
+	fmt.Fprintf(w, "total_connections_received:%d\n", s.statNumConnections)
+	fmt.Fprintf(w, "total_commands_processed:%d\n", s.statNumCommands.Load())
+	fmt.Fprintf(w, "instantaneous_ops_per_sec:%d\n", s.instantaneousOps())
+	fmt.Fprintf(w, "total_net_input_bytes:%d\n", s.statNetInputBytes.Load())
+	fmt.Fprintf(w, "total_net_output_bytes:%d\n", s.statNetOutputBytes.Load())
+	fmt.Fprintf(w, "rejected_connections:%d\n", s.statRejectedConn)
+	fmt.Fprintf(w, "expired_keys:%d\n", s.statExpiredKeys)
+	fmt.Fprintf(w, "expired_stale_perc:%.2f\n", s.statExpiredStalePerc*100)
+	fmt.Fprintf(w, "expired_time_cap_reached_count:%d\n", s.statExpiredTimeCapReached)
+	fmt.Fprintf(w, "expire_cycle_cpu_milliseconds:%d\n", s.statExpireCycleTime/time.Millisecond)
+	fmt.Fprintf(w, "evicted_keys:%d\n", s.statEvictedKeys)
+	hits, misses := s.keyspaceStats()
+	fmt.Fprintf(w, "keyspace_hits:%d\n", hits)
+	fmt.Fprintf(w, "keyspace_misses:%d\n", misses)
 }
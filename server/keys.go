@@ -1,6 +1,7 @@
 package server
 
 import (
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -78,6 +79,30 @@ func keysCommand(c *client) {
 	}
 }
 
+func scanCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	opts, ok := c.parseScanArgs(1, true)
+	if !ok {
+		return
+	}
+	var keys []string
+	cursor := c.db.keys.scan(opts.cursor, opts.count, func(key string) {
+		if !opts.pattern.match(key) {
+			return
+		}
+		if opts.typ != "" && c.db.getType(key) != opts.typ {
+			return
+		}
+		if _, ok := c.db.peek(key); ok {
+			keys = append(keys, key)
+		}
+	})
+	c.replyScan(cursor, keys)
+}
+
 func typeCommand(c *client) {
 	if len(c.args) != 2 {
 		c.replyAritryError()
@@ -117,23 +142,112 @@ func existsCommand(c *client) {
 	c.replyInt(count)
 }
 func expireCommand(c *client) {
-	if len(c.args) != 3 {
+	expireGeneric(c, time.Second, false)
+}
+
+func pexpireCommand(c *client) {
+	expireGeneric(c, time.Millisecond, false)
+}
+
+func pexpireatCommand(c *client) {
+	expireGeneric(c, time.Millisecond, true)
+}
+
+// expireGeneric is the implementation of EXPIRE, PEXPIRE, EXPIREAT and
+// PEXPIREAT. The time argument is in units, and is relative to now unless
+// abs is set. The command is written to the aof as an absolute PEXPIREAT, so
+// replaying the aof later doesn't extend the ttl.
+func expireGeneric(c *client, unit time.Duration, abs bool) {
+	if len(c.args) < 3 {
 		c.replyAritryError()
 		return
 	}
-	seconds, err := strconv.ParseInt(c.args[2], 10, 64)
+	n, err := strconv.ParseInt(c.args[2], 10, 64)
 	if err != nil {
-		c.replyError("value is not an integer or out of range")
+		c.replyInvalidIntError()
 		return
 	}
-	if c.db.expire(c.args[1], time.Now().Add(time.Duration(seconds)*time.Second)) {
-		c.replyInt(1)
-		c.dirty++
-	} else {
+	var nx, xx, gt, lt bool
+	for _, opt := range c.args[3:] {
+		switch strings.ToLower(opt) {
+		default:
+			c.replyError("Unsupported option " + opt)
+			return
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		}
+	}
+	if nx && (xx || gt || lt) {
+		c.replyError("NX and XX, GT or LT options at the same time are not compatible")
+		return
+	}
+	if gt && lt {
+		c.replyError("GT and LT options at the same time are not compatible")
+		return
+	}
+	ms, ok := expireMillis(n, unit, abs)
+	if !ok {
+		c.replyError("invalid expire time in '" + strings.ToLower(c.args[0]) + "' command")
+		return
+	}
+	key := c.args[1]
+	_, cur, ok := c.db.getExpires(key)
+	if !ok {
 		c.replyInt(0)
+		return
 	}
+	when := time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+	// a key without a ttl has an infinite ttl
+	if (nx && !cur.IsZero()) || (xx && cur.IsZero()) ||
+		(gt && (cur.IsZero() || !when.After(cur))) ||
+		(lt && !cur.IsZero() && !when.Before(cur)) {
+		c.replyInt(0)
+		return
+	}
+	if !when.After(time.Now()) {
+		c.db.del(key)
+		c.rewriteRaw("DEL", key)
+	} else {
+		c.db.expire(key, when)
+		c.rewriteRaw("PEXPIREAT", key, ms)
+	}
+	c.replyInt(1)
+	c.dirty++
+}
+
+// expireMillis converts an expire time in units into an absolute unix time
+// in milliseconds. Returns false on overflow.
+func expireMillis(n int64, unit time.Duration, abs bool) (int64, bool) {
+	mul := int64(unit / time.Millisecond)
+	if n > math.MaxInt64/mul || n < math.MinInt64/mul {
+		return 0, false
+	}
+	ms := n * mul
+	if !abs {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		if ms > math.MaxInt64-now {
+			return 0, false
+		}
+		ms += now
+	}
+	return ms, true
 }
+
 func ttlCommand(c *client) {
+	ttlGeneric(c, time.Second)
+}
+
+func pttlCommand(c *client) {
+	ttlGeneric(c, time.Millisecond)
+}
+
+func ttlGeneric(c *client, unit time.Duration) {
 	if len(c.args) != 2 {
 		c.replyAritryError()
 		return
@@ -144,9 +258,24 @@ func ttlCommand(c *client) {
 	} else if expires.IsZero() {
 		c.replyInt(-1)
 	} else {
-		c.replyInt(int(expires.Sub(time.Now()) / time.Second))
+		ttl := expires.Sub(time.Now())
+		c.replyInt(int((ttl + unit/2) / unit))
 	}
 }
+
+func persistCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	if c.db.persist(c.args[1]) {
+		c.replyInt(1)
+		c.dirty++
+	} else {
+		c.replyInt(0)
+	}
+}
+
 func moveCommand(c *client) {
 	if len(c.args) != 3 {
 		c.replyAritryError()
@@ -164,12 +293,13 @@ func moveCommand(c *client) {
 		return
 	}
 	db := c.s.selectDB(int(num))
-	_, ok = db.get(c.args[1])
+	_, ok = db.peek(c.args[1])
 	if ok {
 		c.replyInt(0)
 		return
 	}
 	db.set(c.args[1], value)
+	db.touch(c.args[1])
 	c.db.del(c.args[1])
 	c.replyInt(1)
 	c.dirty++
@@ -275,6 +405,31 @@ func (v *sortValues) Swap(i, j int) {
 	v.arr[i], v.arr[j] = v.arr[j], v.arr[i]
 }
 
+// sortKeys returns the key and the STORE destination of SORT. The keys of the
+// BY and GET patterns depend on the elements, so they can't be known.
+func sortKeys(args []string) ([]string, bool) {
+	if len(args) < 2 {
+		return nil, true
+	}
+	keys := []string{args[1]}
+	complete := true
+	for i := 2; i+1 < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "limit":
+			i += 2
+		case "store":
+			i++
+			keys = append(keys, args[i])
+		case "by", "get":
+			i++
+			if strings.Contains(args[i], "*") {
+				complete = false
+			}
+		}
+	}
+	return keys, complete
+}
+
 func sortCommand(c *client) {
 	if len(c.args) < 2 {
 		c.replyAritryError()
@@ -379,6 +534,8 @@ func sortCommand(c *client) {
 		arr = v.strArr()
 	case *set:
 		arr = v.strArr()
+	case *zset:
+		arr = v.strArr()
 	}
 	if limitProvided {
 		if offset >= len(arr) {
@@ -412,6 +569,7 @@ func sortCommand(c *client) {
 		l := newList()
 		l.rpush(arr...)
 		c.db.set(store, l)
+		c.db.touch(store)
 		c.replyInt(l.len())
 		c.dirty++
 		return
@@ -423,19 +581,5 @@ func sortCommand(c *client) {
 }
 
 func expireatCommand(c *client) {
-	if len(c.args) != 3 {
-		c.replyAritryError()
-		return
-	}
-	seconds, err := strconv.ParseInt(c.args[2], 10, 64)
-	if err != nil {
-		c.replyError("value is not an integer or out of range")
-		return
-	}
-	if c.db.expire(c.args[1], time.Unix(seconds, 0)) {
-		c.replyInt(1)
-		c.dirty++
-	} else {
-		c.replyInt(0)
-	}
+	expireGeneric(c, time.Second, true)
 }
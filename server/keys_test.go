@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTTL checks that the TTL of the key is between min and max.
+func testTTL(t *testing.T, c *testConn, key string, min, max int) {
+	t.Helper()
+	reply := c.do("TTL", key)
+	ttl, err := strconv.Atoi(strings.TrimPrefix(reply, ":"))
+	if err != nil || ttl < min || ttl > max {
+		t.Fatalf("%v: expected a TTL from %v to %v, got '%v'", key, min, max, reply)
+	}
+}
+
+func TestExpireCommands(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "SET", "a", "1")
+	c.expect(":0", "EXPIRE", "a", "100", "XX")
+	c.expect(":-1", "TTL", "a")
+	c.expect(":0", "EXPIRE", "a", "100", "GT")
+	c.expect(":1", "EXPIRE", "a", "100", "LT")
+	c.expect(":100", "TTL", "a")
+	c.expect(":0", "EXPIRE", "a", "200", "NX")
+	c.expect(":0", "EXPIRE", "a", "50", "GT")
+	c.expect(":1", "EXPIRE", "a", "200", "GT")
+	c.expect(":1", "EXPIRE", "a", "150", "XX", "LT")
+	c.expect(":150", "TTL", "a")
+	c.expect("-ERR NX and XX, GT or LT options at the same time are not compatible",
+		"EXPIRE", "a", "1", "NX", "XX")
+	c.expect("-ERR GT and LT options at the same time are not compatible",
+		"EXPIRE", "a", "1", "GT", "LT")
+	c.expect("-ERR Unsupported option foo", "EXPIRE", "a", "1", "foo")
+	c.expect("-ERR invalid expire time in 'pexpire' command",
+		"PEXPIRE", "a", "9223372036854775807")
+	c.expect(":1", "PEXPIRE", "a", "5000")
+	pttl, _ := strconv.Atoi(strings.TrimPrefix(c.do("PTTL", "a"), ":"))
+	if pttl < 4000 || pttl > 5000 {
+		t.Fatalf("expected a PTTL from %v to %v, got %v", 4000, 5000, pttl)
+	}
+	testTTL(t, c, "a", 4, 5)
+	c.expect(":1", "PERSIST", "a")
+	c.expect(":0", "PERSIST", "a")
+	c.expect(":-1", "PTTL", "a")
+	c.expect(":-2", "PTTL", "nokey")
+	c.expect(":0", "PERSIST", "nokey")
+	ms := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	c.expect(":1", "PEXPIREAT", "a", strconv.FormatInt(ms, 10))
+	testTTL(t, c, "a", 3599, 3600)
+	c.expect(":1", "EXPIREAT", "a", "1")
+	c.expect(":0", "EXISTS", "a")
+
+	c.expect("+OK", "SETEX", "b", "100", "v")
+	c.expect(":100", "TTL", "b")
+	c.expect("+OK", "PSETEX", "c", "100000", "v")
+	testTTL(t, c, "c", 99, 100)
+	c.expect("-ERR invalid expire time in 'setex' command", "SETEX", "b", "0", "v")
+	c.expect("-ERR invalid expire time in 'psetex' command", "PSETEX", "b", "-1", "v")
+	c.expect("+OK", "SET", "d", "v", "EXAT", strconv.FormatInt(time.Now().Unix()+1000, 10))
+	testTTL(t, c, "d", 998, 1000)
+	c.expect("+OK", "SET", "e", "v", "PXAT", strconv.FormatInt(ms, 10))
+	testTTL(t, c, "e", 3598, 3600)
+	c.expect("-ERR invalid expire time in 'set' command", "SET", "e", "v", "EX", "0")
+	c.expect("-ERR syntax error", "SET", "e", "v", "EX", "10", "PX", "10")
+	c.expect("+OK", "SET", "f", "v", "EX", "1000")
+
+	// the expirations are written as absolute times
+	ts.restart()
+	data, err := ioutil.ReadFile(path.Join(ts.dir, "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aof := string(data); strings.Contains(aof, "\r\nEXPIRE\r\n") ||
+		strings.Contains(aof, "SETEX") || !strings.Contains(aof, "PXAT") {
+		t.Fatalf("expected absolute expirations, got '%q'", data)
+	}
+	c = ts.dial()
+	c.expect(":0", "EXISTS", "a")
+	testTTL(t, c, "b", 98, 100)
+	testTTL(t, c, "f", 998, 1000)
+	testTTL(t, c, "e", 3597, 3600)
+	c.rewriteAOF()
+	ts.restart()
+	c = ts.dial()
+	testTTL(t, c, "b", 97, 100)
+	c.expect(":5", "DBSIZE")
+}
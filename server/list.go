@@ -656,6 +656,9 @@ func rpoplpushCommand(c *client) {
 		c.replyNull()
 		return
 	}
+	if l1.len() == 0 && l1 != l2 {
+		c.db.del(c.args[1])
+	}
 	if l2 == nil {
 		l2 = newList()
 		c.db.set(c.args[2], l2)
@@ -664,3 +667,42 @@ func rpoplpushCommand(c *client) {
 	c.replyBulk(v)
 	c.dirty++
 }
+
+func blpopCommand(c *client) {
+	blockingPop(c, true)
+}
+
+func brpopCommand(c *client) {
+	blockingPop(c, false)
+}
+
+func brpoplpushCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	timeout, ok := c.blockTimeout(c.args[3])
+	if !ok {
+		return
+	}
+	l1, ok := c.db.getList(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if _, ok := c.db.getList(c.args[2], false); !ok {
+		c.replyTypeError()
+		return
+	}
+	if l1 != nil {
+		c.popBlocked(c.args[1], false, c.args[2])
+		return
+	}
+	if c.mblock != nil {
+		// inside of EXEC or a script, which can't block
+		c.replyNull()
+		return
+	}
+	keys := copyStrings(c.args[1:3])
+	c.block(keys[:1], false, keys[1], timeout)
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bytes"
+	"time"
+)
+
+type queuedCommand struct {
+	cmd  *command
+	args []string
+	raw  []byte
+}
+
+type watchedKey struct {
+	db  *database
+	key string
+}
+
+// multiAOF collects the commands of a transaction or a script that changed
+// the dataset. The commands are written to the aof wrapped in a MULTI/EXEC
+// block so that a partially written block can be detected on load.
+type multiAOF struct {
+	startdb *database // the database that the block starts and ends on
+	db      *database // the database of the last command
+	buf     bytes.Buffer
+	n       int
+}
+
+func newMultiAOF(db *database) *multiAOF {
+	return &multiAOF{startdb: db, db: db}
+}
+
+func (m *multiAOF) add(db *database, raw []byte) {
+	if db != m.db {
+		writeMultiBulk(&m.buf, "SELECT", db.num)
+		m.db = db
+	}
+	m.buf.Write(raw)
+	m.n++
+}
+
+// flush writes the block to the aof buffer of the start database.
+func (m *multiAOF) flush() {
+	if m.n == 0 {
+		return
+	}
+	if m.db != m.startdb {
+		writeMultiBulk(&m.buf, "SELECT", m.startdb.num)
+	}
+	writeMultiBulk(&m.startdb.aofbuf, "MULTI")
+	m.startdb.aofbuf.Write(m.buf.Bytes())
+	writeMultiBulk(&m.startdb.aofbuf, "EXEC")
+}
+
+// commandArity is the number of arguments of each command, including the
+// command name, like Redis. A negative arity is the minimum number of
+// arguments.
+var commandArity = map[string]int{
+	// string
+	"get": 2, "getset": 3, "set": -3, "append": 3, "bitcount": -2,
+	"incr": 2, "incrby": 3, "decr": 2, "decrby": 3, "mget": -2, "setnx": 3,
+	"mset": -3, "msetnx": -3, "setex": 4, "psetex": 4,
+	// list
+	"lpush": -3, "rpush": -3, "lrange": 4, "llen": 2, "lpop": 2, "rpop": 2,
+	"lindex": 3, "lrem": 4, "lset": 4, "ltrim": 4, "rpoplpush": 3,
+	"blpop": -3, "brpop": -3, "brpoplpush": 4,
+	// set
+	"sadd": -3, "scard": 2, "smembers": 2, "sismember": 3, "sdiff": -2,
+	"sinter": -2, "sunion": -2, "sdiffstore": -3, "sinterstore": -3,
+	"sunionstore": -3, "spop": -2, "srandmember": -2, "srem": -3,
+	"smove": 4, "sscan": -3,
+	// sortedset
+	"zadd": -4, "zincrby": 4, "zcard": 2, "zscore": 3, "zrem": -3,
+	"zrank": 3, "zrevrank": 3, "zrange": -4, "zrevrange": -4,
+	"zrangebyscore": -4, "zrevrangebyscore": -4, "zrangebylex": -4,
+	"zrevrangebylex": -4, "zcount": 4, "zlexcount": 4, "zremrangebyrank": 4,
+	"zremrangebyscore": 4, "zremrangebylex": 4, "zunionstore": -4,
+	"zinterstore": -4,
+	// hash
+	"hset": -4, "hsetnx": 4, "hmset": -4, "hget": 3, "hmget": -3,
+	"hgetall": 2, "hkeys": 2, "hvals": 2, "hdel": -3, "hlen": 2,
+	"hstrlen": 3, "hexists": 3, "hincrby": 4, "hincrbyfloat": 4,
+	// pubsub
+	"subscribe": -2, "psubscribe": -2, "unsubscribe": -1,
+	"punsubscribe": -1, "publish": 3, "pubsub": -2,
+	// connection
+	"echo": 2, "ping": -1, "select": 2, "client": -2, "hello": -1,
+	"auth": -2,
+	// admin
+	"flushdb": 1, "flushall": 1, "dbsize": 1, "debug": -2,
+	"bgrewriteaof": 1, "bgsave": 1, "save": 1, "lastsave": 1,
+	"shutdown": -1, "info": -1, "monitor": 1, "config": -2, "acl": -2,
+	"replicaof": 3, "slaveof": 3, "sync": 1, "psync": 3, "replconf": -1,
+	"slowlog": -2,
+	// transaction
+	"multi": 1, "exec": 1, "discard": 1, "watch": -2, "unwatch": 1,
+	// scripting
+	"eval": -3, "evalsha": -3, "script": -2,
+	// keyspace
+	"del": -2, "keys": 2, "rename": 3, "renamenx": 3, "type": 2,
+	"randomkey": 1, "exists": -2, "expire": -3, "ttl": 2, "move": 3,
+	"sort": -2, "expireat": -3, "scan": -2, "pexpire": -3, "pexpireat": -3,
+	"pttl": 2, "persist": 2,
+}
+
+// queueCommand adds the current command to the MULTI queue. The args and raw
+// bytes belong to the reader and must be copied. A command with the wrong
+// number of arguments isn't queued, and it makes EXEC discard the
+// transaction.
+func (c *client) queueCommand(cmd *command) {
+	if arity := commandArity[cmd.name]; (arity > 0 && len(c.args) != arity) ||
+		(arity < 0 && len(c.args) < -arity) {
+		c.replyAritryError()
+		c.multiAbort = true
+		return
+	}
+	args := make([]string, len(c.args))
+	copy(args, c.args)
+	raw := make([]byte, len(c.raw))
+	copy(raw, c.raw)
+	c.queue = append(c.queue, queuedCommand{cmd: cmd, args: args, raw: raw})
+	c.replyString("QUEUED")
+}
+
+func (c *client) discardMulti() {
+	c.multi = false
+	c.multiAbort = false
+	c.queue = nil
+}
+
+func (c *client) watch(key string) {
+	for _, wk := range c.watching {
+		if wk.db == c.db && wk.key == key {
+			return
+		}
+	}
+	clients, ok := c.db.watchers[key]
+	if !ok {
+		clients = make(map[*client]bool)
+		c.db.watchers[key] = clients
+	}
+	clients[c] = true
+	c.watching = append(c.watching, watchedKey{db: c.db, key: key})
+}
+
+func (c *client) unwatchAll() {
+	for _, wk := range c.watching {
+		if clients, ok := wk.db.watchers[wk.key]; ok {
+			delete(clients, c)
+			if len(clients) == 0 {
+				delete(wk.db.watchers, wk.key)
+			}
+		}
+	}
+	c.watching = nil
+	c.watchDirty = false
+}
+
+// call executes a command and marks the keys of write commands as modified
+// when the dataset changed. Returns true if the dataset changed. Replicas
+// only accept changes from the master.
+func (c *client) call(cmd *command) bool {
+	if cmd.aof && c.s.follower && !c.master {
+		cmd.stats.rejected.Add(1)
+		c.replyUniqueError("READONLY You can't write against a read only replica.")
+		return false
+	}
+	if cmd.denyoom && c.s.oom {
+		cmd.stats.rejected.Add(1)
+		c.replyUniqueError("OOM command not allowed when used memory > 'maxmemory'.")
+		return false
+	}
+	dirty, errd := c.dirty, c.errd
+	c.errd = false
+	start := time.Now()
+	c.depth++
+	if cmd.aof && cmd.write {
+		// the lookups of writes aren't keyspace hits or misses
+		db, writing := c.db, c.db.writing
+		if len(db.snapshots) > 0 {
+			keys, _ := cmd.allKeys(c.args)
+			for _, key := range keys {
+				db.preserve(key)
+			}
+		}
+		db.writing = true
+		cmd.funct(c)
+		db.writing = writing
+	} else {
+		cmd.funct(c)
+	}
+	c.depth--
+	elapsed := time.Since(start)
+	cmd.stats.record(elapsed, c.errd)
+	c.s.statNumCommands.Add(1)
+	if c.depth == 0 && cmd.name != "auth" {
+		c.slowlogPush(elapsed)
+	}
+	if c.depth > 0 {
+		// an error of a command in EXEC or a script isn't an error of the
+		// EXEC or script
+		c.errd = errd
+	}
+	if c.dirty == dirty {
+		return false
+	}
+	if c.depth == 0 {
+		// EXEC and scripts call other commands, count the changes once.
+		c.s.dirty += c.dirty - dirty
+	}
+	if cmd.write {
+		for _, key := range cmd.keys(c.args) {
+			c.db.touch(key)
+		}
+	}
+	return true
+}
+
+func multiCommand(c *client) {
+	if len(c.args) != 1 {
+		c.replyAritryError()
+		return
+	}
+	if c.multi {
+		c.replyError("MULTI calls can not be nested")
+		return
+	}
+	c.multi = true
+	c.replyString("OK")
+}
+
+func discardCommand(c *client) {
+	if len(c.args) != 1 {
+		c.replyAritryError()
+		return
+	}
+	if !c.multi {
+		c.replyError("DISCARD without MULTI")
+		return
+	}
+	c.discardMulti()
+	c.unwatchAll()
+	c.replyString("OK")
+}
+
+// execCommand runs all queued commands under the write lock. The commands
+// that changed the dataset are written to the AOF wrapped in a MULTI/EXEC
+// block so that a partially written transaction can be detected on load.
+func execCommand(c *client) {
+	if len(c.args) != 1 {
+		c.replyAritryError()
+		return
+	}
+	if !c.multi {
+		c.replyError("EXEC without MULTI")
+		return
+	}
+	queue := c.queue
+	abort, dirty := c.multiAbort, c.watchDirty
+	c.discardMulti()
+	c.unwatchAll()
+	if abort {
+		c.replyUniqueError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+	if dirty {
+		c.replyNullArray()
+		return
+	}
+	args := c.args
+	c.mblock = newMultiAOF(c.db)
+	c.replyMultiBulkLen(len(queue))
+	for _, q := range queue {
+		c.args, c.raw = q.args, q.raw
+		if c.call(q.cmd) && q.cmd.aof {
+			c.mblock.add(c.db, c.raw)
+		}
+	}
+	c.args = args
+	c.mblock.flush()
+	c.mblock = nil
+}
+
+func watchCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	if c.multi {
+		c.replyError("WATCH inside MULTI is not allowed")
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		c.watch(c.args[i])
+	}
+	c.replyString("OK")
+}
+
+func unwatchCommand(c *client) {
+	if len(c.args) != 1 {
+		c.replyAritryError()
+		return
+	}
+	c.unwatchAll()
+	c.replyString("OK")
+}
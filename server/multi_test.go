@@ -0,0 +1,131 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMulti(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "MULTI")
+	c.expect("-ERR MULTI calls can not be nested", "MULTI")
+	c.expect("+QUEUED", "SET", "a", "1")
+	c.expect("+QUEUED", "SELECT", "2")
+	c.expect("+QUEUED", "INCR", "b")
+	c.expect("*[+OK,+OK,:1]", "EXEC")
+	c.expect("1", "GET", "b")
+	c.expect("+OK", "SELECT", "0")
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "SET", "a", "2")
+	c.expect("+OK", "DISCARD")
+	c.expect("1", "GET", "a")
+	c.expect("-ERR EXEC without MULTI", "EXEC")
+	c.expect("-ERR DISCARD without MULTI", "DISCARD")
+
+	// a command that fails to run doesn't stop the others
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "INCR", "a")
+	c.expect("+QUEUED", "LPUSH", "a", "x")
+	c.expect("+QUEUED", "INCR", "a")
+	c.expect("*[:2,-WRONGTYPE Operation against a key holding the wrong kind of value,:3]",
+		"EXEC")
+
+	// a command that fails to queue discards the transaction
+	c.expect("+OK", "MULTI")
+	c.expect("-ERR unknown command 'BOGUS'", "BOGUS")
+	c.expect("+QUEUED", "SET", "a", "9")
+	c.expect("-EXECABORT Transaction discarded because of previous errors.", "EXEC")
+	c.expect("+OK", "MULTI")
+	c.expect("-ERR wrong number of arguments for 'SET'", "SET", "a")
+	c.expect("+QUEUED", "SET", "a", "9")
+	c.expect("-EXECABORT Transaction discarded because of previous errors.", "EXEC")
+	c.expect("3", "GET", "a")
+}
+
+func TestMultiWatch(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	other := ts.dial()
+	c.expect("+OK", "SET", "a", "1")
+	c.expect("+OK", "WATCH", "a", "b")
+	other.expect("+OK", "SET", "a", "2")
+	c.expect("+OK", "MULTI")
+	c.expect("-ERR WATCH inside MULTI is not allowed", "WATCH", "a")
+	c.expect("+QUEUED", "SET", "a", "3")
+	c.expect("(nil)", "EXEC")
+	c.expect("2", "GET", "a")
+
+	// the keys are unwatched after EXEC
+	c.expect("+OK", "WATCH", "a")
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "SET", "a", "3")
+	c.expect("*[+OK]", "EXEC")
+	other.expect("+OK", "SET", "a", "4")
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "SET", "a", "5")
+	c.expect("*[+OK]", "EXEC")
+
+	// a key that is created, deleted or expires is touched
+	c.expect("+OK", "WATCH", "b")
+	other.expect(":1", "RPUSH", "b", "x")
+	c.expect("+OK", "MULTI")
+	c.expect("(nil)", "EXEC")
+	c.expect("+OK", "WATCH", "b")
+	other.expect(":1", "DEL", "b")
+	c.expect("+OK", "MULTI")
+	c.expect("(nil)", "EXEC")
+	c.expect("+OK", "WATCH", "a")
+	c.expect("+OK", "UNWATCH")
+	other.expect("+OK", "SET", "a", "6")
+	c.expect("+OK", "MULTI")
+	c.expect("*[]", "EXEC")
+
+	// a key that is watched in another database isn't touched
+	c.expect("+OK", "WATCH", "a")
+	other.expect("+OK", "SELECT", "1")
+	other.expect("+OK", "SET", "a", "7")
+	c.expect("+OK", "MULTI")
+	c.expect("*[]", "EXEC")
+}
+
+func TestMultiAOF(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "SET", "a", "1")
+	c.expect("+QUEUED", "SELECT", "2")
+	c.expect("+QUEUED", "SET", "b", "2")
+	c.expect("*[+OK,+OK,+OK]", "EXEC")
+	ts.shutdown()
+
+	// a transaction without EXEC at the end of the aof is discarded
+	f, err := os.OpenFile(path.Join(ts.dir, "appendonly.aof"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n9\r\n")
+	f.Close()
+	ts.start()
+	c = ts.dial()
+	c.expect("1", "GET", "a")
+	c.expect("+OK", "SELECT", "2")
+	c.expect("2", "GET", "b")
+	c.expect("+OK", "SET", "c", "3")
+	ts.restart()
+	c = ts.dial()
+	c.expect("1", "GET", "a")
+	c.expect("+OK", "SELECT", "2")
+	c.expect("3", "GET", "c")
+}
+
+func TestCommandArity(t *testing.T) {
+	s := &Server{cmds: make(map[string]*command)}
+	s.commandTable()
+	for _, cmd := range s.cmds {
+		if commandArity[cmd.name] == 0 {
+			t.Fatalf("expected an arity for '%v'", cmd.name)
+		}
+	}
+}
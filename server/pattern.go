@@ -32,7 +32,7 @@ func parsePattern(value string) *pattern {
 	} else if p.greaterOrEqual != "" {
 		c := p.greaterOrEqual[len(p.greaterOrEqual)-1]
 		if c == 0xFF {
-			p.lessThan = p.greaterOrEqual + string(0)
+			p.lessThan = p.greaterOrEqual + "\x00"
 		} else {
 			p.lessThan = p.greaterOrEqual[:len(p.greaterOrEqual)-1] + string(c+1)
 		}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// subPattern is a pattern subscription shared by all clients that
+// subscribed to the same pattern.
+type subPattern struct {
+	pattern *pattern
+	clients map[*client]bool
+}
+
+// subscribed returns true when the client is in pubsub mode.
+func (c *client) subscribed() bool {
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+func (c *client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// replyPubSub writes a subscribe style reply such as
+// "subscribe channel 1" to the client.
+func (c *client) replyPubSub(kind, name string, null bool) {
+	c.replyPushLen(3)
+	c.replyBulk(kind)
+	if null {
+		c.replyNull()
+	} else {
+		c.replyBulk(name)
+	}
+	c.replyInt(c.subscriptions())
+}
+
+func (s *Server) subscribe(c *client, channel string) {
+	if c.channels == nil {
+		c.channels = make(map[string]bool)
+	}
+	if !c.channels[channel] {
+		c.channels[channel] = true
+		clients, ok := s.channels[channel]
+		if !ok {
+			clients = make(map[*client]bool)
+			s.channels[channel] = clients
+		}
+		clients[c] = true
+	}
+	c.replyPubSub("subscribe", channel, false)
+}
+
+func (s *Server) unsubscribe(c *client, channel string) {
+	if c.channels[channel] {
+		delete(c.channels, channel)
+		if clients, ok := s.channels[channel]; ok {
+			delete(clients, c)
+			if len(clients) == 0 {
+				delete(s.channels, channel)
+			}
+		}
+	}
+	c.replyPubSub("unsubscribe", channel, false)
+}
+
+func (s *Server) psubscribe(c *client, pattern string) {
+	if c.patterns == nil {
+		c.patterns = make(map[string]bool)
+	}
+	if !c.patterns[pattern] {
+		c.patterns[pattern] = true
+		sp, ok := s.patterns[pattern]
+		if !ok {
+			sp = &subPattern{
+				pattern: parsePattern(pattern),
+				clients: make(map[*client]bool),
+			}
+			s.patterns[pattern] = sp
+		}
+		sp.clients[c] = true
+	}
+	c.replyPubSub("psubscribe", pattern, false)
+}
+
+func (s *Server) punsubscribe(c *client, pattern string) {
+	if c.patterns[pattern] {
+		delete(c.patterns, pattern)
+		if sp, ok := s.patterns[pattern]; ok {
+			delete(sp.clients, c)
+			if len(sp.clients) == 0 {
+				delete(s.patterns, pattern)
+			}
+		}
+	}
+	c.replyPubSub("punsubscribe", pattern, false)
+}
+
+// unsubscribeAll removes every subscription for a client. Used when the
+// client disconnects.
+func (s *Server) unsubscribeAll(c *client) {
+	for channel := range c.channels {
+		if clients, ok := s.channels[channel]; ok {
+			delete(clients, c)
+			if len(clients) == 0 {
+				delete(s.channels, channel)
+			}
+		}
+	}
+	for pattern := range c.patterns {
+		if sp, ok := s.patterns[pattern]; ok {
+			delete(sp.clients, c)
+			if len(sp.clients) == 0 {
+				delete(s.patterns, pattern)
+			}
+		}
+	}
+	c.channels = nil
+	c.patterns = nil
+}
+
+// pushLimit is the most bytes of messages that may wait for a subscriber,
+// which is disconnected when it falls further behind.
+const pushLimit = 32 * 1024 * 1024
+
+// publish sends a message to all clients subscribed to the channel or to a
+// pattern matching the channel. Returns the number of clients that
+// received the message. The messages are queued for the pushers of the
+// subscribers, so a slow subscriber doesn't hold up the server.
+func (s *Server) publish(channel, message string) int {
+	var count int
+	var msgs [4][]byte // by protocol
+	for sc := range s.channels[channel] {
+		if msgs[sc.protocol()] == nil {
+			msgs[sc.protocol()] = encodePush(sc.protocol(), "message", channel, message)
+		}
+		sc.queuePush(msgs[sc.protocol()])
+		count++
+	}
+	for _, sp := range s.patterns {
+		if !sp.pattern.match(channel) {
+			continue
+		}
+		for sc := range sp.clients {
+			sc.queuePush(encodePush(sc.protocol(), "pmessage",
+				sp.pattern.value, channel, message))
+			count++
+		}
+	}
+	return count
+}
+
+// encodePush returns a push with the protocol of a subscriber.
+func encodePush(resp int, parts ...string) []byte {
+	var buf bytes.Buffer
+	pc := &client{wr: &buf, resp: resp}
+	pc.replyPushLen(len(parts))
+	for _, part := range parts {
+		pc.replyBulk(part)
+	}
+	return buf.Bytes()
+}
+
+// queuePush adds a message for the pusher of the subscriber. The caller must
+// hold the write lock.
+func (sc *client) queuePush(msg []byte) {
+	if sc.replyOff {
+		return
+	}
+	sc.pushMu.Lock()
+	if sc.pushFull {
+		sc.pushMu.Unlock()
+		return
+	}
+	if len(sc.pushes)+len(msg) > pushLimit {
+		sc.pushFull = true
+		sc.pushes = nil
+		sc.pushMu.Unlock()
+		sc.s.lwarningf("Client %s closed for overcoming of output buffer limits.", sc.addr)
+		if sc.conn != nil {
+			sc.conn.Close()
+		}
+		return
+	}
+	sc.pushes = append(sc.pushes, msg...)
+	sc.pushMu.Unlock()
+	select {
+	case sc.pushWake <- struct{}{}:
+	default:
+		// already woken
+	}
+}
+
+// pushLoop is the pusher of a subscriber, which writes the queued messages
+// between the replies of the client until done is closed.
+func (c *client) pushLoop(wr *bufio.Writer, done, exited chan struct{}) {
+	defer close(exited)
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.pushWake:
+		}
+		c.outMu.Lock()
+		select {
+		case <-done:
+			c.outMu.Unlock()
+			return
+		default:
+		}
+		c.pushMu.Lock()
+		pushes := c.pushes
+		c.pushes = nil
+		c.pushMu.Unlock()
+		wr.Write(pushes)
+		err := wr.Flush()
+		c.outMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func subscribeCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		c.s.subscribe(c, c.args[i])
+	}
+}
+
+func psubscribeCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		c.s.psubscribe(c, c.args[i])
+	}
+}
+
+func unsubscribeCommand(c *client) {
+	if len(c.args) == 1 {
+		if len(c.channels) == 0 {
+			c.replyPubSub("unsubscribe", "", true)
+			return
+		}
+		channels := make([]string, 0, len(c.channels))
+		for channel := range c.channels {
+			channels = append(channels, channel)
+		}
+		for _, channel := range channels {
+			c.s.unsubscribe(c, channel)
+		}
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		c.s.unsubscribe(c, c.args[i])
+	}
+}
+
+func punsubscribeCommand(c *client) {
+	if len(c.args) == 1 {
+		if len(c.patterns) == 0 {
+			c.replyPubSub("punsubscribe", "", true)
+			return
+		}
+		patterns := make([]string, 0, len(c.patterns))
+		for pattern := range c.patterns {
+			patterns = append(patterns, pattern)
+		}
+		for _, pattern := range patterns {
+			c.s.punsubscribe(c, pattern)
+		}
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		c.s.punsubscribe(c, c.args[i])
+	}
+}
+
+func publishCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	c.replyInt(c.s.publish(c.args[1], c.args[2]))
+}
+
+func pubsubCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("Unknown PUBSUB subcommand or wrong number of arguments for '" + c.args[1] + "'")
+	case "channels":
+		if len(c.args) > 3 {
+			c.replyError("Unknown PUBSUB subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		var p *pattern
+		if len(c.args) == 3 {
+			p = parsePattern(c.args[2])
+		}
+		var channels []string
+		for channel := range c.s.channels {
+			if p == nil || p.match(channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		c.replyMultiBulkLen(len(channels))
+		for _, channel := range channels {
+			c.replyBulk(channel)
+		}
+	case "numsub":
+		c.replyMapLen(len(c.args) - 2)
+		for i := 2; i < len(c.args); i++ {
+			c.replyBulk(c.args[i])
+			c.replyInt(len(c.s.channels[c.args[i]]))
+		}
+	case "numpat":
+		if len(c.args) != 2 {
+			c.replyError("Unknown PUBSUB subcommand or wrong number of arguments for '" + c.args[1] + "'")
+			return
+		}
+		c.replyInt(len(c.s.patterns))
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPubSub(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	s1 := ts.dial()
+	s2 := ts.dial()
+	s1.expect("*[subscribe,news,:1]", "SUBSCRIBE", "news")
+	s2.expect("*[psubscribe,n*,:1]", "PSUBSCRIBE", "n*")
+	s1.expect("-ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context",
+		"GET", "x")
+	s1.expect("*[pong,]", "PING")
+	c.expect(":2", "PUBLISH", "news", "hello")
+	if got := s1.read(); got != "*[message,news,hello]" {
+		t.Fatalf("expected '%v', got '%v'", "*[message,news,hello]", got)
+	}
+	if got := s2.read(); got != "*[pmessage,n*,news,hello]" {
+		t.Fatalf("expected '%v', got '%v'", "*[pmessage,n*,news,hello]", got)
+	}
+	c.expect("*[news]", "PUBSUB", "CHANNELS")
+	c.expect("*[news,:1,x,:0]", "PUBSUB", "NUMSUB", "news", "x")
+	c.expect(":1", "PUBSUB", "NUMPAT")
+	s1.expect("*[unsubscribe,news,:0]", "UNSUBSCRIBE")
+	s1.expect("(nil)", "GET", "x")
+	s2.conn.Close()
+	c.wait(":0", "PUBSUB", "NUMPAT")
+	c.expect(":0", "PUBLISH", "news", "hello")
+}
+
+func TestPubSubSlowSubscriber(t *testing.T) {
+	ts := testStartServer(t)
+	sub := ts.dial()
+	sub.expect("*[subscribe,ch,:1]", "SUBSCRIBE", "ch")
+
+	// the subscriber doesn't read, which doesn't block the publisher, and
+	// it's disconnected when it's too far behind
+	c := ts.dial()
+	msg := strings.Repeat("x", 1024*1024)
+	for i := 0; i < 80; i++ {
+		if got := c.do("PUBLISH", "ch", msg); strings.HasPrefix(got, "ERR:") {
+			t.Fatal(got)
+		}
+	}
+	c.wait(":0", "PUBLISH", "ch", "m")
+}
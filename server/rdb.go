@@ -0,0 +1,1111 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The snapshot file uses the Redis RDB format. Snapshots are written as
+// version 9, which every Redis release since 5.0 can load. Files written by
+// newer Redis versions can be read as long as they only contain the data
+// types that sider supports.
+const (
+	rdbVersion    = 9
+	rdbMaxVersion = 12
+
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5
+	rdbTypeHashZipmap     = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZSetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeSetListpack    = 20
+
+	rdbOpcodeFunction2    = 0xf5
+	rdbOpcodeModuleAux    = 0xf7
+	rdbOpcodeIdle         = 0xf8
+	rdbOpcodeFreq         = 0xf9
+	rdbOpcodeAux          = 0xfa
+	rdbOpcodeResizeDB     = 0xfb
+	rdbOpcodeExpireTimeMS = 0xfc
+	rdbOpcodeExpireTime   = 0xfd
+	rdbOpcodeSelectDB     = 0xfe
+	rdbOpcodeEOF          = 0xff
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	rdbQuicklistNodePlain = 1
+)
+
+// rdbCRCTable is the Jones polynomial used by Redis, in reversed form.
+var rdbCRCTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// rdbCRC updates a Redis style crc64, which does not invert the input and
+// output like the hash/crc64 package does.
+func rdbCRC(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, rdbCRCTable, p)
+}
+
+type rdbWriter struct {
+	wr  io.Writer
+	crc uint64
+	err error
+	buf [9]byte
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = rdbCRC(w.crc, p)
+	_, w.err = w.wr.Write(p)
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.buf[0] = b
+	w.write(w.buf[:1])
+}
+
+func (w *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.writeByte(byte(n))
+	case n < 1<<14:
+		w.buf[0] = 0x40 | byte(n>>8)
+		w.buf[1] = byte(n)
+		w.write(w.buf[:2])
+	case n <= math.MaxUint32:
+		w.buf[0] = 0x80
+		binary.BigEndian.PutUint32(w.buf[1:], uint32(n))
+		w.write(w.buf[:5])
+	default:
+		w.buf[0] = 0x81
+		binary.BigEndian.PutUint64(w.buf[1:], n)
+		w.write(w.buf[:9])
+	}
+}
+
+func (w *rdbWriter) writeString(s string) {
+	w.writeLen(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+// writeEntry writes a key and its value, which are preceded by the type of
+// the value.
+func (w *rdbWriter) writeEntry(key string, value interface{}) {
+	switch v := value.(type) {
+	default:
+		if w.err == nil {
+			w.err = errors.New("invalid type in database")
+		}
+	case string:
+		w.writeByte(rdbTypeString)
+		w.writeString(key)
+		w.writeString(v)
+	case *list:
+		w.writeByte(rdbTypeList)
+		w.writeString(key)
+		w.writeLen(uint64(v.len()))
+		v.ascend(func(value string) bool {
+			w.writeString(value)
+			return w.err == nil
+		})
+	case *set:
+		w.writeByte(rdbTypeSet)
+		w.writeString(key)
+		w.writeLen(uint64(v.len()))
+		v.ascend(func(member string) bool {
+			w.writeString(member)
+			return w.err == nil
+		})
+	case *zset:
+		w.writeByte(rdbTypeZSet2)
+		w.writeString(key)
+		w.writeLen(uint64(v.len()))
+		v.ascend(func(member string, score float64) bool {
+			w.writeString(member)
+			binary.LittleEndian.PutUint64(w.buf[:8], math.Float64bits(score))
+			w.write(w.buf[:8])
+			return w.err == nil
+		})
+	case *hash:
+		w.writeByte(rdbTypeHash)
+		w.writeString(key)
+		w.writeLen(uint64(v.len()))
+		v.ascend(func(field, value string) bool {
+			w.writeString(field)
+			w.writeString(value)
+			return w.err == nil
+		})
+	}
+}
+
+// writeHeader writes the version and the auxiliary fields.
+func (w *rdbWriter) writeHeader(version string, ctime time.Time) {
+	w.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+	aux := func(key, value string) {
+		w.writeByte(rdbOpcodeAux)
+		w.writeString(key)
+		w.writeString(value)
+	}
+	aux("redis-ver", version)
+	aux("redis-bits", strconv.Itoa(ptrSize))
+	aux("ctime", strconv.FormatInt(ctime.Unix(), 10))
+}
+
+// writeFooter writes the end of the file and the checksum.
+func (w *rdbWriter) writeFooter() {
+	w.writeByte(rdbOpcodeEOF)
+	binary.LittleEndian.PutUint64(w.buf[:8], w.crc)
+	w.write(w.buf[:8])
+}
+
+// writeSelectDB starts a database, with the sizes of its hash tables.
+func (w *rdbWriter) writeSelectDB(num, keys, expires int) {
+	w.writeByte(rdbOpcodeSelectDB)
+	w.writeLen(uint64(num))
+	w.writeByte(rdbOpcodeResizeDB)
+	w.writeLen(uint64(keys))
+	w.writeLen(uint64(expires))
+}
+
+// writeExpires writes the expiration of the next entry.
+func (w *rdbWriter) writeExpires(t time.Time) {
+	w.writeByte(rdbOpcodeExpireTimeMS)
+	ms := t.UnixNano() / int64(time.Millisecond)
+	binary.LittleEndian.PutUint64(w.buf[:8], uint64(ms))
+	w.write(w.buf[:8])
+}
+
+// writeRDB writes a point-in-time snapshot of every database to wr. The
+// caller must hold the lock.
+func (s *Server) writeRDB(wr io.Writer) error {
+	w := &rdbWriter{wr: wr}
+	w.writeHeader(s.options.Version, time.Now())
+	dbs := make([]*database, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Sort(dbsByNumber(dbs))
+	now := time.Now()
+	for _, db := range dbs {
+		if db.len() == 0 {
+			continue
+		}
+		w.writeSelectDB(db.num, len(db.items), len(db.expires))
+		for key, item := range db.items {
+			if item.expires {
+				if t, ok := db.expires[key]; ok {
+					if now.After(t) {
+						continue
+					}
+					w.writeExpires(t)
+				}
+			}
+			w.writeEntry(key, item.value)
+			if w.err != nil {
+				return w.err
+			}
+		}
+	}
+	w.writeFooter()
+	return w.err
+}
+
+// rdbSelectDB and rdbEntry encode the databases of a snapshot as an RDB file.
+func rdbSelectDB(buf *bytes.Buffer, sd *snapshotDB) {
+	w := &rdbWriter{wr: buf}
+	w.writeSelectDB(sd.db.num, len(sd.keys), len(sd.expires))
+}
+
+func rdbEntry(buf *bytes.Buffer, key string, value interface{}, expires time.Time) error {
+	w := &rdbWriter{wr: buf}
+	if !expires.IsZero() {
+		w.writeExpires(expires)
+	}
+	w.writeEntry(key, value)
+	return w.err
+}
+
+type rdbReader struct {
+	rd  *bufio.Reader
+	crc uint64
+	buf [8]byte
+}
+
+func (r *rdbReader) read(p []byte) error {
+	if _, err := io.ReadFull(r.rd, p); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.crc = rdbCRC(r.crc, p)
+	return nil
+}
+
+// rdbReadChunk is the most that is allocated for a string or a collection
+// before its bytes are read. The lengths come from the file, and a corrupt
+// length must fail at the end of the file instead of allocating it.
+const rdbReadChunk = 64 * 1024
+
+// readBytes reads a string of n bytes in chunks.
+func (r *rdbReader) readBytes(n uint64) ([]byte, error) {
+	var b []byte
+	for uint64(len(b)) < n {
+		m := n - uint64(len(b))
+		if m > rdbReadChunk {
+			m = rdbReadChunk
+		}
+		b = append(b, make([]byte, m)...)
+		if err := r.read(b[len(b)-int(m):]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	if err := r.read(r.buf[:1]); err != nil {
+		return 0, err
+	}
+	return r.buf[0], nil
+}
+
+// readLen reads a length. When encoded is true the length is actually one
+// of the special string encodings.
+func (r *rdbReader) readLen() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		b2, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			if err := r.read(r.buf[:4]); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(r.buf[:4])), false, nil
+		case 0x81:
+			if err := r.read(r.buf[:8]); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(r.buf[:8]), false, nil
+		}
+		return 0, false, fmt.Errorf("Unknown length encoding %d in rdbLoadLen()", b)
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+func (r *rdbReader) readCount() (int, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, errors.New("Unexpected string encoding for a length")
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("Invalid length %d", n)
+	}
+	return int(n), nil
+}
+
+func (r *rdbReader) readString() (string, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := r.readBytes(n)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := r.readByte()
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int8(b)), 10), nil
+	case rdbEncInt16:
+		if err := r.read(r.buf[:2]); err != nil {
+			return "", err
+		}
+		v := int16(binary.LittleEndian.Uint16(r.buf[:2]))
+		return strconv.FormatInt(int64(v), 10), nil
+	case rdbEncInt32:
+		if err := r.read(r.buf[:4]); err != nil {
+			return "", err
+		}
+		v := int32(binary.LittleEndian.Uint32(r.buf[:4]))
+		return strconv.FormatInt(int64(v), 10), nil
+	case rdbEncLZF:
+		clen, err := r.readCount()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := r.readCount()
+		if err != nil {
+			return "", err
+		}
+		in, err := r.readBytes(uint64(clen))
+		if err != nil {
+			return "", err
+		}
+		out, err := lzfDecompress(in, ulen)
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	}
+	return "", fmt.Errorf("Unknown RDB string encoding type %d", n)
+}
+
+// readScore reads a zset score that is stored as a string, which is used by
+// the old zset type.
+func (r *rdbReader) readScore() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(+1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.readBytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func (r *rdbReader) readStrings(n int) ([]string, error) {
+	size := n
+	if size > rdbReadChunk {
+		size = rdbReadChunk
+	}
+	strs := make([]string, 0, size)
+	for i := 0; i < n; i++ {
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// readValue reads a value of the given type and converts it into the type
+// that is stored in the database.
+func (r *rdbReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case rdbTypeString:
+		return r.readString()
+	case rdbTypeList:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		values, err := r.readStrings(n)
+		if err != nil {
+			return nil, err
+		}
+		return newListFrom(values), nil
+	case rdbTypeSet:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		members, err := r.readStrings(n)
+		if err != nil {
+			return nil, err
+		}
+		return newSetFrom(members), nil
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		z := newZSet()
+		for i := 0; i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == rdbTypeZSet2 {
+				if err := r.read(r.buf[:8]); err != nil {
+					return nil, err
+				}
+				score = math.Float64frombits(binary.LittleEndian.Uint64(r.buf[:8]))
+			} else if score, err = r.readScore(); err != nil {
+				return nil, err
+			}
+			z.add(member, score)
+		}
+		return z, nil
+	case rdbTypeHash:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		pairs, err := r.readStrings(n * 2)
+		if err != nil {
+			return nil, err
+		}
+		return newHashFrom(pairs), nil
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		l := newList()
+		for i := 0; i < n; i++ {
+			container := rdbQuicklistNodePlain + 1
+			if typ == rdbTypeListQuicklist2 {
+				if container, err = r.readCount(); err != nil {
+					return nil, err
+				}
+			}
+			blob, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			var values []string
+			switch {
+			case typ == rdbTypeListQuicklist:
+				values, err = parseZiplist([]byte(blob))
+			case container == rdbQuicklistNodePlain:
+				values = []string{blob}
+			default:
+				values, err = parseListpack([]byte(blob))
+			}
+			if err != nil {
+				return nil, err
+			}
+			l.rpush(values...)
+		}
+		return l, nil
+	}
+	// The remaining types are a single blob in a compact encoding.
+	blob, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	switch typ {
+	default:
+		return nil, fmt.Errorf("Unknown RDB encoding type %d", typ)
+	case rdbTypeHashZipmap:
+		values, err = parseZipmap([]byte(blob))
+	case rdbTypeSetIntset:
+		values, err = parseIntset([]byte(blob))
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		values, err = parseZiplist([]byte(blob))
+	case rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		values, err = parseListpack([]byte(blob))
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case rdbTypeListZiplist:
+		return newListFrom(values), nil
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		return newSetFrom(values), nil
+	}
+	if len(values)%2 != 0 {
+		return nil, errors.New("Odd number of elements in an encoded pair list")
+	}
+	if typ == rdbTypeZSetZiplist || typ == rdbTypeZSetListpack {
+		z := newZSet()
+		for i := 0; i < len(values); i += 2 {
+			score, err := strconv.ParseFloat(values[i+1], 64)
+			if err != nil {
+				return nil, err
+			}
+			z.add(values[i], score)
+		}
+		return z, nil
+	}
+	return newHashFrom(values), nil
+}
+
+// readRDB reads an RDB file and calls iter for every key that has not
+// expired.
+func readRDB(rd io.Reader, iter func(dbnum int, key string, value interface{}, expires time.Time) error) error {
+	r := &rdbReader{rd: bufio.NewReaderSize(rd, 64*1024)}
+	var header [9]byte
+	if err := r.read(header[:]); err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("Wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return fmt.Errorf("Can't handle RDB format version %s", header[5:])
+	}
+	now := time.Now()
+	var dbnum int
+	var expires time.Time
+	for {
+		typ, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case rdbOpcodeEOF:
+			if version < 5 {
+				return nil
+			}
+			crc := r.crc
+			if err := r.read(r.buf[:8]); err != nil {
+				return err
+			}
+			expected := binary.LittleEndian.Uint64(r.buf[:8])
+			if expected != 0 && expected != crc {
+				return errors.New("Wrong RDB checksum")
+			}
+			return nil
+		case rdbOpcodeSelectDB:
+			n, err := r.readCount()
+			if err != nil {
+				return err
+			}
+			dbnum = n
+			continue
+		case rdbOpcodeResizeDB:
+			if _, err := r.readCount(); err != nil {
+				return err
+			}
+			if _, err := r.readCount(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeAux:
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeExpireTimeMS:
+			if err := r.read(r.buf[:8]); err != nil {
+				return err
+			}
+			ms := int64(binary.LittleEndian.Uint64(r.buf[:8]))
+			expires = time.Unix(0, ms*int64(time.Millisecond))
+			continue
+		case rdbOpcodeExpireTime:
+			if err := r.read(r.buf[:4]); err != nil {
+				return err
+			}
+			expires = time.Unix(int64(binary.LittleEndian.Uint32(r.buf[:4])), 0)
+			continue
+		case rdbOpcodeIdle:
+			if _, err := r.readCount(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeFreq:
+			if _, err := r.readByte(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeFunction2:
+			// Function libraries are not supported and are skipped.
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeModuleAux:
+			return errors.New("The RDB file contains module data that is not supported")
+		}
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+		value, err := r.readValue(typ)
+		if err != nil {
+			return err
+		}
+		if expires.IsZero() || expires.After(now) {
+			if err := iter(dbnum, key, value, expires); err != nil {
+				return err
+			}
+		}
+		expires = time.Time{}
+	}
+}
+
+func newListFrom(values []string) *list {
+	l := newList()
+	l.rpush(values...)
+	return l
+}
+
+func newSetFrom(members []string) *set {
+	st := newSet()
+	for _, member := range members {
+		st.add(member)
+	}
+	return st
+}
+
+func newHashFrom(pairs []string) *hash {
+	h := newHash()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		h.set(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+var errCorruptEncoding = errors.New("Corrupt encoded value in RDB file")
+
+// lzfDecompress expands data that was compressed with LZF.
+func lzfDecompress(in []byte, ulen int) ([]byte, error) {
+	// a back reference of three bytes expands to at most 264 bytes
+	size := ulen
+	if size > len(in)*88 {
+		size = len(in) * 88
+	}
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// literal run
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errCorruptEncoding
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errCorruptEncoding
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorruptEncoding
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorruptEncoding
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != ulen {
+		return nil, errCorruptEncoding
+	}
+	return out, nil
+}
+
+// parseZiplist returns the entries of a ziplist, which is the compact
+// encoding used by Redis before 7.0.
+func parseZiplist(b []byte) ([]string, error) {
+	if len(b) < 11 {
+		return nil, errCorruptEncoding
+	}
+	var values []string
+	i := 10
+	for {
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		if b[i] == 0xff {
+			return values, nil
+		}
+		// skip the length of the previous entry
+		if b[i] == 0xfe {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		enc := b[i]
+		i++
+		var value string
+		var n int
+		switch {
+		case enc>>6 == 0:
+			n = int(enc & 0x3f)
+		case enc>>6 == 1:
+			if i >= len(b) {
+				return nil, errCorruptEncoding
+			}
+			n = int(enc&0x3f)<<8 | int(b[i])
+			i++
+		case enc == 0x80:
+			if i+4 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			n = int(binary.BigEndian.Uint32(b[i:]))
+			i += 4
+		default:
+			var v int64
+			var size int
+			switch {
+			case enc == 0xc0:
+				size = 2
+			case enc == 0xd0:
+				size = 4
+			case enc == 0xe0:
+				size = 8
+			case enc == 0xf0:
+				size = 3
+			case enc == 0xfe:
+				size = 1
+			case enc >= 0xf1 && enc <= 0xfd:
+				v = int64(enc&0x0f) - 1
+			default:
+				return nil, errCorruptEncoding
+			}
+			if i+size > len(b) {
+				return nil, errCorruptEncoding
+			}
+			if size > 0 {
+				v = readIntLE(b[i : i+size])
+			}
+			i += size
+			values = append(values, strconv.FormatInt(v, 10))
+			continue
+		}
+		if i+n > len(b) {
+			return nil, errCorruptEncoding
+		}
+		value = string(b[i : i+n])
+		i += n
+		values = append(values, value)
+	}
+}
+
+// parseListpack returns the entries of a listpack, which is the compact
+// encoding used by Redis 7.0 and later.
+func parseListpack(b []byte) ([]string, error) {
+	if len(b) < 7 {
+		return nil, errCorruptEncoding
+	}
+	var values []string
+	i := 6
+	for {
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		enc := b[i]
+		if enc == 0xff {
+			return values, nil
+		}
+		start := i
+		i++
+		var str bool
+		var n int
+		var v int64
+		switch {
+		case enc&0x80 == 0:
+			v = int64(enc & 0x7f)
+		case enc&0xc0 == 0x80:
+			str = true
+			n = int(enc & 0x3f)
+		case enc&0xe0 == 0xc0:
+			if i >= len(b) {
+				return nil, errCorruptEncoding
+			}
+			v = int64(enc&0x1f)<<8 | int64(b[i])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			i++
+		case enc&0xf0 == 0xe0:
+			if i >= len(b) {
+				return nil, errCorruptEncoding
+			}
+			str = true
+			n = int(enc&0x0f)<<8 | int(b[i])
+			i++
+		case enc == 0xf0:
+			if i+4 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			str = true
+			n = int(binary.LittleEndian.Uint32(b[i:]))
+			i += 4
+		case enc >= 0xf1 && enc <= 0xf4:
+			size := [...]int{2, 3, 4, 8}[enc-0xf1]
+			if i+size > len(b) {
+				return nil, errCorruptEncoding
+			}
+			v = readIntLE(b[i : i+size])
+			i += size
+		default:
+			return nil, errCorruptEncoding
+		}
+		if str {
+			if i+n > len(b) {
+				return nil, errCorruptEncoding
+			}
+			values = append(values, string(b[i:i+n]))
+			i += n
+		} else {
+			values = append(values, strconv.FormatInt(v, 10))
+		}
+		// skip the backlen, which is the size of the entry
+		switch size := i - start; {
+		case size < 1<<7:
+			i++
+		case size < 1<<14:
+			i += 2
+		case size < 1<<21:
+			i += 3
+		case size < 1<<28:
+			i += 4
+		default:
+			i += 5
+		}
+	}
+}
+
+// parseIntset returns the members of an intset.
+func parseIntset(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errCorruptEncoding
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if (size != 2 && size != 4 && size != 8) || 8+n*size > len(b) {
+		return nil, errCorruptEncoding
+	}
+	members := make([]string, n)
+	for i := 0; i < n; i++ {
+		v := readIntLE(b[8+i*size : 8+(i+1)*size])
+		members[i] = strconv.FormatInt(v, 10)
+	}
+	return members, nil
+}
+
+// parseZipmap returns the field value pairs of a zipmap, which is the hash
+// encoding used by Redis before 2.6.
+func parseZipmap(b []byte) ([]string, error) {
+	var pairs []string
+	i := 1
+	readLen := func() (int, bool) {
+		if i >= len(b) {
+			return 0, false
+		}
+		n := int(b[i])
+		i++
+		if n == 254 {
+			if i+4 > len(b) {
+				return 0, false
+			}
+			n = int(binary.LittleEndian.Uint32(b[i:]))
+			i += 4
+		}
+		return n, true
+	}
+	for {
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		if b[i] == 0xff {
+			return pairs, nil
+		}
+		n, ok := readLen()
+		if !ok || i+n > len(b) {
+			return nil, errCorruptEncoding
+		}
+		field := string(b[i : i+n])
+		i += n
+		n, ok = readLen()
+		if !ok || i+1+n > len(b) {
+			return nil, errCorruptEncoding
+		}
+		free := int(b[i])
+		i++
+		value := string(b[i : i+n])
+		i += n + free
+		pairs = append(pairs, field, value)
+	}
+}
+
+// readIntLE reads a little-endian signed integer of 1 to 8 bytes.
+func readIntLE(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := uint(64 - len(b)*8)
+	return int64(v<<shift) >> shift
+}
+
+// saveRDB writes the snapshot file. The data is written to a temporary file
+// which replaces the snapshot file once it is complete. The caller must hold
+// the write lock.
+func (s *Server) saveRDB() error {
+	tempName := path.Join(path.Dir(s.rdbPath),
+		fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err := s.writeRDBFile(tempName, func(wr io.Writer) error {
+		return s.writeRDB(wr)
+	}); err != nil {
+		s.lwarningf("Failed saving the DB: %v", err)
+		return err
+	}
+	s.lastsave = time.Now()
+	s.lastbgsaveErr = nil
+	s.dirty = 0
+	s.lnoticef("DB saved on disk")
+	return nil
+}
+
+// bgsaveRDB writes the snapshot file in the background. Returns false if a
+// background save is already in progress. The snapshot is taken while the
+// caller holds the write lock, and then it's encoded in chunks which only
+// hold the lock for a moment each.
+func (s *Server) bgsaveRDB() bool {
+	if s.rdbsaving {
+		return false
+	}
+	snap := s.newSnapshot(rdbSelectDB, rdbEntry)
+	s.rdbsaving = true
+	start, dirty := snap.start, s.dirty
+	tempName := path.Join(path.Dir(s.rdbPath),
+		fmt.Sprintf("temp-bgsave-%d.rdb", os.Getpid()))
+	s.lnoticef("Background saving started")
+	go func() {
+		err := s.writeRDBFile(tempName, func(wr io.Writer) error {
+			w := &rdbWriter{wr: wr}
+			w.writeHeader(s.options.Version, start)
+			if err := s.streamSnapshot(snap, func(p []byte) error {
+				w.write(p)
+				return w.err
+			}); err != nil {
+				return err
+			}
+			w.writeFooter()
+			return w.err
+		})
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.rdbsaving = false
+		s.lastbgsaveErr = err
+		if err != nil {
+			s.lwarningf("Background saving error: %v", err)
+			return
+		}
+		s.lastsave = start
+		s.dirty -= dirty
+		s.lnoticef("Background saving terminated with success")
+	}()
+	return true
+}
+
+// writeRDBFile creates a temporary file, fills it using write, and then
+// renames it to the snapshot path.
+func (s *Server) writeRDBFile(tempName string, write func(wr io.Writer) error) error {
+	f, err := os.Create(tempName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// If the rename was successful then these calls are noops.
+		f.Close()
+		os.RemoveAll(tempName)
+	}()
+	wr := bufio.NewWriter(f)
+	if err := write(wr); err != nil {
+		return err
+	}
+	if err := wr.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempName, s.rdbPath)
+}
+
+// loadRDB loads the snapshot file into the databases. Returns false if there
+// is no snapshot file.
+func (s *Server) loadRDB() (bool, error) {
+	start := time.Now()
+	f, err := os.Open(s.rdbPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	var keys int
+	err = readRDB(f, func(dbnum int, key string, value interface{}, expires time.Time) error {
+		db := s.selectDB(dbnum)
+		db.set(key, value)
+		if !expires.IsZero() {
+			db.expire(key, expires)
+		}
+		keys++
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("Short read or OOM loading DB. Unrecoverable error, aborting now: %v", err)
+	}
+	s.lnoticef("DB loaded from disk: %.3f seconds, %d keys",
+		float64(time.Now().Sub(start))/float64(time.Second), keys)
+	return true, nil
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRDBString returns a value in a form that can be compared.
+func testRDBString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "string:" + v
+	case *list:
+		return "list:" + v.String()
+	case *set:
+		members := v.strArr()
+		sort.Strings(members)
+		return "set:" + strings.Join(members, " ")
+	case *zset:
+		var members []string
+		v.rangeByRank(0, -1, false, func(member string, score float64) bool {
+			members = append(members, fmt.Sprintf("%s=%v", member, score))
+			return true
+		})
+		return "zset:" + strings.Join(members, " ")
+	case *hash:
+		var fields []string
+		v.ascend(func(field, value string) bool {
+			fields = append(fields, field+"="+value)
+			return true
+		})
+		sort.Strings(fields)
+		return "hash:" + strings.Join(fields, " ")
+	}
+	return fmt.Sprintf("unknown:%T", value)
+}
+
+func testMakeRDBServer(t testing.TB) *Server {
+	s := &Server{options: &Options{Version: "0.0.0"}, dbs: make(map[int]*database)}
+	db0 := newDB(0)
+	db0.set("str", "hello")
+	l := newList()
+	l.rpush("a", "b", "c")
+	db0.set("list", l)
+	st := newSet()
+	st.add("x")
+	st.add("y")
+	db0.set("set", st)
+	z := newZSet()
+	z.add("one", 1)
+	z.add("half", 0.5)
+	z.add("inf", math.Inf(1))
+	db0.set("zset", z)
+	h := newHash()
+	h.set("f1", "v1")
+	h.set("f2", "v2")
+	db0.set("hash", h)
+	s.dbs[0] = db0
+	db3 := newDB(3)
+	db3.set("live", "1")
+	db3.expire("live", time.Now().Add(time.Hour))
+	db3.set("dead", "2")
+	db3.expire("dead", time.Now().Add(-time.Hour))
+	s.dbs[3] = db3
+	s.dbs[5] = newDB(5)
+	return s
+}
+
+type testRDBEntry struct {
+	value   string
+	expires time.Time
+}
+
+func testReadRDB(t *testing.T, data []byte) map[int]map[string]testRDBEntry {
+	dbs := make(map[int]map[string]testRDBEntry)
+	err := readRDB(bytes.NewReader(data), func(dbnum int, key string,
+		value interface{}, expires time.Time) error {
+		if dbs[dbnum] == nil {
+			dbs[dbnum] = make(map[string]testRDBEntry)
+		}
+		dbs[dbnum][key] = testRDBEntry{testRDBString(value), expires}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbs
+}
+
+func testRDBExpect(t *testing.T, dbs map[int]map[string]testRDBEntry) {
+	if len(dbs) != 2 {
+		t.Fatalf("expected %v, got %v", 2, len(dbs))
+	}
+	for key, expect := range map[string]string{
+		"str":  "string:hello",
+		"list": "list:a b c",
+		"set":  "set:x y",
+		"zset": "zset:half=0.5 one=1 inf=+Inf",
+		"hash": "hash:f1=v1 f2=v2",
+	} {
+		if got := dbs[0][key].value; got != expect {
+			t.Fatalf("expected '%v', got '%v'", expect, got)
+		}
+	}
+	if len(dbs[0]) != 5 {
+		t.Fatalf("expected %v, got %v", 5, len(dbs[0]))
+	}
+	if len(dbs[3]) != 1 {
+		t.Fatalf("expected %v, got %v", 1, len(dbs[3]))
+	}
+	live := dbs[3]["live"]
+	if live.value != "string:1" {
+		t.Fatalf("expected '%v', got '%v'", "string:1", live.value)
+	}
+	if d := time.Until(live.expires); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("expected the expiration in an hour, got %v", d)
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	s := testMakeRDBServer(t)
+	var buf bytes.Buffer
+	if err := s.writeRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	testRDBExpect(t, testReadRDB(t, buf.Bytes()))
+
+	// a flipped byte fails the checksum
+	data := append([]byte(nil), buf.Bytes()...)
+	data[len(data)/2] ^= 0xFF
+	err := readRDB(bytes.NewReader(data), func(int, string, interface{}, time.Time) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestRDBSnapshot(t *testing.T) {
+	s := testMakeRDBServer(t)
+	var buf bytes.Buffer
+	w := &rdbWriter{wr: &buf}
+	w.writeHeader(s.options.Version, time.Now())
+	s.mu.Lock()
+	snap := s.newSnapshot(rdbSelectDB, rdbEntry)
+	s.mu.Unlock()
+
+	// changes made after the snapshot was taken aren't written
+	s.mu.Lock()
+	db0 := s.dbs[0]
+	db0.preserve("str")
+	db0.set("str", "changed")
+	db0.preserve("list")
+	db0.del("list")
+	db0.set("new", "value")
+	s.mu.Unlock()
+
+	err := s.streamSnapshot(snap, func(p []byte) error {
+		w.write(p)
+		return w.err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.writeFooter()
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+	if len(db0.snapshots) != 0 {
+		t.Fatalf("expected %v, got %v", 0, len(db0.snapshots))
+	}
+	testRDBExpect(t, testReadRDB(t, buf.Bytes()))
+}
+
+func TestRDBCRC(t *testing.T) {
+	if crc := rdbCRC(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("expected %x, got %x", uint64(0xe9c6d914c4b8d9ca), crc)
+	}
+}
+
+func TestRDBEncodings(t *testing.T) {
+	// "a", 5, -2, 300, "hello"
+	lp := []byte{0, 0, 0, 0, 5, 0,
+		0x81, 'a', 2,
+		5, 1,
+		0xdf, 0xfe, 2,
+		0xc1, 0x2c, 2,
+		0x85, 'h', 'e', 'l', 'l', 'o', 6,
+		0xff}
+	vals, err := parseListpack(lp)
+	if err != nil || strings.Join(vals, " ") != "a 5 -2 300 hello" {
+		t.Fatalf("expected '%v', got '%v' (%v)", "a 5 -2 300 hello", vals, err)
+	}
+	// "ab", 7, -3
+	zl := []byte{0, 0, 0, 0, 0, 0, 0, 0, 3, 0,
+		0, 0x02, 'a', 'b',
+		4, 0xf8,
+		2, 0xc0, 0xfd, 0xff,
+		0xff}
+	vals, err = parseZiplist(zl)
+	if err != nil || strings.Join(vals, " ") != "ab 7 -3" {
+		t.Fatalf("expected '%v', got '%v' (%v)", "ab 7 -3", vals, err)
+	}
+	is := []byte{2, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 5, 0}
+	vals, err = parseIntset(is)
+	if err != nil || strings.Join(vals, " ") != "-1 5" {
+		t.Fatalf("expected '%v', got '%v' (%v)", "-1 5", vals, err)
+	}
+	// the literal "abc" and a back reference of 6 bytes
+	out, err := lzfDecompress([]byte{2, 'a', 'b', 'c', 4 << 5, 2}, 9)
+	if err != nil || string(out) != "abcabcabc" {
+		t.Fatalf("expected '%v', got '%v' (%v)", "abcabcabc", string(out), err)
+	}
+}
+
+func TestRDBInvalidLength(t *testing.T) {
+	for _, tt := range []struct {
+		data   string
+		expect string
+	}{
+		// a string that is longer than the file
+		{"REDIS0009\x00\x01k\x81\x00\x00\x01\x00\x00\x00\x00\x00", "unexpected EOF"},
+		// a list with too many elements
+		{"REDIS0009\x01\x01k\x81\x00\x00\x01\x00\x00\x00\x00\x00", "Invalid length 1099511627776"},
+	} {
+		err := readRDB(strings.NewReader(tt.data), func(int, string, interface{}, time.Time) error {
+			return nil
+		})
+		if err == nil || err.Error() != tt.expect {
+			t.Fatalf("expected '%v', got '%v'", tt.expect, err)
+		}
+	}
+}
+
+func TestRDBSave(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "SET", "s", "v")
+	c.expect(":3", "RPUSH", "l", "1", "2", "3")
+	c.expect(":2", "SADD", "st", "a", "b")
+	c.expect(":2", "ZADD", "z", "1.5", "a", "-inf", "b")
+	c.expect(":2", "HSET", "h", "f", "1", "g", "2")
+	c.expect("+OK", "SET", "e", "x")
+	c.expect(":1", "EXPIRE", "e", "100")
+	c.expect("+OK", "SELECT", "2")
+	c.expect("+OK", "SET", "two", "2")
+	c.expect("+OK", "SAVE")
+	lastsave, _ := strconv.ParseInt(c.do("LASTSAVE")[1:], 10, 64)
+	if d := time.Now().Unix() - lastsave; d < 0 || d > 2 {
+		t.Fatalf("expected the last save now, got %v", lastsave)
+	}
+
+	// a server without an aof loads the snapshot
+	other := testStartServer(t, "--appendonly", "no", "--dbfilename", ts.dbfilename)
+	c = other.dial()
+	c.expect("v", "GET", "s")
+	c.expect("*[1,2,3]", "LRANGE", "l", "0", "-1")
+	c.expect(":2", "SCARD", "st")
+	c.expect("*[b,-inf,a,1.5]", "ZRANGE", "z", "0", "-1", "WITHSCORES")
+	c.expect("2", "HGET", "h", "g")
+	if ttl := c.do("TTL", "e"); ttl != ":100" && ttl != ":99" {
+		t.Fatalf("expected '%v', got '%v'", ":100", ttl)
+	}
+	c.expect("+OK", "SELECT", "2")
+	c.expect("2", "GET", "two")
+	c.expect("-ERR dbfilename can't be a path, just a filename",
+		"CONFIG", "SET", "dbfilename", "a/b.rdb")
+}
+
+func TestRDBBackgroundSave(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	const n = 50000
+	for i := 0; i < n; i++ {
+		c.send("RPUSH", "k"+strconv.Itoa(i), "a")
+	}
+	for i := 0; i < n; i++ {
+		c.read()
+	}
+	c.expect("+OK", "SET", "gone", "x")
+	c.expect("+Background saving started", "BGSAVE")
+
+	// the writes after BGSAVE aren't saved
+	for i := n - 1; i >= 0; i-- {
+		c.send("RPUSH", "k"+strconv.Itoa(i), "b")
+	}
+	for i := 0; i < n; i++ {
+		c.read()
+	}
+	c.expect("+OK", "SET", "new", "x")
+	c.expect(":1", "DEL", "gone")
+	c.expect("+OK", "FLUSHALL")
+	for testInfoField(c.do("INFO", "persistence"), "rdb_bgsave_in_progress") != "0" {
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := ioutil.ReadFile(ts.dbfilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = readRDB(bytes.NewReader(data), func(dbnum int, key string,
+		value interface{}, expires time.Time) error {
+		count++
+		if l, ok := value.(*list); ok && l.len() != 1 {
+			return fmt.Errorf("%v: expected %v, got %v", key, 1, l.len())
+		}
+		if key == "new" {
+			return fmt.Errorf("expected '%v' to not be saved", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n+1 {
+		t.Fatalf("expected %v, got %v", n+1, count)
+	}
+}
@@ -0,0 +1,748 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replBacklogSize  = 1024 * 1024      // the size of the replication backlog
+	replPingPeriod   = time.Second * 10 // how often the master pings replicas
+	replTimeout      = time.Second * 60 // replica timeout for the master link
+	replDialTimeout  = time.Second * 10
+	replAckPeriod    = time.Second
+	replRetryBackoff = time.Second
+)
+
+// replica is a connected replica as seen by the master. All stream data is
+// appended to buf and a background goroutine writes it to the connection,
+// which keeps slow replicas from holding the server lock.
+type replica struct {
+	c         *client
+	conn      net.Conn
+	buf       bytes.Buffer // pending stream data, guarded by s.mu
+	cond      *sync.Cond   // signals new data in buf
+	closed    bool         // the replica is gone
+	online    bool         // the initial sync has been sent
+	ackOffset int64        // the last offset acknowledged by the replica
+	ackTime   time.Time    // the time of the last acknowledgement
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// feedReplicas appends data to the replication stream. The caller must
+// hold the write lock.
+func (s *Server) feedReplicas(data []byte) {
+	s.replOffset += int64(len(data))
+	if s.backlog != nil {
+		s.backlog = append(s.backlog, data...)
+		if len(s.backlog) > replBacklogSize*2 {
+			// keep the most recent bytes
+			trim := len(s.backlog) - replBacklogSize
+			s.backlog = append([]byte(nil), s.backlog[trim:]...)
+			s.backlogOff += int64(trim)
+		}
+	}
+	for _, r := range s.replicas {
+		r.buf.Write(data)
+		r.cond.Signal()
+	}
+}
+
+// writeSnapshot writes the commands that are needed to recreate every
+// database. The snapshot ends by selecting the current aof database, which
+// is the database that the replication stream continues on. The caller
+// must hold the lock.
+func (s *Server) writeSnapshot(wr io.Writer) error {
+	dbs := make([]*database, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Sort(dbsByNumber(dbs))
+	for _, db := range dbs {
+		if db.len() == 0 {
+			continue
+		}
+		writeMultiBulk(wr, "SELECT", db.num)
+		keys := make([]string, 0, len(db.items))
+		for key := range db.items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, expires, ok := db.getExpires(key)
+			if !ok {
+				continue
+			}
+			if err := writeKeyCommands(wr, key, value, expires); err != nil {
+				return err
+			}
+		}
+	}
+	writeMultiBulk(wr, "SELECT", s.streamDB())
+	return nil
+}
+
+// streamDB returns the database that the replication stream continues on.
+func (s *Server) streamDB() int {
+	if s.aofdbnum < 0 {
+		return 0
+	}
+	return s.aofdbnum
+}
+
+// writeKeyCommands writes the commands that recreate a key.
+func writeKeyCommands(wr io.Writer, key string, value interface{}, expires time.Time) error {
+	if err := writeItemCommands(wr, key, value); err != nil {
+		return err
+	}
+	if !expires.IsZero() {
+		writeMultiBulk(wr, "PEXPIREAT", key,
+			expires.UnixNano()/int64(time.Millisecond))
+	}
+	return nil
+}
+
+// replSelectDB and replEntry encode the databases of a snapshot as commands,
+// like writeSnapshot.
+func replSelectDB(buf *bytes.Buffer, sd *snapshotDB) {
+	writeMultiBulk(buf, "SELECT", sd.db.num)
+}
+
+func replEntry(buf *bytes.Buffer, key string, value interface{}, expires time.Time) error {
+	return writeKeyCommands(buf, key, value, expires)
+}
+
+// fullSync sends a snapshot to the replica, followed by the stream that was
+// buffered while the snapshot was encoded. The snapshot is encoded in chunks
+// that are sent as they're encoded, so the clients aren't blocked while the
+// whole dataset is encoded. The size of the snapshot isn't known up front,
+// so it's sent like the diskless sync of Redis, as "$EOF:<mark>", the
+// snapshot, and then the mark.
+func (s *Server) fullSync(r *replica, snap *snapshot, preamble string, dbnum int) {
+	mark := newReplID()
+	_, err := io.WriteString(r.conn, preamble+"$EOF:"+mark+"\r\n")
+	if err == nil {
+		err = s.streamSnapshot(snap, func(p []byte) error {
+			_, err := r.conn.Write(p)
+			return err
+		})
+	} else {
+		s.releaseSnapshot(snap)
+	}
+	if err == nil {
+		var buf bytes.Buffer
+		writeMultiBulk(&buf, "SELECT", dbnum)
+		buf.WriteString(mark)
+		_, err = r.conn.Write(buf.Bytes())
+	}
+	s.mu.Lock()
+	if err != nil || r.closed {
+		if err != nil {
+			s.lwarningf("Error sending the snapshot to replica %s: %v",
+				r.c.addr, err)
+		}
+		// closing the connection will remove the replica in handleConn
+		r.closed = true
+		r.conn.Close()
+		s.mu.Unlock()
+		return
+	}
+	r.online = true
+	s.lnoticef("Synchronization with replica %s succeeded", r.c.addr)
+	s.mu.Unlock()
+	s.replicaWriter(r)
+}
+
+// replicaWriter sends the pending stream data to the replica until the
+// replica is closed.
+func (s *Server) replicaWriter(r *replica) {
+	s.mu.Lock()
+	for {
+		for r.buf.Len() == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if r.closed {
+			s.mu.Unlock()
+			return
+		}
+		data := append([]byte(nil), r.buf.Bytes()...)
+		r.buf.Reset()
+		s.mu.Unlock()
+		_, err := r.conn.Write(data)
+		s.mu.Lock()
+		if err != nil {
+			// closing the connection will remove the replica in handleConn
+			r.closed = true
+			r.conn.Close()
+			s.mu.Unlock()
+			return
+		}
+		if !r.online {
+			r.online = true
+			s.lnoticef("Synchronization with replica %s succeeded", r.c.addr)
+		}
+	}
+}
+
+func (s *Server) removeReplica(c *client) {
+	if r, ok := s.replicas[c]; ok {
+		r.closed = true
+		r.cond.Signal()
+		delete(s.replicas, c)
+		s.lnoticef("Connection with replica %s lost.", c.addr)
+	}
+}
+
+// stopReplication disconnects from the master. The caller must hold the
+// write lock.
+func (s *Server) stopReplication() {
+	s.masterEpoch++
+	if s.masterConn != nil {
+		s.masterConn.Close()
+		s.masterConn = nil
+	}
+	s.masterLinkUp = false
+	s.masterSyncing = false
+}
+
+// replicationCron is called once a second from the expire loop. The caller
+// must hold the write lock.
+func (s *Server) replicationCron() {
+	if len(s.replicas) > 0 && time.Since(s.replPinged) >= replPingPeriod {
+		s.feedReplicas([]byte("*1\r\n$4\r\nPING\r\n"))
+		s.replPinged = time.Now()
+	}
+}
+
+// replicationLoop keeps the server connected to its master until the master
+// changes or replication is turned off.
+func (s *Server) replicationLoop(epoch int) {
+	for {
+		s.mu.RLock()
+		done := s.masterEpoch != epoch
+		addr := net.JoinHostPort(s.masterHost, s.masterPort)
+		s.mu.RUnlock()
+		if done {
+			return
+		}
+		if err := s.syncWithMaster(epoch, addr); err != nil {
+			s.mu.RLock()
+			current := s.masterEpoch == epoch
+			s.mu.RUnlock()
+			if current {
+				s.lwarningf("Error condition on socket for SYNC: %v", err)
+			}
+		}
+		time.Sleep(replRetryBackoff)
+	}
+}
+
+// syncWithMaster performs the replication handshake, loads the initial
+// snapshot or continues from the backlog, and then applies the live command
+// stream until the connection fails.
+func (s *Server) syncWithMaster(epoch int, addr string) error {
+	s.lnoticef("Connecting to MASTER %s", addr)
+	conn, err := net.DialTimeout("tcp", addr, replDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s.mu.Lock()
+	if s.masterEpoch != epoch {
+		s.mu.Unlock()
+		return nil
+	}
+	s.masterConn = conn
+	s.masterSyncing = true
+	replid, offset := s.masterReplID, s.masterOffset
+	port := s.cfg.port
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.masterEpoch == epoch {
+			s.masterConn = nil
+			s.masterLinkUp = false
+			s.masterSyncing = false
+		}
+		s.mu.Unlock()
+	}()
+
+	rd := bufio.NewReader(conn)
+	var src io.Reader = rd // the command stream
+	send := func(args ...interface{}) error {
+		var buf bytes.Buffer
+		writeMultiBulk(&buf, args...)
+		_, err := conn.Write(buf.Bytes())
+		return err
+	}
+	readLine := func() (string, error) {
+		for {
+			conn.SetReadDeadline(time.Now().Add(replTimeout))
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return "", err
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "" {
+				continue // newlines are sent as keepalives
+			}
+			if line[0] == '-' {
+				return "", errors.New(line[1:])
+			}
+			return line, nil
+		}
+	}
+	if err := send("PING"); err != nil {
+		return err
+	}
+	if _, err := readLine(); err != nil {
+		return err
+	}
+	if err := send("REPLCONF", "listening-port", port); err != nil {
+		return err
+	}
+	if _, err := readLine(); err != nil {
+		return err
+	}
+	if offset < 0 {
+		err = send("PSYNC", "?", -1)
+	} else {
+		err = send("PSYNC", replid, offset+1)
+	}
+	if err != nil {
+		return err
+	}
+	line, err := readLine()
+	if err != nil {
+		return err
+	}
+	switch {
+	default:
+		return errors.New("unexpected reply to PSYNC: " + line)
+	case strings.HasPrefix(line, "+CONTINUE"):
+		s.lnoticef("Successful partial resynchronization with master.")
+	case strings.HasPrefix(line, "+FULLRESYNC"):
+		parts := strings.Fields(line)
+		if len(parts) != 3 {
+			return errors.New("unexpected reply to PSYNC: " + line)
+		}
+		replid = parts[1]
+		offset, err = strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return errors.New("unexpected reply to PSYNC: " + line)
+		}
+		s.lnoticef("Full resync from master: %s:%d", replid, offset)
+		if line, err = readLine(); err != nil {
+			return err
+		}
+		if line[0] != '$' {
+			return errors.New("bad protocol from MASTER, the first byte is not '$'")
+		}
+		conn.SetReadDeadline(time.Time{})
+		var payload []byte
+		if strings.HasPrefix(line, "$EOF:") {
+			// the snapshot ends with the mark
+			s.lnoticef("MASTER <-> REPLICA sync: receiving streamed snapshot from master")
+			var rest []byte
+			payload, rest, err = readUntilMark(rd, []byte(line[5:]))
+			if err != nil {
+				return err
+			}
+			if len(rest) > 0 {
+				// the stream that follows the snapshot
+				src = io.MultiReader(bytes.NewReader(rest), rd)
+			}
+		} else {
+			n, err := strconv.ParseInt(line[1:], 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("bad protocol from MASTER, invalid bulk length")
+			}
+			s.lnoticef("MASTER <-> REPLICA sync: receiving %d bytes from master", n)
+			payload = make([]byte, n)
+			if _, err := io.ReadFull(rd, payload); err != nil {
+				return err
+			}
+		}
+		s.mu.Lock()
+		if s.masterEpoch != epoch {
+			s.mu.Unlock()
+			return nil
+		}
+		dbnum, err := s.loadSnapshot(payload)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.masterReplID = replid
+		s.masterOffset = offset
+		s.masterDBNum = dbnum
+		s.mu.Unlock()
+		s.lnoticef("MASTER <-> REPLICA sync: Finished with success")
+	}
+
+	s.mu.Lock()
+	if s.masterEpoch != epoch {
+		s.mu.Unlock()
+		return nil
+	}
+	s.masterLinkUp = true
+	s.masterSyncing = false
+	s.masterLastIO = time.Now()
+	c := &client{wr: ioutil.Discard, s: s, addr: addr, master: true,
+		conn: conn, created: time.Now()}
+	c.lastTime.Store(c.created.UnixNano())
+	c.db = s.selectDB(s.masterDBNum)
+	s.addClient(c)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	// Acknowledge the processed offset once a second.
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		t := time.NewTicker(replAckPeriod)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				s.mu.RLock()
+				offset := s.masterOffset
+				s.mu.RUnlock()
+				if send("REPLCONF", "ACK", offset) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	crd := newCommandReader(src)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		raw, args, flush, err := crd.readCommand()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.masterEpoch != epoch {
+			s.mu.Unlock()
+			return nil
+		}
+		if len(args) > 0 {
+			c.args, c.raw = args, raw
+			c.lastTime.Store(time.Now().UnixNano())
+			if cmd, ok := s.cmds[autocase(args[0])]; !ok {
+				s.lwarningf("Unknown command '%s' from master", args[0])
+			} else if c.multi && !cmd.multi {
+				c.queueCommand(cmd)
+			} else if c.call(cmd) && cmd.aof {
+				c.db.aofbuf.Write(raw)
+			}
+		}
+		s.masterOffset += int64(len(raw))
+		s.masterDBNum = c.db.num
+		s.masterLastIO = time.Now()
+		if flush {
+			if err := s.flushAOF(); err != nil {
+				s.fatalError(err)
+				s.mu.Unlock()
+				return err
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// readUntilMark reads a snapshot that ends with the mark. Returns the
+// snapshot and the bytes that were read after the mark.
+func readUntilMark(rd io.Reader, mark []byte) (payload, rest []byte, err error) {
+	if len(mark) != 40 {
+		return nil, nil, errors.New("bad protocol from MASTER, invalid EOF mark")
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := rd.Read(buf)
+		start := len(payload) - len(mark)
+		if start < 0 {
+			start = 0
+		}
+		payload = append(payload, buf[:n]...)
+		if i := bytes.Index(payload[start:], mark); i != -1 {
+			i += start
+			rest = append([]byte(nil), payload[i+len(mark):]...)
+			return payload[:i], rest, nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+	}
+}
+
+// loadSnapshot replaces the dataset with a snapshot from the master and
+// writes it to the aof. Returns the database that the snapshot ends on. The
+// caller must hold the write lock.
+func (s *Server) loadSnapshot(payload []byte) (int, error) {
+	if err := s.flushAOF(); err != nil {
+		return 0, err
+	}
+	for _, db := range s.dbs {
+		db.flush()
+	}
+	c := &client{wr: ioutil.Discard, s: s, master: true}
+	c.db = s.selectDB(0)
+	rd := newCommandReader(bytes.NewReader(payload))
+	for {
+		_, args, _, err := rd.readCommand()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		cmd, ok := s.cmds[autocase(args[0])]
+		if !ok {
+			return 0, errors.New("unknown command '" + args[0] + "' in snapshot")
+		}
+		c.args = args
+		cmd.funct(c)
+	}
+	var buf bytes.Buffer
+	writeMultiBulk(&buf, "FLUSHALL")
+	buf.Write(payload)
+	if err := s.writeAOF(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	s.feedReplicas(buf.Bytes())
+	s.aofdbnum = c.db.num
+	return c.db.num, nil
+}
+
+func syncCommand(c *client) {
+	if c.master {
+		return
+	}
+	psync := strings.ToLower(c.args[0]) == "psync"
+	if (psync && len(c.args) != 3) || (!psync && len(c.args) != 1) {
+		c.replyAritryError()
+		return
+	}
+	s := c.s
+	if _, ok := s.replicas[c]; ok {
+		return
+	}
+	if s.follower && !s.masterLinkUp {
+		c.replyError("Can't SYNC while not connected with my master")
+		return
+	}
+	s.lnoticef("Replica %s asks for synchronization", c.addr)
+	// Flush the pending commands so that the snapshot and the stream line
+	// up at the current replication offset.
+	if err := s.flushAOF(); err != nil {
+		s.fatalError(err)
+		c.replyError(err.Error())
+		return
+	}
+	r := &replica{c: c, conn: c.conn, cond: sync.NewCond(&s.mu)}
+	partial := false
+	if psync && c.args[1] == s.replID && s.backlog != nil {
+		offset, err := strconv.ParseInt(c.args[2], 10, 64)
+		if err == nil && offset-1 >= s.backlogOff &&
+			offset-1 <= s.backlogOff+int64(len(s.backlog)) {
+			r.buf.WriteString("+CONTINUE\r\n")
+			r.buf.Write(s.backlog[offset-1-s.backlogOff:])
+			partial = true
+			s.lnoticef("Partial resynchronization request from %s accepted. "+
+				"Sending %d bytes of backlog starting from offset %d.",
+				c.addr, s.replOffset-(offset-1), offset)
+		}
+	}
+	var snap *snapshot
+	var preamble string
+	if !partial {
+		// The writes that are made while the snapshot is encoded are
+		// buffered for the replica, which gets them after the snapshot.
+		snap = s.newSnapshot(replSelectDB, replEntry)
+		if psync {
+			preamble = "+FULLRESYNC " + s.replID + " " +
+				strconv.FormatInt(s.replOffset, 10) + "\r\n"
+		}
+	}
+	if s.backlog == nil {
+		s.backlog = []byte{}
+		s.backlogOff = s.replOffset
+	}
+	// Flush any pending replies and hand the connection over to the replica
+	// writer. Nothing else may be written to this client from here on.
+	if wr, ok := c.wr.(*bufio.Writer); ok {
+		wr.Flush()
+	}
+	c.wr = ioutil.Discard
+	s.replicas[c] = r
+	if partial {
+		go s.replicaWriter(r)
+	} else {
+		go s.fullSync(r, snap, preamble, s.streamDB())
+	}
+}
+
+func replconfCommand(c *client) {
+	if len(c.args)%2 == 0 {
+		c.replySyntaxError()
+		return
+	}
+	for i := 1; i < len(c.args); i += 2 {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replyError("Unrecognized REPLCONF option: " + c.args[i])
+			return
+		case "listening-port":
+			n, err := strconv.ParseUint(c.args[i+1], 10, 16)
+			if err != nil {
+				c.replyInvalidIntError()
+				return
+			}
+			c.replPort = int(n)
+		case "ip-address", "capa":
+		case "ack":
+			// acks are never replied to
+			if r, ok := c.s.replicas[c]; ok {
+				if n, err := strconv.ParseInt(c.args[i+1], 10, 64); err == nil {
+					r.ackOffset = n
+					r.ackTime = time.Now()
+				}
+			}
+			return
+		}
+	}
+	c.replyString("OK")
+}
+
+func replicaofCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	s := c.s
+	if strings.ToLower(c.args[1]) == "no" && strings.ToLower(c.args[2]) == "one" {
+		if s.follower {
+			s.stopReplication()
+			s.follower = false
+			// A new history begins, replicas of this server must resync.
+			s.replID = newReplID()
+			s.lnoticef("MASTER MODE enabled (user request from '%s')", c.addr)
+		}
+		c.replyString("OK")
+		return
+	}
+	if _, err := strconv.ParseUint(c.args[2], 10, 16); err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	host, port := c.args[1], c.args[2]
+	if s.follower && s.masterHost == host && s.masterPort == port {
+		c.replyString("OK Already connected to specified master")
+		return
+	}
+	s.stopReplication()
+	s.follower = true
+	s.unblockAll("UNBLOCKED force unblock from blocking operation, instance state changed (master -> replica?)")
+	s.masterHost, s.masterPort = host, port
+	s.masterReplID = "?"
+	s.masterOffset = -1
+	go s.replicationLoop(s.masterEpoch)
+	s.lnoticef("REPLICAOF %s:%s enabled (user request from '%s')", host, port, c.addr)
+	c.replyString("OK")
+}
+
+func writeInfoReplication(c *client, w io.Writer) {
+	s := c.s
+	if s.follower {
+		fmt.Fprintf(w, "role:slave\n")
+		fmt.Fprintf(w, "master_host:%s\n", s.masterHost)
+		fmt.Fprintf(w, "master_port:%s\n", s.masterPort)
+		if s.masterLinkUp {
+			fmt.Fprintf(w, "master_link_status:up\n")
+			fmt.Fprintf(w, "master_last_io_seconds_ago:%d\n",
+				time.Since(s.masterLastIO)/time.Second)
+		} else {
+			fmt.Fprintf(w, "master_link_status:down\n")
+			fmt.Fprintf(w, "master_last_io_seconds_ago:-1\n")
+		}
+		if s.masterSyncing {
+			fmt.Fprintf(w, "master_sync_in_progress:1\n")
+		} else {
+			fmt.Fprintf(w, "master_sync_in_progress:0\n")
+		}
+		fmt.Fprintf(w, "slave_repl_offset:%d\n", s.masterOffset)
+		fmt.Fprintf(w, "slave_read_only:1\n")
+	} else {
+		fmt.Fprintf(w, "role:master\n")
+	}
+	replicas := make([]*replica, 0, len(s.replicas))
+	for _, r := range s.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].c.addr < replicas[j].c.addr
+	})
+	fmt.Fprintf(w, "connected_slaves:%d\n", len(replicas))
+	for i, r := range replicas {
+		ip := r.c.addr
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		state := "wait_bgsave"
+		if r.online {
+			state = "online"
+		}
+		lag := int64(-1)
+		if !r.ackTime.IsZero() {
+			lag = int64(time.Since(r.ackTime) / time.Second)
+		}
+		fmt.Fprintf(w, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\n",
+			i, ip, r.c.replPort, state, r.ackOffset, lag)
+	}
+	fmt.Fprintf(w, "master_replid:%s\n", s.replID)
+	fmt.Fprintf(w, "master_repl_offset:%d\n", s.replOffset)
+	if s.backlog != nil {
+		fmt.Fprintf(w, "repl_backlog_active:1\n")
+		fmt.Fprintf(w, "repl_backlog_size:%d\n", replBacklogSize)
+		fmt.Fprintf(w, "repl_backlog_first_byte_offset:%d\n", s.backlogOff+1)
+		fmt.Fprintf(w, "repl_backlog_histlen:%d\n", len(s.backlog))
+	} else {
+		fmt.Fprintf(w, "repl_backlog_active:0\n")
+		fmt.Fprintf(w, "repl_backlog_size:%d\n", replBacklogSize)
+		fmt.Fprintf(w, "repl_backlog_first_byte_offset:0\n")
+		fmt.Fprintf(w, "repl_backlog_histlen:0\n")
+	}
+}
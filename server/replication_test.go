@@ -0,0 +1,101 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	master := testStartServer(t)
+	replica := testStartServer(t)
+	m := master.dial()
+	r := replica.dial()
+	m.expect("+OK", "SET", "a", "1")
+	m.expect(":2", "RPUSH", "l", "x", "y")
+	m.expect("+OK", "SELECT", "3")
+	m.expect("+OK", "SET", "b", "2")
+	r.expect("+OK", "SET", "gone", "1")
+	r.expect("+OK", "REPLICAOF", "127.0.0.1", strconv.Itoa(master.port))
+	r.wait("1", "GET", "a")
+	r.expect("(nil)", "GET", "gone")
+	r.expect("*[x,y]", "LRANGE", "l", "0", "-1")
+	r.expect("-READONLY You can't write against a read only replica.", "SET", "x", "1")
+
+	// the writes after the sync are streamed
+	m.expect("+OK", "SET", "c", "3")
+	r.expect("+OK", "SELECT", "3")
+	r.wait("3", "GET", "c")
+	r.expect("2", "GET", "b")
+	m.expect("+OK", "MULTI")
+	m.expect("+QUEUED", "INCR", "n")
+	m.expect("+QUEUED", "INCR", "n")
+	m.expect("*[:1,:2]", "EXEC")
+	r.wait("2", "GET", "n")
+
+	info := m.do("INFO", "replication")
+	if got := testInfoField(info, "connected_slaves"); got != "1" {
+		t.Fatalf("expected '%v', got '%v'", "1", got)
+	}
+	rinfo := r.do("INFO", "replication")
+	if got := testInfoField(rinfo, "role"); got != "slave" {
+		t.Fatalf("expected '%v', got '%v'", "slave", got)
+	}
+
+	// a replica that is behind continues from its offset
+	replid := testInfoField(info, "master_replid")
+	offset, _ := strconv.Atoi(testInfoField(info, "master_repl_offset"))
+	p := master.dial()
+	p.expect("+CONTINUE", "PSYNC", replid, strconv.Itoa(offset-10))
+	p.conn.Close()
+
+	r.expect("+OK", "REPLICAOF", "NO", "ONE")
+	r.expect("+OK", "SET", "x", "1")
+	r.expect("3", "GET", "c")
+}
+
+func TestReplicationSyncWhileWriting(t *testing.T) {
+	master := testStartServer(t)
+	replica := testStartServer(t)
+	m := master.dial()
+	r := replica.dial()
+	const n = 50000
+	for i := 0; i < n; i++ {
+		m.send("RPUSH", "k"+strconv.Itoa(i), "a")
+	}
+	for i := 0; i < n; i++ {
+		m.read()
+	}
+
+	// the writes while the snapshot is sent are applied once
+	w := master.dial()
+	done := make(chan string)
+	go func() {
+		for j := 0; j < 3; j++ {
+			for i := n - 1; i >= 0; i-- {
+				w.send("RPUSH", "k"+strconv.Itoa(i), "b")
+			}
+			for i := 0; i < n; i++ {
+				if got := w.read(); !strings.HasPrefix(got, ":") {
+					done <- got
+					return
+				}
+			}
+		}
+		done <- ""
+	}()
+	r.expect("+OK", "REPLICAOF", "127.0.0.1", strconv.Itoa(master.port))
+	if got := <-done; got != "" {
+		t.Fatal(got)
+	}
+	m.expect("+OK", "SET", "done", "1")
+	r.wait("1", "GET", "done")
+	for i := 0; i < n; i++ {
+		r.send("LLEN", "k"+strconv.Itoa(i))
+	}
+	for i := 0; i < n; i++ {
+		if got := r.read(); got != ":4" {
+			t.Fatalf("k%d: expected '%v', got '%v'", i, ":4", got)
+		}
+	}
+}
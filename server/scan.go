@@ -0,0 +1,179 @@
+package server
+
+import (
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// scanTable indexes strings in hash buckets for the SCAN family. The cursor
+// is a bucket index that is incremented with its bits reversed, like Redis,
+// so every string that is in the table for a full iteration is returned at
+// least once, even when the table grows or shrinks between calls.
+type scanTable struct {
+	buckets [][]string
+	count   int
+}
+
+func scanHash(s string) uint64 {
+	// FNV-1a
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// add adds a string, which must not already be in the table.
+func (t *scanTable) add(s string) {
+	if t.count >= len(t.buckets) {
+		t.resize(len(t.buckets) * 2)
+	}
+	i := scanHash(s) & uint64(len(t.buckets)-1)
+	t.buckets[i] = append(t.buckets[i], s)
+	t.count++
+}
+
+func (t *scanTable) remove(s string) {
+	if t.count == 0 {
+		return
+	}
+	i := scanHash(s) & uint64(len(t.buckets)-1)
+	bucket := t.buckets[i]
+	for j := range bucket {
+		if bucket[j] == s {
+			bucket[j] = bucket[len(bucket)-1]
+			bucket[len(bucket)-1] = ""
+			t.buckets[i] = bucket[:len(bucket)-1]
+			t.count--
+			break
+		}
+	}
+	if len(t.buckets) > 4 && t.count < len(t.buckets)/8 {
+		t.resize(len(t.buckets) / 2)
+	}
+}
+
+func (t *scanTable) clear() {
+	t.buckets = nil
+	t.count = 0
+}
+
+// resize rehashes the table into n buckets. The number of buckets is always
+// a power of two.
+func (t *scanTable) resize(n int) {
+	if n < 4 {
+		n = 4
+	}
+	buckets := make([][]string, n)
+	mask := uint64(n - 1)
+	for _, bucket := range t.buckets {
+		for _, s := range bucket {
+			i := scanHash(s) & mask
+			buckets[i] = append(buckets[i], s)
+		}
+	}
+	t.buckets = buckets
+}
+
+// scan visits the buckets starting at the cursor until at least count
+// strings are visited. Returns the cursor for the next call, which is zero
+// when the iteration is complete.
+func (t *scanTable) scan(cursor uint64, count int, iter func(s string)) uint64 {
+	if t.count == 0 {
+		return 0
+	}
+	mask := uint64(len(t.buckets) - 1)
+	var n int
+	for {
+		for _, s := range t.buckets[cursor&mask] {
+			iter(s)
+			n++
+		}
+		cursor |= ^mask
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		if cursor == 0 || n >= count {
+			return cursor
+		}
+	}
+}
+
+type scanOptions struct {
+	cursor  uint64
+	pattern *pattern
+	count   int
+	typ     string
+}
+
+// parseScanArgs parses the cursor and the options of a SCAN family command.
+// The cursor is at c.args[i]. TYPE is only allowed when typ is set.
+func (c *client) parseScanArgs(i int, typ bool) (opts scanOptions, ok bool) {
+	cursor, err := strconv.ParseUint(c.args[i], 10, 64)
+	if err != nil {
+		c.replyError("invalid cursor")
+		return opts, false
+	}
+	opts.cursor = cursor
+	opts.pattern = parsePattern("*")
+	opts.count = 10
+	for i++; i < len(c.args); i += 2 {
+		if i+1 == len(c.args) {
+			c.replySyntaxError()
+			return opts, false
+		}
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replySyntaxError()
+			return opts, false
+		case "match":
+			opts.pattern = parsePattern(c.args[i+1])
+		case "count":
+			n, err := strconv.Atoi(c.args[i+1])
+			if err != nil {
+				c.replyInvalidIntError()
+				return opts, false
+			}
+			if n < 1 {
+				c.replySyntaxError()
+				return opts, false
+			}
+			opts.count = n
+		case "type":
+			if !typ {
+				c.replySyntaxError()
+				return opts, false
+			}
+			opts.typ = strings.ToLower(c.args[i+1])
+		}
+	}
+	return opts, true
+}
+
+// replyScan replies with the next cursor and the strings that were found.
+func (c *client) replyScan(cursor uint64, strs []string) {
+	c.replyMultiBulkLen(2)
+	c.replyBulk(strconv.FormatUint(cursor, 10))
+	c.replyMultiBulkLen(len(strs))
+	for _, s := range strs {
+		c.replyBulk(s)
+	}
+}
+
+// sample visits about n strings, starting at a random bucket, for the random
+// sampling of keys by eviction.
+func (t *scanTable) sample(n int, iter func(s string)) {
+	if t.count == 0 {
+		return
+	}
+	mask := len(t.buckets) - 1
+	start := rand.Intn(len(t.buckets))
+	var visited int
+	for i := 0; i < len(t.buckets) && visited < n; i++ {
+		for _, s := range t.buckets[(start+i)&mask] {
+			iter(s)
+			visited++
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testMakeScanTable(t testing.TB, prefix string, n int) *scanTable {
+	var st scanTable
+	for i := 0; i < n; i++ {
+		st.add(fmt.Sprintf("%s%d", prefix, i))
+	}
+	if st.count != n {
+		t.Fatalf("expected %v, got %v", n, st.count)
+	}
+	return &st
+}
+
+// testScanTable runs a full scan and calls change after each call. Returns
+// the strings that were visited.
+func testScanTable(st *scanTable, count int, change func(step int)) map[string]bool {
+	seen := make(map[string]bool)
+	var cursor uint64
+	for step := 0; ; step++ {
+		cursor = st.scan(cursor, count, func(s string) { seen[s] = true })
+		if cursor == 0 {
+			return seen
+		}
+		change(step)
+	}
+}
+
+func testScanSeen(t *testing.T, seen map[string]bool, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		s := fmt.Sprintf("%s%d", prefix, i)
+		if !seen[s] {
+			t.Fatalf("expected '%v' to be visited", s)
+		}
+	}
+}
+
+func TestScanTable(t *testing.T) {
+	st := testMakeScanTable(t, "key:", 1000)
+	seen := testScanTable(st, 10, func(int) {})
+	if len(seen) != 1000 {
+		t.Fatalf("expected %v, got %v", 1000, len(seen))
+	}
+	testScanSeen(t, seen, "key:", 1000)
+	for i := 0; i < 1000; i++ {
+		st.remove(fmt.Sprintf("key:%d", i))
+	}
+	if st.count != 0 {
+		t.Fatalf("expected %v, got %v", 0, st.count)
+	}
+	if cursor := st.scan(0, 10, func(s string) {
+		t.Fatalf("expected no strings, got '%v'", s)
+	}); cursor != 0 {
+		t.Fatalf("expected %v, got %v", 0, cursor)
+	}
+}
+
+func TestScanTableGrow(t *testing.T) {
+	st := testMakeScanTable(t, "key:", 1000)
+	buckets := len(st.buckets)
+	var n int
+	seen := testScanTable(st, 10, func(step int) {
+		if step%5 == 0 && n < 8000 {
+			for i := 0; i < 500; i++ {
+				st.add(fmt.Sprintf("new:%d", n))
+				n++
+			}
+		}
+	})
+	if len(st.buckets) <= buckets {
+		t.Fatalf("expected the table to grow from %v buckets", buckets)
+	}
+	testScanSeen(t, seen, "key:", 1000)
+}
+
+func TestScanTableShrink(t *testing.T) {
+	st := testMakeScanTable(t, "key:", 1000)
+	for i := 0; i < 20000; i++ {
+		st.add(fmt.Sprintf("tmp:%d", i))
+	}
+	buckets := len(st.buckets)
+	var n int
+	seen := testScanTable(st, 10, func(step int) {
+		for i := 0; i < 500 && n < 20000; i++ {
+			st.remove(fmt.Sprintf("tmp:%d", n))
+			n++
+		}
+	})
+	if len(st.buckets) >= buckets {
+		t.Fatalf("expected the table to shrink from %v buckets", buckets)
+	}
+	testScanSeen(t, seen, "key:", 1000)
+}
+
+// testScanAll runs a full scan with the command, which is the args before
+// the cursor, and the options, and calls change after each call. Returns the
+// number of times each element was visited.
+func testScanAll(t *testing.T, c *testConn, command, options []string,
+	change func(step int)) map[string]int {
+	seen := make(map[string]int)
+	cursor := "0"
+	for step := 0; ; step++ {
+		args := append(append(append([]string(nil), command...), cursor), options...)
+		reply := c.do(args...)
+		// *[cursor,*[elem,...]]
+		if !strings.HasPrefix(reply, "*[") || !strings.HasSuffix(reply, "]]") {
+			t.Fatalf("expected a scan reply, got '%v'", reply)
+		}
+		reply = reply[2 : len(reply)-2]
+		i := strings.Index(reply, ",*[")
+		cursor = reply[:i]
+		if elems := reply[i+3:]; elems != "" {
+			for _, elem := range strings.Split(elems, ",") {
+				seen[elem]++
+			}
+		}
+		if cursor == "0" {
+			return seen
+		}
+		change(step)
+	}
+}
+
+func TestScanCommands(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	for i := 0; i < 200; i++ {
+		c.expect("+OK", "SET", fmt.Sprintf("key:%d", i), "v")
+	}
+	c.expect(":1", "SADD", "myset", "a")
+	c.expect(":1", "LPUSH", "mylist", "a")
+
+	// the keys that exist for the whole scan are visited
+	seen := testScanAll(t, c, []string{"SCAN"}, []string{"COUNT", "7"}, func(step int) {
+		c.expect("+OK", "SET", fmt.Sprintf("new:%d", step), "v")
+	})
+	for i := 0; i < 200; i++ {
+		if seen[fmt.Sprintf("key:%d", i)] == 0 {
+			t.Fatalf("expected 'key:%d' to be visited", i)
+		}
+	}
+	c.expect("*[0,*[]]", "SCAN", "0", "MATCH", "nomatch*", "COUNT", "1000")
+	c.expect("*[0,*[myset]]", "SCAN", "0", "TYPE", "set", "COUNT", "1000")
+	c.expect("*[0,*[key:7]]", "SCAN", "0", "MATCH", "key:7", "COUNT", "1000")
+	c.expect("-ERR invalid cursor", "SCAN", "x")
+	c.expect("-ERR syntax error", "SCAN", "0", "COUNT", "0")
+	c.expect("-ERR syntax error", "SCAN", "0", "MATCH")
+	c.expect("-ERR syntax error", "SSCAN", "myset", "0", "TYPE", "set")
+
+	for i := 0; i < 100; i++ {
+		c.expect(":1", "SADD", "s", fmt.Sprintf("m%d", i))
+	}
+	seen = testScanAll(t, c, []string{"SSCAN", "s"}, []string{"MATCH", "m1*"}, func(int) {})
+	if len(seen) != 11 {
+		t.Fatalf("expected %v, got %v", 11, len(seen))
+	}
+	c.expect("*[0,*[]]", "SSCAN", "nokey", "0")
+	c.expect("-WRONGTYPE Operation against a key holding the wrong kind of value",
+		"SSCAN", "mylist", "0")
+	c.expect(":1", "SREM", "myset", "a")
+	c.expect("*[0,*[s]]", "SCAN", "0", "TYPE", "set", "COUNT", "1000")
+	c.expect("+OK", "FLUSHDB")
+	c.expect("*[0,*[]]", "SCAN", "0")
+}
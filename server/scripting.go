@@ -0,0 +1,555 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scripts run under the write lock on the connection of the calling client.
+// The redis.call and redis.pcall functions run commands from the same
+// command table as the clients. The commands that changed the dataset are
+// written to the aof wrapped in a MULTI/EXEC block, rather than the script
+// itself, so the aof and the replicas get the effects of the script.
+
+func sha1hex(s string) string {
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// luaState returns the interpreter, which is created on first use.
+func (s *Server) luaState() *lua.LState {
+	if s.lua != nil {
+		return s.lua
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// scripts have no access to the file system
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			return s.luaCall(L, true)
+		},
+		"pcall": func(L *lua.LState) int {
+			return s.luaCall(L, false)
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex(L.CheckString(1))))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(luaReplyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"error_reply": func(L *lua.LState) int {
+			L.Push(luaReplyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"log": func(L *lua.LState) int {
+			level := L.CheckInt(1)
+			var parts []string
+			for i := 2; i <= L.GetTop(); i++ {
+				parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+			}
+			msg := strings.Join(parts, " ")
+			switch level {
+			case 0:
+				s.ldebugf("%s", msg)
+			case 1:
+				s.lverbosf("%s", msg)
+			case 2:
+				s.lnoticef("%s", msg)
+			default:
+				s.lwarningf("%s", msg)
+			}
+			return 0
+		},
+	})
+	redis.RawSetString("LOG_DEBUG", lua.LNumber(0))
+	redis.RawSetString("LOG_VERBOSE", lua.LNumber(1))
+	redis.RawSetString("LOG_NOTICE", lua.LNumber(2))
+	redis.RawSetString("LOG_WARNING", lua.LNumber(3))
+	L.SetGlobal("redis", redis)
+
+	// The globals and the libraries are read-only, so a script can't change
+	// them for the next scripts. The globals are moved to a table behind
+	// the global table, which only holds the KEYS and ARGV of a script.
+	globals := L.NewTable()
+	var names []lua.LValue
+	L.G.Global.ForEach(func(k, v lua.LValue) {
+		if t, ok := v.(*lua.LTable); ok && t != L.G.Global {
+			v = luaReadOnly(L, t)
+		}
+		globals.RawSet(k, v)
+		names = append(names, k)
+	})
+	for _, k := range names {
+		L.G.Global.RawSet(k, lua.LNil)
+	}
+	protect := L.NewTable()
+	protect.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to create global variable '%s'", L.Get(2).String())
+		return 0
+	}))
+	protect.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		v := globals.RawGet(L.Get(2))
+		if v == lua.LNil {
+			L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.Get(2).String())
+		}
+		L.Push(v)
+		return 1
+	}))
+	L.SetMetatable(L.G.Global, protect)
+	s.lua = L
+	s.luaFuncs = make(map[string]*lua.LFunction)
+	return L
+}
+
+// luaReadOnly returns a table that reads from t and can't be changed.
+func luaReadOnly(L *lua.LState, t *lua.LTable) *lua.LTable {
+	proxy := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", t)
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Attempt to modify a readonly table")
+		return 0
+	}))
+	L.SetMetatable(proxy, mt)
+	return proxy
+}
+
+// luaFunc compiles a script and adds it to the script cache.
+func (s *Server) luaFunc(sha, body string) (*lua.LFunction, error) {
+	L := s.luaState()
+	if fn, ok := s.luaFuncs[sha]; ok {
+		return fn, nil
+	}
+	fn, err := L.Load(strings.NewReader(body), "user_script")
+	if err != nil {
+		return nil, err
+	}
+	s.scripts[sha] = body
+	s.luaFuncs[sha] = fn
+	return fn, nil
+}
+
+// flushScripts empties the script cache and throws away the interpreter.
+func (s *Server) flushScripts() {
+	if s.lua != nil {
+		s.lua.Close()
+		s.lua = nil
+	}
+	s.luaFuncs = nil
+	s.scripts = make(map[string]string)
+}
+
+func luaReplyTable(L *lua.LState, field, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(msg))
+	return t
+}
+
+// luaCall runs a command for redis.call and redis.pcall. An error reply is
+// raised as a Lua error when raise is set, otherwise it's returned as a
+// table with an err field.
+func (s *Server) luaCall(L *lua.LState, raise bool) int {
+	c := s.luaClient
+	if L.GetTop() == 0 {
+		L.RaiseError("Please specify at least one argument for redis.call()")
+		return 0
+	}
+	args := make([]string, L.GetTop())
+	iargs := make([]interface{}, len(args))
+	for i := range args {
+		switch v := L.Get(i + 1).(type) {
+		default:
+			L.RaiseError("Lua redis() command arguments must be strings or integers")
+			return 0
+		case lua.LString:
+			args[i] = string(v)
+		case lua.LNumber:
+			args[i] = v.String()
+		}
+		iargs[i] = args[i]
+	}
+	// the reply is parsed by luaFromReply, which only knows RESP2
+	var reply bytes.Buffer
+	c.wr = &reply
+	resp := c.resp
+	c.resp = 2
+	if cmd, ok := s.cmds[autocase(args[0])]; !ok {
+		c.replyError("Unknown Redis command called from script")
+	} else if cmd.noscript {
+		c.replyError("This Redis command is not allowed from scripts")
+	} else if c.args = args; !c.aclCheck(cmd) {
+		// the user of the script may not run the command
+	} else {
+		var raw bytes.Buffer
+		writeMultiBulk(&raw, iargs...)
+		c.raw = raw.Bytes()
+		if c.call(cmd) && cmd.aof {
+			s.luaMu.Lock()
+			s.luaWrote = true
+			s.luaMu.Unlock()
+			c.mblock.add(c.db, c.raw)
+		}
+	}
+	c.resp = resp
+	v, _ := luaFromReply(L, reply.Bytes())
+	if t, ok := v.(*lua.LTable); ok && raise {
+		if _, ok := t.RawGetString("err").(lua.LString); ok {
+			L.Error(t, 1)
+			return 0
+		}
+	}
+	L.Push(v)
+	return 1
+}
+
+// luaFromReply converts a reply into a Lua value. Returns the value and the
+// bytes that follow the reply.
+func luaFromReply(L *lua.LState, b []byte) (lua.LValue, []byte) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 2 {
+		return lua.LFalse, nil
+	}
+	typ, line := b[0], string(b[1:i-1])
+	b = b[i+1:]
+	switch typ {
+	case '+':
+		return luaReplyTable(L, "ok", line), b
+	case '-':
+		return luaReplyTable(L, "err", line), b
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return lua.LNumber(n), b
+	case '$':
+		n, _ := strconv.Atoi(line)
+		if n < 0 || n+2 > len(b) {
+			return lua.LFalse, b
+		}
+		return lua.LString(b[:n]), b[n+2:]
+	case '*':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return lua.LFalse, b
+		}
+		t := L.CreateTable(n, 0)
+		for j := 0; j < n; j++ {
+			var v lua.LValue
+			v, b = luaFromReply(L, b)
+			t.Append(v)
+		}
+		return t, b
+	}
+	return lua.LFalse, nil
+}
+
+// luaErrorString makes a Lua error message fit on a single reply line.
+func luaErrorString(msg string) string {
+	return strings.Replace(strings.TrimSpace(msg), "\n", " ", -1)
+}
+
+// replyLua converts the return value of a script into a reply.
+func (c *client) replyLua(v lua.LValue) {
+	switch v := v.(type) {
+	default:
+		c.replyNull()
+	case lua.LString:
+		c.replyBulk(string(v))
+	case lua.LNumber:
+		c.replyInt(int(v))
+	case lua.LBool:
+		if v {
+			c.replyInt(1)
+		} else {
+			c.replyNull()
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			c.replyString(string(msg))
+			return
+		}
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			c.replyUniqueError(string(msg))
+			return
+		}
+		// the RESP3 types, which are written as RESP2 to RESP2 clients
+		if n, ok := v.RawGetString("double").(lua.LNumber); ok {
+			c.replyDouble(float64(n))
+			return
+		}
+		if n, ok := v.RawGetString("big_number").(lua.LString); ok {
+			c.replyBigNumber(string(n))
+			return
+		}
+		if m, ok := v.RawGetString("map").(*lua.LTable); ok {
+			var pairs []lua.LValue
+			m.ForEach(func(key, value lua.LValue) {
+				pairs = append(pairs, key, value)
+			})
+			c.replyMapLen(len(pairs) / 2)
+			for _, v := range pairs {
+				c.replyLua(v)
+			}
+			return
+		}
+		if st, ok := v.RawGetString("set").(*lua.LTable); ok {
+			var members []lua.LValue
+			st.ForEach(func(member, _ lua.LValue) {
+				members = append(members, member)
+			})
+			c.replySetLen(len(members))
+			for _, v := range members {
+				c.replyLua(v)
+			}
+			return
+		}
+		// arrays stop at the first nil
+		var n int
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		c.replyMultiBulkLen(n)
+		for i := 1; i <= n; i++ {
+			c.replyLua(v.RawGetInt(i))
+		}
+	}
+}
+
+func luaStrings(L *lua.LState, strs []string) *lua.LTable {
+	t := L.CreateTable(len(strs), 0)
+	for _, s := range strs {
+		t.Append(lua.LString(s))
+	}
+	return t
+}
+
+// scriptArgs returns the KEYS and ARGV of an EVAL or EVALSHA.
+func (c *client) scriptArgs() (keys, argv []string, ok bool) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return nil, nil, false
+	}
+	n, err := strconv.Atoi(c.args[2])
+	if err != nil {
+		c.replyInvalidIntError()
+		return nil, nil, false
+	}
+	if n < 0 {
+		c.replyError("Number of keys can't be negative")
+		return nil, nil, false
+	}
+	if n > len(c.args)-3 {
+		c.replyError("Number of keys can't be greater than number of args")
+		return nil, nil, false
+	}
+	return c.args[3 : 3+n], c.args[3+n:], true
+}
+
+// runScript runs a compiled script and replies with its return value.
+func (c *client) runScript(sha string, fn *lua.LFunction, keys, argv []string) {
+	s := c.s
+	L := s.luaState()
+	// raw sets, the globals are protected
+	L.G.Global.RawSetString("KEYS", luaStrings(L, keys))
+	L.G.Global.RawSetString("ARGV", luaStrings(L, argv))
+	ctx, cancel := context.WithCancel(context.Background())
+	L.SetContext(ctx)
+	s.luaMu.Lock()
+	s.luaCancel = cancel
+	s.luaWrote = false
+	s.luaNoPass = s.defaultNoPass()
+	s.luaMu.Unlock()
+
+	wr, args, raw, db := c.wr, c.args, c.raw, c.db
+	block := c.mblock
+	if block == nil {
+		// not inside of an EXEC
+		c.mblock = newMultiAOF(db)
+	}
+	s.luaClient = c
+	L.Push(fn)
+	err := L.PCall(0, 1, nil)
+	s.luaClient = nil
+	if block == nil {
+		c.mblock.flush()
+		c.mblock = nil
+	}
+	c.wr, c.args, c.raw, c.db = wr, args, raw, db
+	c.errd = false
+
+	s.luaMu.Lock()
+	s.luaCancel = nil
+	s.luaMu.Unlock()
+	killed := ctx.Err() != nil
+	cancel()
+	L.RemoveContext()
+
+	if err != nil {
+		if killed {
+			c.replyError("Script killed by user with SCRIPT KILL...")
+			return
+		}
+		msg := err.Error()
+		if err, ok := err.(*lua.ApiError); ok {
+			if t, ok := err.Object.(*lua.LTable); ok {
+				// an error reply from redis.call
+				if msg, ok := t.RawGetString("err").(lua.LString); ok {
+					c.replyUniqueError(string(msg))
+					return
+				}
+			}
+			msg = err.Object.String()
+		}
+		c.replyError("Error running script (call to f_" + sha + "): " + luaErrorString(msg))
+		return
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	c.replyLua(ret)
+}
+
+// killScript handles a SCRIPT KILL while a script is running. The script
+// holds the write lock, so this runs outside of the lock. Returns false when
+// the command should take the normal path.
+func (c *client) killScript() bool {
+	if c.multi || len(c.args) != 2 || strings.ToLower(c.args[1]) != "kill" {
+		return false
+	}
+	s := c.s
+	s.luaMu.Lock()
+	defer s.luaMu.Unlock()
+	// a new client is checked like authenticate does, which local clients
+	// pass when no password is required
+	if c.authd != 2 && (!s.luaNoPass || (c.authd == 0 && !c.local())) {
+		return false
+	}
+	if u := c.user.Load(); u != nil && !u.commands["script"] {
+		return false
+	}
+	if s.luaCancel == nil {
+		// replied here, as the script may start before the lock is taken
+		c.replyUniqueError("NOTBUSY No scripts in execution right now.")
+		return true
+	}
+	if s.luaWrote {
+		c.replyUniqueError("UNKILLABLE Sorry the script already executed write " +
+			"commands against the dataset. You can either wait the script " +
+			"termination or kill the server in a hard way using the SHUTDOWN " +
+			"NOSAVE command.")
+		return true
+	}
+	s.luaCancel()
+	c.replyString("OK")
+	return true
+}
+
+func evalCommand(c *client) {
+	keys, argv, ok := c.scriptArgs()
+	if !ok {
+		return
+	}
+	sha := sha1hex(c.args[1])
+	fn, err := c.s.luaFunc(sha, c.args[1])
+	if err != nil {
+		c.replyError("Error compiling script (new function): " + luaErrorString(err.Error()))
+		return
+	}
+	c.runScript(sha, fn, keys, argv)
+}
+
+func evalshaCommand(c *client) {
+	keys, argv, ok := c.scriptArgs()
+	if !ok {
+		return
+	}
+	sha := strings.ToLower(c.args[1])
+	body, ok := c.s.scripts[sha]
+	if !ok {
+		c.replyUniqueError("NOSCRIPT No matching script. Please use EVAL.")
+		return
+	}
+	fn, err := c.s.luaFunc(sha, body)
+	if err != nil {
+		c.replyError("Error compiling script (new function): " + luaErrorString(err.Error()))
+		return
+	}
+	c.runScript(sha, fn, keys, argv)
+}
+
+func scriptCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("SCRIPT subcommand must be one of LOAD, EXISTS, FLUSH, KILL")
+	case "load":
+		if len(c.args) != 3 {
+			c.replyError("Wrong number of arguments for SCRIPT " + c.args[1])
+			return
+		}
+		sha := sha1hex(c.args[2])
+		if _, err := c.s.luaFunc(sha, c.args[2]); err != nil {
+			c.replyError("Error compiling script (new function): " + luaErrorString(err.Error()))
+			return
+		}
+		c.replyBulk(sha)
+	case "exists":
+		if len(c.args) < 3 {
+			c.replyError("Wrong number of arguments for SCRIPT " + c.args[1])
+			return
+		}
+		c.replyMultiBulkLen(len(c.args) - 2)
+		for _, sha := range c.args[2:] {
+			if _, ok := c.s.scripts[strings.ToLower(sha)]; ok {
+				c.replyInt(1)
+			} else {
+				c.replyInt(0)
+			}
+		}
+	case "flush":
+		if len(c.args) == 3 {
+			switch strings.ToLower(c.args[2]) {
+			default:
+				c.replyError("SCRIPT FLUSH only support SYNC|ASYNC option")
+				return
+			case "sync", "async":
+			}
+		} else if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for SCRIPT " + c.args[1])
+			return
+		}
+		c.s.flushScripts()
+		c.replyString("OK")
+	case "kill":
+		if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for SCRIPT " + c.args[1])
+			return
+		}
+		// a running script is killed by killScript before the lock
+		c.replyUniqueError("NOTBUSY No scripts in execution right now.")
+	}
+}
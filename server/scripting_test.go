@@ -0,0 +1,201 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScripting(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "SET", "a", "1")
+	c.expect("1", "EVAL", "return redis.call('get', KEYS[1])", "1", "a")
+	c.expect(":11", "EVAL", "return redis.call('incrby', KEYS[1], ARGV[1])", "1", "a", "10")
+	c.expect("*[:1,:2,*[x,(nil)]]", "EVAL", "return {1,2,{'x',false}}", "0")
+	c.expect("+PONG", "EVAL", "return redis.call('ping')", "0")
+	c.expect("+fine", "EVAL", "return redis.status_reply('fine')", "0")
+	c.expect("-MYERR bad", "EVAL", "return redis.error_reply('MYERR bad')", "0")
+	c.expect(":1", "EVAL", "return true", "0")
+	c.expect("(nil)", "EVAL", "return false", "0")
+	c.expect(":3", "EVAL", "return 3.7", "0")
+	c.expect("-ERR Number of keys can't be greater than number of args",
+		"EVAL", "return 1", "2", "a")
+	c.expect("-ERR Number of keys can't be negative", "EVAL", "return 1", "-1")
+	for _, tt := range []struct {
+		script string
+		expect string
+	}{
+		{"return redis.call('nosuch')", "Unknown Redis command called from script"},
+		{"return redis.call('multi')", "not allowed from scripts"},
+		{"return (", "-ERR Error compiling script"},
+		{"error('boom')", "boom"},
+	} {
+		if got := c.do("EVAL", tt.script, "0"); !strings.Contains(got, tt.expect) {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.script, tt.expect, got)
+		}
+	}
+
+	// redis.call raises the error and redis.pcall returns it
+	const wrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	c.expect(":1", "LPUSH", "l", "x")
+	c.expect("-"+wrongType, "EVAL", "return redis.call('get', 'l')", "0")
+	c.expect(wrongType, "EVAL", "local r = redis.pcall('get', 'l'); return r['err']", "0")
+	c.expect("-"+wrongType, "EVAL", "return redis.pcall('get', 'l')", "0")
+
+	sha := c.do("SCRIPT", "LOAD", "return ARGV[1]")
+	if len(sha) != 40 {
+		t.Fatalf("expected a sha1, got '%v'", sha)
+	}
+	c.expect("hi", "EVALSHA", sha, "0", "hi")
+	c.expect("hi", "EVALSHA", strings.ToUpper(sha), "0", "hi")
+	c.expect("*[:1,:0]", "SCRIPT", "EXISTS", sha, "0000")
+	c.expect("+OK", "SCRIPT", "FLUSH")
+	c.expect("*[:0]", "SCRIPT", "EXISTS", sha)
+	c.expect("-NOSCRIPT No matching script. Please use EVAL.", "EVALSHA", sha, "0")
+	c.expect("-NOTBUSY No scripts in execution right now.", "SCRIPT", "KILL")
+
+	// the writes of scripts touch the watched keys
+	other := ts.dial()
+	other.expect("+OK", "WATCH", "w")
+	c.expect("+OK", "EVAL", "return redis.call('set', 'w', '1')", "0")
+	other.expect("+OK", "MULTI")
+	other.expect("+QUEUED", "SET", "w", "2")
+	other.expect("(nil)", "EXEC")
+
+	// SELECT in a script doesn't change the database of the client
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "EVAL",
+		"redis.call('select', '3'); redis.call('set', 's3', 'x'); return 1", "0")
+	c.expect("+QUEUED", "SET", "after", "y")
+	c.expect("*[:1,+OK]", "EXEC")
+	c.expect("(nil)", "GET", "s3")
+	c.expect("y", "GET", "after")
+}
+
+func TestScriptingGlobals(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	for _, tt := range []struct {
+		script string
+		expect string
+	}{
+		{"x = 1", "Script attempted to create global variable 'x'"},
+		{"return y", "Script attempted to access nonexistent global variable 'y'"},
+		{"redis = nil", "Script attempted to create global variable 'redis'"},
+		{"redis.call = nil", "Attempt to modify a readonly table"},
+		{"string.len = nil", "Attempt to modify a readonly table"},
+	} {
+		if got := c.do("EVAL", tt.script, "0"); !strings.Contains(got, tt.expect) {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.script, tt.expect, got)
+		}
+	}
+	c.expect(":1", "EVAL", "local x = 1; return x", "0")
+	c.expect(":3", "EVAL", "return string.len('abc')", "0")
+	c.expect("ABC", "EVAL", "return ('abc'):upper()", "0")
+	c.expect("a", "EVAL", "return KEYS[1]", "1", "a")
+	c.expect("+PONG", "EVAL", "return redis.call('ping')", "0")
+}
+
+func TestScriptingKill(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	other := ts.dial()
+
+	// a script that didn't write can be killed
+	done := make(chan string)
+	go func() { done <- c.do("EVAL", "while true do end", "0") }()
+	other.wait("+OK", "SCRIPT", "KILL")
+	if got := <-done; !strings.Contains(got, "Script killed") {
+		t.Fatalf("expected '%v', got '%v'", "Script killed", got)
+	}
+
+	// a script that wrote can't be killed
+	go func() {
+		done <- c.do("EVAL", "redis.call('set', 'z', '1'); "+
+			"local i = 0; while i < 1000000 do i = i + 1 end; return 1", "0")
+	}()
+	for {
+		got := other.do("SCRIPT", "KILL")
+		if strings.HasPrefix(got, "-UNKILLABLE") {
+			break
+		}
+		if got != "-NOTBUSY No scripts in execution right now." {
+			t.Fatalf("expected '%v', got '%v'", "-UNKILLABLE", got)
+		}
+		select {
+		case got := <-done:
+			t.Fatalf("expected the script to run, got '%v'", got)
+		default:
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := <-done; got != ":1" {
+		t.Fatalf("expected '%v', got '%v'", ":1", got)
+	}
+	c.expect("1", "GET", "z")
+}
+
+func TestScriptingEffects(t *testing.T) {
+	master := testStartServer(t)
+	replica := testStartServer(t)
+	m := master.dial()
+	r := replica.dial()
+	r.expect("+OK", "REPLICAOF", "127.0.0.1", strconv.Itoa(master.port))
+	r.waitInfo("replication", "master_link_status", "up")
+
+	// the commands of scripts are written instead of the scripts
+	m.expect("+OK", "SET", "a", "1")
+	m.expect(":11", "EVAL", "return redis.call('incrby', KEYS[1], ARGV[1])", "1", "a", "10")
+	m.expect(":1", "EVAL",
+		"redis.call('select', '3'); redis.call('set', 's3', 'x'); return 1", "0")
+	m.expect("+OK", "SCRIPT", "FLUSH")
+	m.expect("+OK", "SET", "done", "1")
+	r.wait("1", "GET", "done")
+	r.expect("11", "GET", "a")
+	r.expect("+OK", "SELECT", "3")
+	r.expect("x", "GET", "s3")
+
+	master.restart()
+	data, err := ioutil.ReadFile(path.Join(master.dir, "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "EVAL") || !strings.Contains(string(data), "incrby") {
+		t.Fatalf("expected the commands of the scripts, got '%q'", data)
+	}
+	m = master.dial()
+	m.expect("11", "GET", "a")
+	m.expect("+OK", "SELECT", "3")
+	m.expect("x", "GET", "s3")
+}
+
+func TestScriptingRESP3(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	if got := c.do("HELLO", "3"); !strings.Contains(got, ",proto,:3,") {
+		t.Fatalf("expected '%v' in '%v'", "proto,:3", got)
+	}
+	c.expect(":1", "HSET", "h", "f", "v")
+	c.expect(":1", "SADD", "s", "m")
+	c.expect(":1", "ZADD", "z", "1.5", "m")
+
+	// the commands of scripts reply like RESP2
+	c.expect("*[f,v]", "EVAL", "return redis.call('hgetall', KEYS[1])", "1", "h")
+	c.expect("*[m]", "EVAL", "return redis.call('smembers', KEYS[1])", "1", "s")
+	c.expect("1.5", "EVAL", "return redis.call('zscore', KEYS[1], 'm')", "1", "z")
+	c.expect(":1", "EVAL", "return redis.call('get', 'nokey') == false", "0")
+	c.expect("_", "EVAL", "return redis.call('get', 'nokey')", "0")
+
+	// the scripts reply with the RESP3 types
+	c.expect(",3.5", "EVAL", "return {double=3.5}", "0")
+	c.expect("~[a]", "EVAL", "return {set={a=true}}", "0")
+	c.expect("(12", "EVAL", "return {big_number='12'}", "0")
+	c.expect("%[f,v]", "EVAL", "return {map={f='v'}}", "0")
+	other := ts.dial()
+	other.expect("3.5", "EVAL", "return {double=3.5}", "0")
+	other.expect("*[a]", "EVAL", "return {set={a=true}}", "0")
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -12,95 +14,227 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 func (s *Server) commandTable() {
 	// "+" append aof
 	// "w" write lock
 	// "r" read lock
-	s.register("get", getCommand, "r")           // Strings
-	s.register("getset", getsetCommand, "w+")    // Strings
-	s.register("set", setCommand, "w+")          // Strings
-	s.register("append", appendCommand, "w+")    // Strings
-	s.register("bitcount", bitcountCommand, "r") // Strings
-	s.register("incr", incrCommand, "w+")        // Strings
-	s.register("incrby", incrbyCommand, "w+")    // Strings
-	s.register("decr", decrCommand, "w+")        // Strings
-	s.register("decrby", decrbyCommand, "w+")    // Strings
-	s.register("mget", mgetCommand, "r")         // Strings
-	s.register("setnx", setnxCommand, "w+")      // Strings
-	s.register("mset", msetCommand, "w+")        // Strings
-	s.register("msetnx", msetnxCommand, "w+")    // Strings
-
-	s.register("lpush", lpushCommand, "w+")         // Lists
-	s.register("rpush", rpushCommand, "w+")         // Lists
-	s.register("lrange", lrangeCommand, "r")        // Lists
-	s.register("llen", llenCommand, "r")            // Lists
-	s.register("lpop", lpopCommand, "w+")           // Lists
-	s.register("rpop", rpopCommand, "w+")           // Lists
-	s.register("lindex", lindexCommand, "r")        // Lists
-	s.register("lrem", lremCommand, "w+")           // Lists
-	s.register("lset", lsetCommand, "w+")           // Lists
-	s.register("ltrim", ltrimCommand, "w+")         // Lists
-	s.register("rpoplpush", rpoplpushCommand, "w+") // Lists
-
-	s.register("sadd", saddCommand, "w+")               // Sets
-	s.register("scard", scardCommand, "r")              // Sets
-	s.register("smembers", smembersCommand, "r")        // Sets
-	s.register("sismember", sismembersCommand, "r")     // Sets
-	s.register("sdiff", sdiffCommand, "r")              // Sets
-	s.register("sinter", sinterCommand, "r")            // Sets
-	s.register("sunion", sunionCommand, "r")            // Sets
-	s.register("sdiffstore", sdiffstoreCommand, "w+")   // Sets
-	s.register("sinterstore", sinterstoreCommand, "w+") // Sets
-	s.register("sunionstore", sunionstoreCommand, "w+") // Sets
-	s.register("spop", spopCommand, "w+")               // Sets
-	s.register("srandmember", srandmemberCommand, "r")  // Sets
-	s.register("srem", sremCommand, "w+")               // Sets
-	s.register("smove", smoveCommand, "w+")             // Sets
-
-	s.register("echo", echoCommand, "")      // Connection
-	s.register("ping", pingCommand, "")      // Connection
-	s.register("select", selectCommand, "w") // Connection
-
-	s.register("flushdb", flushdbCommand, "w+")          // Server
-	s.register("flushall", flushallCommand, "w+")        // Server
-	s.register("dbsize", dbsizeCommand, "r")             // Server
-	s.register("debug", debugCommand, "w")               // Server
-	s.register("bgrewriteaof", bgrewriteaofCommand, "w") // Server
-	s.register("bgsave", bgsaveCommand, "w")             // Server
-	s.register("save", saveCommand, "w")                 // Server
-	s.register("lastsave", lastsaveCommand, "r")         // Server
-	s.register("shutdown", shutdownCommand, "w")         // Server
-	s.register("info", infoCommand, "r")                 // Server
-	s.register("monitor", monitorCommand, "w")           // Server
-	s.register("config", configCommand, "w")             // Server
-	s.register("auth", authCommand, "r")                 // Server
-
-	s.register("del", delCommand, "w+")            // Keys
-	s.register("keys", keysCommand, "r")           // Keys
-	s.register("rename", renameCommand, "w+")      // Keys
-	s.register("renamenx", renamenxCommand, "w+")  // Keys
-	s.register("type", typeCommand, "r")           // Keys
-	s.register("randomkey", randomkeyCommand, "r") // Keys
-	s.register("exists", existsCommand, "r")       // Keys
-	s.register("expire", expireCommand, "w+")      // Keys
-	s.register("ttl", ttlCommand, "r")             // Keys
-	s.register("move", moveCommand, "w+")          // Keys
-	s.register("sort", sortCommand, "w+")          // Keys
-	s.register("expireat", expireatCommand, "w+")  // Keys
+	// "s" allowed while the client is subscribed to pubsub channels
+	// "x" executed immediately inside MULTI rather than queued
+	// "n" not allowed from scripts
+	// "m" may use more memory, refused when the memory is over maxmemory
+	//
+	// The three numbers are the positions of the first key, the last key, and
+	// the step between keys. A negative last key counts back from the end of
+	// the arguments. Zero means the command takes no keys.
+	//
+	// The last argument is the ACL category of the command group. The
+	// @read, @write and @dangerous categories are added from the options.
+	s.register("get", getCommand, "r", 1, 1, 1, "string")
+	s.register("getset", getsetCommand, "w+m", 1, 1, 1, "string")
+	s.register("set", setCommand, "w+m", 1, 1, 1, "string")
+	s.register("append", appendCommand, "w+m", 1, 1, 1, "string")
+	s.register("bitcount", bitcountCommand, "r", 1, 1, 1, "string")
+	s.register("incr", incrCommand, "w+m", 1, 1, 1, "string")
+	s.register("incrby", incrbyCommand, "w+m", 1, 1, 1, "string")
+	s.register("decr", decrCommand, "w+m", 1, 1, 1, "string")
+	s.register("decrby", decrbyCommand, "w+m", 1, 1, 1, "string")
+	s.register("mget", mgetCommand, "r", 1, -1, 1, "string")
+	s.register("setnx", setnxCommand, "w+m", 1, 1, 1, "string")
+	s.register("mset", msetCommand, "w+m", 1, -1, 2, "string")
+	s.register("msetnx", msetnxCommand, "w+m", 1, -1, 2, "string")
+	s.register("setex", setexCommand, "w+m", 1, 1, 1, "string")
+	s.register("psetex", psetexCommand, "w+m", 1, 1, 1, "string")
+
+	s.register("lpush", lpushCommand, "w+m", 1, 1, 1, "list")
+	s.register("rpush", rpushCommand, "w+m", 1, 1, 1, "list")
+	s.register("lrange", lrangeCommand, "r", 1, 1, 1, "list")
+	s.register("llen", llenCommand, "r", 1, 1, 1, "list")
+	s.register("lpop", lpopCommand, "w+", 1, 1, 1, "list")
+	s.register("rpop", rpopCommand, "w+", 1, 1, 1, "list")
+	s.register("lindex", lindexCommand, "r", 1, 1, 1, "list")
+	s.register("lrem", lremCommand, "w+", 1, 1, 1, "list")
+	s.register("lset", lsetCommand, "w+m", 1, 1, 1, "list")
+	s.register("ltrim", ltrimCommand, "w+", 1, 1, 1, "list")
+	s.register("rpoplpush", rpoplpushCommand, "w+m", 1, 2, 1, "list")
+	s.register("blpop", blpopCommand, "w+", 1, -2, 1, "list")
+	s.register("brpop", brpopCommand, "w+", 1, -2, 1, "list")
+	s.register("brpoplpush", brpoplpushCommand, "w+m", 1, 2, 1, "list")
+
+	s.register("sadd", saddCommand, "w+m", 1, 1, 1, "set")
+	s.register("scard", scardCommand, "r", 1, 1, 1, "set")
+	s.register("smembers", smembersCommand, "r", 1, 1, 1, "set")
+	s.register("sismember", sismembersCommand, "r", 1, 1, 1, "set")
+	s.register("sdiff", sdiffCommand, "r", 1, -1, 1, "set")
+	s.register("sinter", sinterCommand, "r", 1, -1, 1, "set")
+	s.register("sunion", sunionCommand, "r", 1, -1, 1, "set")
+	s.register("sdiffstore", sdiffstoreCommand, "w+m", 1, -1, 1, "set")
+	s.register("sinterstore", sinterstoreCommand, "w+m", 1, -1, 1, "set")
+	s.register("sunionstore", sunionstoreCommand, "w+m", 1, -1, 1, "set")
+	s.register("spop", spopCommand, "w+", 1, 1, 1, "set")
+	s.register("srandmember", srandmemberCommand, "r", 1, 1, 1, "set")
+	s.register("srem", sremCommand, "w+", 1, 1, 1, "set")
+	s.register("smove", smoveCommand, "w+", 1, 2, 1, "set")
+	s.register("sscan", sscanCommand, "r", 1, 1, 1, "set")
+
+	s.register("zadd", zaddCommand, "w+m", 1, 1, 1, "sortedset")
+	s.register("zincrby", zincrbyCommand, "w+m", 1, 1, 1, "sortedset")
+	s.register("zcard", zcardCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zscore", zscoreCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrem", zremCommand, "w+", 1, 1, 1, "sortedset")
+	s.register("zrank", zrankCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrevrank", zrevrankCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrange", zrangeCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrevrange", zrevrangeCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrangebyscore", zrangebyscoreCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrevrangebyscore", zrevrangebyscoreCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrangebylex", zrangebylexCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zrevrangebylex", zrevrangebylexCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zcount", zcountCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zlexcount", zlexcountCommand, "r", 1, 1, 1, "sortedset")
+	s.register("zremrangebyrank", zremrangebyrankCommand, "w+", 1, 1, 1, "sortedset")
+	s.register("zremrangebyscore", zremrangebyscoreCommand, "w+", 1, 1, 1, "sortedset")
+	s.register("zremrangebylex", zremrangebylexCommand, "w+", 1, 1, 1, "sortedset")
+	s.register("zunionstore", zunionstoreCommand, "w+m", 1, 1, 1, "sortedset")
+	s.register("zinterstore", zinterstoreCommand, "w+m", 1, 1, 1, "sortedset")
+	s.cmds["zunionstore"].getkeys = zstoreKeys
+	s.cmds["zinterstore"].getkeys = zstoreKeys
+
+	s.register("hset", hsetCommand, "w+m", 1, 1, 1, "hash")
+	s.register("hsetnx", hsetnxCommand, "w+m", 1, 1, 1, "hash")
+	s.register("hmset", hmsetCommand, "w+m", 1, 1, 1, "hash")
+	s.register("hget", hgetCommand, "r", 1, 1, 1, "hash")
+	s.register("hmget", hmgetCommand, "r", 1, 1, 1, "hash")
+	s.register("hgetall", hgetallCommand, "r", 1, 1, 1, "hash")
+	s.register("hkeys", hkeysCommand, "r", 1, 1, 1, "hash")
+	s.register("hvals", hvalsCommand, "r", 1, 1, 1, "hash")
+	s.register("hdel", hdelCommand, "w+", 1, 1, 1, "hash")
+	s.register("hlen", hlenCommand, "r", 1, 1, 1, "hash")
+	s.register("hstrlen", hstrlenCommand, "r", 1, 1, 1, "hash")
+	s.register("hexists", hexistsCommand, "r", 1, 1, 1, "hash")
+	s.register("hincrby", hincrbyCommand, "w+m", 1, 1, 1, "hash")
+	s.register("hincrbyfloat", hincrbyfloatCommand, "w+m", 1, 1, 1, "hash")
+
+	s.register("subscribe", subscribeCommand, "wsn", 0, 0, 0, "pubsub")
+	s.register("psubscribe", psubscribeCommand, "wsn", 0, 0, 0, "pubsub")
+	s.register("unsubscribe", unsubscribeCommand, "wsn", 0, 0, 0, "pubsub")
+	s.register("punsubscribe", punsubscribeCommand, "wsn", 0, 0, 0, "pubsub")
+	s.register("publish", publishCommand, "w", 0, 0, 0, "pubsub")
+	s.register("pubsub", pubsubCommand, "r", 0, 0, 0, "pubsub")
+
+	s.register("echo", echoCommand, "", 0, 0, 0, "connection")
+	s.register("ping", pingCommand, "s", 0, 0, 0, "connection")
+	s.register("select", selectCommand, "w", 0, 0, 0, "connection")
+	s.register("client", clientCommand, "wn", 0, 0, 0, "connection")
+	s.register("hello", helloCommand, "wn", 0, 0, 0, "connection")
+	s.register("auth", authCommand, "rn", 0, 0, 0, "connection")
+
+	s.register("flushdb", flushdbCommand, "w+", 0, 0, 0, "admin")
+	s.register("flushall", flushallCommand, "w+", 0, 0, 0, "admin")
+	s.register("dbsize", dbsizeCommand, "r", 0, 0, 0, "admin")
+	s.register("debug", debugCommand, "w", 0, 0, 0, "admin")
+	s.register("bgrewriteaof", bgrewriteaofCommand, "wn", 0, 0, 0, "admin")
+	s.register("bgsave", bgsaveCommand, "wn", 0, 0, 0, "admin")
+	s.register("save", saveCommand, "wn", 0, 0, 0, "admin")
+	s.register("lastsave", lastsaveCommand, "r", 0, 0, 0, "admin")
+	s.register("shutdown", shutdownCommand, "wn", 0, 0, 0, "admin")
+	s.register("info", infoCommand, "r", 0, 0, 0, "admin")
+	s.register("monitor", monitorCommand, "wn", 0, 0, 0, "admin")
+	s.register("config", configCommand, "wn", 0, 0, 0, "admin")
+	s.register("acl", aclCommand, "wn", 0, 0, 0, "admin")
+	s.register("replicaof", replicaofCommand, "wn", 0, 0, 0, "admin")
+	s.register("slaveof", replicaofCommand, "wn", 0, 0, 0, "admin")
+	s.register("sync", syncCommand, "wn", 0, 0, 0, "admin")
+	s.register("psync", syncCommand, "wn", 0, 0, 0, "admin")
+	s.register("replconf", replconfCommand, "wn", 0, 0, 0, "admin")
+	s.register("slowlog", slowlogCommand, "r", 0, 0, 0, "admin")
+
+	s.register("multi", multiCommand, "wxn", 0, 0, 0, "transaction")
+	s.register("exec", execCommand, "wxn", 0, 0, 0, "transaction")
+	s.register("discard", discardCommand, "wxn", 0, 0, 0, "transaction")
+	s.register("watch", watchCommand, "wxn", 1, -1, 1, "transaction")
+	s.register("unwatch", unwatchCommand, "wn", 0, 0, 0, "transaction")
+
+	s.register("eval", evalCommand, "wn", 0, 0, 0, "scripting")
+	s.register("evalsha", evalshaCommand, "wn", 0, 0, 0, "scripting")
+	s.register("script", scriptCommand, "wn", 0, 0, 0, "scripting")
+
+	s.register("del", delCommand, "w+", 1, -1, 1, "keyspace")
+	s.register("keys", keysCommand, "r", 0, 0, 0, "keyspace")
+	s.register("rename", renameCommand, "w+", 1, 2, 1, "keyspace")
+	s.register("renamenx", renamenxCommand, "w+", 1, 2, 1, "keyspace")
+	s.register("type", typeCommand, "r", 1, 1, 1, "keyspace")
+	s.register("randomkey", randomkeyCommand, "r", 0, 0, 0, "keyspace")
+	s.register("exists", existsCommand, "r", 1, -1, 1, "keyspace")
+	s.register("expire", expireCommand, "w+", 1, 1, 1, "keyspace")
+	s.register("ttl", ttlCommand, "r", 1, 1, 1, "keyspace")
+	s.register("move", moveCommand, "w+", 1, 1, 1, "keyspace")
+	s.register("sort", sortCommand, "w+m", 1, 1, 1, "keyspace")
+	s.cmds["sort"].getkeys = sortKeys
+	s.register("expireat", expireatCommand, "w+", 1, 1, 1, "keyspace")
+	s.register("scan", scanCommand, "r", 0, 0, 0, "keyspace")
+	s.register("pexpire", pexpireCommand, "w+", 1, 1, 1, "keyspace")
+	s.register("pexpireat", pexpireatCommand, "w+", 1, 1, 1, "keyspace")
+	s.register("pttl", pttlCommand, "r", 1, 1, 1, "keyspace")
+	s.register("persist", persistCommand, "w+", 1, 1, 1, "keyspace")
 }
 
 var errShutdownSave = errors.New("shutdown and save")
 var errShutdownNoSave = errors.New("shutdown and nosave")
 
 type command struct {
-	name  string
-	aof   bool
-	read  bool
-	write bool
-	funct func(c *client)
+	name     string
+	aof      bool
+	read     bool
+	write    bool
+	pubsub   bool
+	multi    bool
+	noscript bool
+	denyoom  bool
+	stats    commandStats
+	firstKey int
+	lastKey  int
+	keyStep  int
+	funct    func(c *client)
+
+	// getkeys returns the keys of the commands that have keys in variable
+	// positions, and false when some of the keys can't be known.
+	getkeys func(args []string) ([]string, bool)
+
+	categories []string // the ACL categories
+}
+
+// keys returns the key arguments for the command.
+func (cmd *command) keys(args []string) []string {
+	if cmd.firstKey == 0 || cmd.firstKey >= len(args) {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	var keys []string
+	for i := cmd.firstKey; i <= last; i += cmd.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// allKeys returns every key that the command may access, and false when some
+// of the keys can't be known from the arguments.
+func (cmd *command) allKeys(args []string) ([]string, bool) {
+	if cmd.getkeys != nil {
+		return cmd.getkeys(args)
+	}
+	return cmd.keys(args), true
 }
 
 // Options alter the behavior of the server.
@@ -118,27 +252,108 @@ type Options struct {
 // Server represents a server object.
 type Server struct {
 	mu      sync.RWMutex
-	l       net.Listener
-	options *Options // options that are passed from the caller
-	cfg     *config  // server configuration
+	l       net.Listener // nil when port is 0
+	tlsl    net.Listener // nil when tls-port is 0
+	unixl   net.Listener // nil without unixsocket
+	options *Options     // options that are passed from the caller
+	cfg     *config      // server configuration
 	cmds    map[string]*command
 	dbs     map[int]*database
 	started time.Time
 
-	clients  map[*client]bool // connected clients
-	monitors map[*client]bool // clients monitoring
+	clients  map[*client]bool    // connected clients
+	acl      map[string]*aclUser // the ACL users by name
+	monitors map[*client]bool    // clients monitoring
+
+	channels map[string]map[*client]bool // pubsub channel subscribers
+	patterns map[string]*subPattern      // pubsub pattern subscribers
 
 	follower   bool
 	mode       string
 	executable string
 
+	replID     string               // the replication id of this server
+	replOffset int64                // the offset of the replication stream
+	replPinged time.Time            // the last time replicas were pinged
+	backlog    []byte               // recent stream data for partial resyncs
+	backlogOff int64                // the replication offset of backlog[0]
+	replicas   map[*client]*replica // connected replicas
+
+	masterHost    string    // the master host, when following
+	masterPort    string    // the master port, when following
+	masterEpoch   int       // incremented each time the master changes
+	masterConn    net.Conn  // the connection to the master
+	masterLinkUp  bool      // the master link is streaming commands
+	masterSyncing bool      // the master link is in the handshake or sync
+	masterLastIO  time.Time // the last time data was read from the master
+	masterReplID  string    // the replication id of the master
+	masterOffset  int64     // the processed offset of the master stream
+	masterDBNum   int       // the selected db of the master stream
+
 	expiresdone bool // flag for when the expires loop ends
 
+	statExpiredKeys           int           // keys deleted by the active expire cycle
+	statExpiredStalePerc      float64       // running average of expired keys in the samples
+	statExpiredTimeCapReached int           // cycles that ran out of time
+	statExpireCycleTime       time.Duration // the time spent in the active expire cycle
+	statEvictedKeys           int           // keys evicted for maxmemory
+	statNumConnections        int           // connections accepted
+	statRejectedConn          int           // connections rejected for maxclients
+	statNumCommands           atomic.Int64  // commands processed
+	statNetInputBytes         atomic.Int64  // bytes read from clients
+	statNetOutputBytes        atomic.Int64  // bytes written to clients
+
+	opsSamples     [opsSamples]float64 // ops per second samples
+	opsSampleIdx   int                 // the next sample to replace
+	opsSampleTime  time.Time           // the time of the last sample
+	opsSampleCount int64               // statNumCommands at the last sample
+
+	slowlog slowlog // the commands that ran longer than slowlog-log-slower-than
+
+	lastClientID int64         // the id of the last client that connected
+	pauseEnd     time.Time     // the end of CLIENT PAUSE
+	pauseAll     bool          // CLIENT PAUSE ALL, rather than WRITE
+	pauseCh      chan struct{} // closed by CLIENT UNPAUSE
+
+	tlsConfig atomic.Pointer[tls.Config] // the certificates of new TLS connections
+
+	oom         bool   // the memory is over maxmemory and can't be freed
+	memEvicted  int64  // the estimated bytes evicted since the last gc
+	memGCCycles uint64 // the gc cycle of memEvicted
+	memGCAllocs int64  // the total bytes allocated at the last gc
+
+	memGCMu sync.Mutex // held by the client that collects the heap
+
 	aof        *os.File // the aof file handle
 	aofdbnum   int      // the db num of the last "select" written to the aof
 	aofclosed  bool     // flag for when the aof file is closed
 	aofrewrite bool     // flag for when the aof is in the process of being rewritten
 	aofPath    string   // the full absolute path to the aof file
+	aofpending bool     // the aof has writes that are waiting for a sync
+
+	aofsize         int64         // the current size of the aof file
+	aofbasesize     int64         // the size of the aof file after the last rewrite
+	aofrewriteStart time.Time     // the start time of the current rewrite
+	aofrewriteTime  time.Duration // the duration of the last rewrite
+	aofrewriteErr   error         // the error from the last rewrite
+	aofwriteErr     error         // the error from the last aof write
+
+	rdbPath       string    // the full absolute path to the snapshot file
+	rdbsaving     bool      // flag for when a background save is in progress
+	lastsave      time.Time // the time of the last successful snapshot
+	lastbgsaveErr error     // the error from the last background save
+	dirty         int       // the number of changes since the last snapshot
+
+	lua       *lua.LState               // the script interpreter, created on first use
+	luaFuncs  map[string]*lua.LFunction // compiled scripts of the interpreter
+	scripts   map[string]string         // script bodies keyed by their sha1
+	luaClient *client                   // the client running a script
+	luaMu     sync.Mutex                // guards the fields below, used by SCRIPT KILL
+	luaCancel context.CancelFunc        // stops the running script
+	luaWrote  bool                      // the running script changed the dataset
+	luaNoPass bool                      // no password was required when the script started
+
+	loglevel atomic.Int32 // the minimum level that is logged, see logLevels
 
 	ferr     error      // a fatal error. setting this should happen in the fatalError function
 	ferrcond *sync.Cond // synchronize the watch
@@ -149,10 +364,14 @@ type Server struct {
 // register is called from the commandTable() function. The command map will contains
 // two entries assigned to the same command. One with an all uppercase key and one with
 // an all lower case key.
-func (s *Server) register(commandName string, f func(c *client), opts string) {
+func (s *Server) register(commandName string, f func(c *client), opts string,
+	firstKey, lastKey, keyStep int, category string) {
 	var cmd command
 	cmd.name = commandName
 	cmd.funct = f
+	cmd.firstKey = firstKey
+	cmd.lastKey = lastKey
+	cmd.keyStep = keyStep
 	for _, c := range []byte(opts) {
 		switch c {
 		case '+':
@@ -161,8 +380,17 @@ func (s *Server) register(commandName string, f func(c *client), opts string) {
 			cmd.read = true
 		case 'w':
 			cmd.write = true
+		case 's':
+			cmd.pubsub = true
+		case 'x':
+			cmd.multi = true
+		case 'n':
+			cmd.noscript = true
+		case 'm':
+			cmd.denyoom = true
 		}
 	}
+	cmd.categories = commandCategories(&cmd, category)
 	s.cmds[strings.ToLower(commandName)] = &cmd
 	s.cmds[strings.ToUpper(commandName)] = &cmd
 }
@@ -179,18 +407,39 @@ func log(w io.Writer, c byte, format string, args ...interface{}) {
 	)
 }
 
+// The log levels, in the order of logLevels.
+const (
+	logDebug = iota
+	logVerbose
+	logNotice
+	logWarning
+)
+
+// logLevels are the values of the loglevel directive.
+var logLevels = []string{"debug", "verbose", "notice", "warning"}
+
+// setLogLevel sets the minimum level of the messages that are logged.
+// Everything is logged until the config is loaded.
+func (s *Server) setLogLevel(level string) {
+	for i, l := range logLevels {
+		if l == level {
+			s.loglevel.Store(int32(i))
+		}
+	}
+}
+
 func (s *Server) ldebugf(format string, args ...interface{}) {
-	if !s.options.IgnoreLogDebug {
+	if !s.options.IgnoreLogDebug && s.loglevel.Load() <= logDebug {
 		log(s.options.LogWriter, '.', format, args...)
 	}
 }
 func (s *Server) lverbosf(format string, args ...interface{}) {
-	if !s.options.IgnoreLogVerbose {
+	if !s.options.IgnoreLogVerbose && s.loglevel.Load() <= logVerbose {
 		log(s.options.LogWriter, '-', format, args...)
 	}
 }
 func (s *Server) lnoticef(format string, args ...interface{}) {
-	if !s.options.IgnoreLogNotice {
+	if !s.options.IgnoreLogNotice && s.loglevel.Load() <= logNotice {
 		log(s.options.LogWriter, '*', format, args...)
 	}
 }
@@ -215,19 +464,29 @@ func (s *Server) getFatalError() error {
 	return s.ferr
 }
 
-// startExpireLoop runs a background routine which watches for exipred keys
-// and forces their removal from the database. One second resolution.
+// startExpireLoop runs a background routine which runs the active expire
+// cycle hz times a second, and the other periodic tasks once a second.
 func (s *Server) startExpireLoop() {
 	go func() {
-		t := time.NewTicker(time.Second)
-		defer t.Stop()
-		for range t.C {
+		s.mu.RLock()
+		hz := s.cfg.hz
+		s.mu.RUnlock()
+		lastCron := time.Now()
+		for {
+			time.Sleep(time.Second / time.Duration(hz))
 			s.mu.Lock()
 			if s.expiresdone {
 				s.mu.Unlock()
 				return
 			}
-			s.forceDeleteExpires()
+			s.activeExpireCycle()
+			s.trackOps()
+			if time.Since(lastCron) >= time.Second {
+				lastCron = time.Now()
+				s.replicationCron()
+				s.autoRewriteAOF()
+			}
+			hz = s.cfg.hz
 			s.mu.Unlock()
 		}
 	}()
@@ -269,7 +528,7 @@ func (s *Server) startFatalErrorWatch() {
 				return
 			}
 			if s.ferr != nil {
-				s.l.Close()
+				s.closeListeners()
 				s.ferrdone = true
 				s.ferrcond.L.Unlock()
 				return
@@ -302,11 +561,18 @@ func Start(options *Options) (err error) {
 		dbs:      make(map[int]*database),
 		clients:  make(map[*client]bool),
 		monitors: make(map[*client]bool),
+		channels: make(map[string]map[*client]bool),
+		patterns: make(map[string]*subPattern),
 		aofdbnum: -1,
 		ferrcond: sync.NewCond(&sync.Mutex{}),
 		started:  time.Now(),
 		mode:     "standalone",
 		follower: false,
+		replID:   newReplID(),
+		replicas: make(map[*client]*replica),
+		scripts:  make(map[string]string),
+
+		aofrewriteTime: -1,
 	}
 	var ready bool
 	defer func() {
@@ -329,13 +595,26 @@ func Start(options *Options) (err error) {
 	}
 	s.cfg, err = fillConfig(configMap, configFile)
 	if err != nil {
+		s.lwarningf("%v", err)
 		err = errors.New("config failure")
-		//s.lwarningf("%v", err)
 		return
 	}
+	s.setLogLevel(s.cfg.loglevel)
 	s.lwarningf("Server started, %s version %s", s.options.AppName, s.options.Version)
+	s.slowlog.configure(s.cfg)
 	s.commandTable()
+	s.acl = map[string]*aclUser{"default": s.newDefaultUser()}
+	if s.cfg.aclfile != "" {
+		if s.acl, err = s.loadACLFile(); err != nil {
+			s.lwarningf("Aborting startup because of ACL errors: %v", err)
+			return err
+		}
+	}
 	ready = true
+	if err = s.adjustOpenFilesLimit(); err != nil {
+		s.lwarningf("%v", err)
+		return err
+	}
 
 	var wd string
 	wd, err = os.Getwd()
@@ -348,29 +627,80 @@ func Start(options *Options) (err error) {
 	if !path.IsAbs(s.aofPath) {
 		s.aofPath = path.Join(wd, s.aofPath)
 	}
-	if err = s.openAOF(); err != nil {
+	s.rdbPath = s.cfg.dbfilename
+	if !path.IsAbs(s.rdbPath) {
+		s.rdbPath = path.Join(wd, s.rdbPath)
+	}
+	s.lastsave = s.started
+	if fi, err := os.Stat(s.rdbPath); err == nil {
+		s.lastsave = fi.ModTime()
+	}
+	if s.cfg.appendonly {
+		err = s.openAOF()
+	} else {
+		_, err = s.loadRDB()
+	}
+	if err != nil {
 		s.lwarningf("%v", err)
 		return err
 	}
+	s.startAOFSyncLoop()
 	defer func() {
 		switch s.getFatalError() {
 		case errShutdownSave:
-			s.lnoticef("DB saved on disk")
+			s.mu.Lock()
+			s.saveRDB()
+			s.mu.Unlock()
 		}
 	}()
 	defer s.closeAOF()
 	defer s.flushAOF()
 	s.startExpireLoop()
 	defer s.stopExpireLoop()
-	addr := s.cfg.kvm["bind"] + ":" + s.cfg.kvm["port"]
-	s.l, err = net.Listen("tcp", addr)
-	if err != nil {
-		s.lwarningf("%v", err)
-		return err
+	defer func() {
+		s.mu.Lock()
+		s.stopReplication()
+		s.mu.Unlock()
+	}()
+	var listeners []net.Listener
+	if s.cfg.port != 0 {
+		addr := s.cfg.kvm["bind"] + ":" + s.cfg.kvm["port"]
+		s.l, err = net.Listen("tcp", addr)
+		if err != nil {
+			s.lwarningf("%v", err)
+			return err
+		}
+		listeners = append(listeners, s.l)
+	}
+	if s.cfg.tlsPort != 0 {
+		s.tlsl, err = s.listenTLS()
+		if err != nil {
+			s.closeListeners()
+			s.lwarningf("%v", err)
+			return err
+		}
+		listeners = append(listeners, s.tlsl)
+	}
+	if s.cfg.unixsocket != "" {
+		s.unixl, err = s.listenUnix()
+		if err != nil {
+			s.closeListeners()
+			s.lwarningf("Opening Unix socket: %v", err)
+			return err
+		}
+		listeners = append(listeners, s.unixl)
 	}
-	defer s.l.Close()
+	defer s.closeListeners()
 
-	s.lnoticef("The server is now ready to accept connections on port %s", s.l.Addr().String()[strings.LastIndex(s.l.Addr().String(), ":")+1:])
+	if s.l != nil {
+		s.lnoticef("The server is now ready to accept connections on port %s", s.l.Addr().String()[strings.LastIndex(s.l.Addr().String(), ":")+1:])
+	}
+	if s.tlsl != nil {
+		s.lnoticef("The server is now ready to accept TLS connections on port %s", s.tlsl.Addr().String()[strings.LastIndex(s.tlsl.Addr().String(), ":")+1:])
+	}
+	if s.unixl != nil {
+		s.lnoticef("The server is now ready to accept connections at %s", s.cfg.unixsocket)
+	}
 
 	// Start watching for fatal errors.
 	s.startFatalErrorWatch()
@@ -390,9 +720,34 @@ func Start(options *Options) (err error) {
 		}
 	}()
 
+	// Accept on each listener, and handle the connections here.
+	accepted := make(chan net.Conn)
+	failed := make(chan error, len(listeners))
+	done := make(chan struct{})
+	defer close(done)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					failed <- err
+					return
+				}
+				select {
+				case accepted <- conn:
+				case <-done:
+					conn.Close()
+					return
+				}
+			}
+		}(l)
+	}
 	for {
-		conn, err := s.l.Accept()
-		if err != nil {
+		select {
+		case conn := <-accepted:
+			conns[conn] = true
+			go handleConn(conn, s)
+		case err := <-failed:
 			ferr := s.getFatalError()
 			if ferr != errShutdownSave && ferr != errShutdownNoSave {
 				return err
@@ -400,10 +755,38 @@ func Start(options *Options) (err error) {
 				return nil
 			}
 		}
-		conns[conn] = true
-		go handleConn(conn, s)
+	}
+}
 
+// closeListeners closes the tcp, the TLS and the unix listeners. Closing the
+// unix listener removes the socket file.
+func (s *Server) closeListeners() {
+	if s.l != nil {
+		s.l.Close()
+	}
+	if s.tlsl != nil {
+		s.tlsl.Close()
+	}
+	if s.unixl != nil {
+		s.unixl.Close()
+	}
+}
+
+// listenUnix starts the listener on unixsocket, replacing a socket file that
+// was left behind.
+func (s *Server) listenUnix() (net.Listener, error) {
+	os.Remove(s.cfg.unixsocket)
+	l, err := net.Listen("unix", s.cfg.unixsocket)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.unixsocketperm != 0 {
+		if err := os.Chmod(s.cfg.unixsocket, s.cfg.unixsocketperm); err != nil {
+			l.Close()
+			return nil, err
+		}
 	}
+	return l, nil
 }
 
 func (s *Server) broadcastMonitors(dbnum int, addr string, args []string) {
@@ -481,73 +864,169 @@ func (s *Server) protected() bool {
 	if !s.cfg.bindIsLocal {
 		return false
 	}
-	return s.cfg.protectedMode && s.cfg.requirepass == ""
+	return s.cfg.protectedMode && s.defaultNoPass()
 }
 
 func handleConn(conn net.Conn, s *Server) {
 	defer conn.Close()
+	netConn := conn
+	conn = &statConn{Conn: conn, s: s}
 	rd := newCommandReader(conn)
 	wr := bufio.NewWriter(conn)
 	defer wr.Flush()
-	c := &client{wr: wr, s: s}
+	c := &client{wr: wr, out: wr, s: s, conn: conn, created: time.Now(),
+		pushWake: make(chan struct{}, 1)}
 	c.addr = conn.RemoteAddr().String()
+	if _, ok := netConn.(*net.UnixConn); ok {
+		// the clients of the socket have no address, like Redis
+		c.unix = true
+		c.addr = s.cfg.unixsocket + ":0"
+	}
+	c.lastTime.Store(c.created.UnixNano())
 	defer c.flushAOF()
 	s.mu.Lock()
-	s.clients[c] = true
+	if len(s.clients) >= s.cfg.maxclients {
+		s.statRejectedConn++
+		s.mu.Unlock()
+		c.replyError("max number of clients reached")
+		return
+	}
+	s.addClient(c)
+	setKeepAlive(netConn, s.cfg.tcpKeepalive)
+	s.statNumConnections++
 	c.db = s.selectDB(0)
 	s.mu.Unlock()
 	defer func() {
 		s.mu.Lock()
 		delete(s.clients, c)
 		delete(s.monitors, c)
+		s.unsubscribeAll(c)
+		c.unwatchAll()
+		c.unblock()
+		s.removeReplica(c)
 		s.mu.Unlock()
 	}()
+	// The pusher of a subscribed client writes the messages from publishers.
+	// The connection holds outMu while it runs a command and writes the
+	// reply, so the pusher writes between the replies.
+	var pushing, outLocked bool
+	pushDone, pushExited := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(pushDone)
+		if outLocked {
+			c.outMu.Unlock()
+		}
+		if pushing {
+			<-pushExited
+		}
+	}()
 	var flush bool
 	var err error
+	var next chan commandResult // a command that was read while blocked
 	for {
 		dbnum := c.db.num
 		c.errd = false
-		c.raw, c.args, flush, err = rd.readCommand()
+		s.mu.RLock()
+		c.setIdleDeadline()
+		s.mu.RUnlock()
+		if next != nil {
+			r := <-next
+			next = nil
+			c.raw, c.args, flush, err = r.raw, r.args, r.flush, r.err
+		} else {
+			c.raw, c.args, flush, err = rd.readCommand()
+		}
 		if err != nil {
-			if err, ok := err.(*protocolError); ok {
-				c.replyError(err.Error())
+			if perr, ok := err.(*protocolError); ok {
+				c.replyError(perr.Error())
+			} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				s.lverbosf("Closing idle client %s", c.addr)
 			}
 			return
 		}
 		if len(c.args) == 0 {
 			continue
 		}
+		c.outMu.Lock()
+		outLocked = true
+		c.lastTime.Store(time.Now().UnixNano())
+		if c.skipNext {
+			s.mu.Lock()
+			c.skipNext, c.skipping = false, true
+			c.updateReplies()
+			s.mu.Unlock()
+		}
 		commandName := autocase(c.args[0])
+		pubsub := c.subscribed()
 		if cmd, ok := s.cmds[commandName]; ok {
-			if c.authenticate(cmd) {
-				if cmd.write {
+			c.lastCmd.Store(cmd)
+			if pubsub && !cmd.pubsub && c.resp != 3 {
+				// RESP3 clients get the messages as pushes, so they may
+				// run any command while subscribed
+				c.replyError("only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+			} else if cmd.name == "script" && c.killScript() {
+				// handled without the lock, which a running script holds
+			} else if c.authenticate(cmd) && c.aclCheck(cmd) {
+				if c.multi && !cmd.multi {
+					// the queue is shown by CLIENT LIST
 					s.mu.Lock()
-				} else if cmd.read {
-					s.mu.RLock()
-				}
-				cmd.funct(c)
-				if c.dirty > 0 && cmd.aof {
-					c.db.aofbuf.Write(c.raw)
-				}
-
-				if cmd.write {
+					c.queueCommand(cmd)
 					s.mu.Unlock()
-				} else if cmd.read {
-					s.mu.RUnlock()
-				}
-				if !c.errd && cmd.name != "monitor" {
-					s.broadcastMonitors(dbnum, c.addr, c.args)
+				} else {
+					c.waitPause(cmd)
+					if cmd.write {
+						s.mu.Lock()
+					} else if cmd.read {
+						s.mu.RLock()
+					}
+					if cmd.write {
+						s.freeMemoryIfNeeded()
+					}
+					if c.call(cmd) {
+						if cmd.aof {
+							c.db.aofbuf.Write(c.raw)
+						}
+						s.serveBlocked()
+					}
+					blocked := c.blocked
+					if cmd.write {
+						s.mu.Unlock()
+					} else if cmd.read {
+						s.mu.RUnlock()
+					}
+					if !c.errd && cmd.name != "monitor" {
+						s.broadcastMonitors(dbnum, c.addr, c.args)
+					}
+					if blocked != nil {
+						if next, err = c.waitBlocked(blocked, rd, wr); err != nil {
+							return
+						}
+						c.lastTime.Store(time.Now().UnixNano())
+					}
 				}
 			}
 		} else {
 			switch commandName {
 			default:
 				c.replyError("unknown command '" + c.args[0] + "'")
+				if c.multi {
+					c.multiAbort = true
+				}
 			case "quit":
 				c.replyString("OK")
 				return
 			}
 		}
+		if c.skipping {
+			s.mu.Lock()
+			c.skipping = false
+			c.updateReplies()
+			s.mu.Unlock()
+		}
+		if c.closing {
+			// killed by CLIENT KILL, the reply is flushed on return
+			return
+		}
 		if flush {
 			if err := c.flushAOF(); err != nil {
 				return
@@ -556,6 +1035,12 @@ func handleConn(conn net.Conn, s *Server) {
 				return
 			}
 		}
+		c.outMu.Unlock()
+		outLocked = false
+		if !pushing && c.subscribed() {
+			pushing = true
+			go c.pushLoop(wr, pushDone, pushExited)
+		}
 	}
 }
 
@@ -595,6 +1080,10 @@ func bgrewriteaofCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
+	if c.s.aof == nil {
+		c.replyError("Background append only file rewriting can't run while appendonly is turned off")
+		return
+	}
 	if ok := c.s.rewriteAOF(); !ok {
 		c.replyError("Background append only file rewriting already in progress")
 		return
@@ -607,7 +1096,7 @@ func bgsaveCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
-	if ok := c.s.rewriteAOF(); !ok {
+	if ok := c.s.bgsaveRDB(); !ok {
 		c.replyError("Background save already in progress")
 		return
 	}
@@ -619,12 +1108,7 @@ func lastsaveCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
-	fi, err := c.s.aof.Stat()
-	if err != nil {
-		c.replyError("Could not get the UNIX timestamp")
-		return
-	}
-	c.replyInt(int(fi.ModTime().Unix()))
+	c.replyInt(int(c.s.lastsave.Unix()))
 }
 
 func saveCommand(c *client) {
@@ -632,22 +1116,14 @@ func saveCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
-	if !c.s.rewriteAOF() {
+	if c.s.rdbsaving {
 		c.replyError("Background save already in progress")
 		return
 	}
-	c.s.mu.Unlock()
-	t := time.NewTicker(time.Millisecond * 50)
-	defer t.Stop()
-	for range t.C {
-		c.s.mu.Lock()
-		res := c.s.aofrewrite
-		c.s.mu.Unlock()
-		if !res {
-			break
-		}
+	if err := c.s.saveRDB(); err != nil {
+		c.replyError(fmt.Sprintf("Failed saving the DB: %v", err))
+		return
 	}
-	c.s.mu.Lock()
 	c.replyString("OK")
 }
 
@@ -708,49 +1184,63 @@ func configCommand(c *client) {
 	}
 }
 func configGetCommand(c *client) {
-	if len(c.args) != 3 {
+	if len(c.args) < 3 {
 		c.replyError("Wrong number of arguments for CONFIG " + c.args[1])
 		return
 	}
-	switch c.args[2] {
-	default:
-		c.replyMultiBulkLen(0)
-		return
-	case "port", "bind", "protected-mode", "requirepass":
+	var matched []*directive
+	seen := make(map[*directive]bool)
+	for _, arg := range c.args[2:] {
+		p := parsePattern(strings.ToLower(arg))
+		for _, d := range directives {
+			if !seen[d] && p.match(d.name) {
+				seen[d] = true
+				matched = append(matched, d)
+			}
+		}
+	}
+	c.replyMapLen(len(matched))
+	for _, d := range matched {
+		c.replyBulk(d.name)
+		c.replyBulk(c.s.cfg.kvm[d.name])
 	}
-	c.replyMultiBulkLen(2)
-	c.replyBulk(c.args[2])
-	c.replyBulk(c.s.cfg.kvm[c.args[2]])
-
 }
 func configSetCommand(c *client) {
 	if len(c.args) != 4 {
 		c.replyError("Wrong number of arguments for CONFIG " + c.args[1])
 		return
 	}
-	switch strings.ToLower(c.args[2]) {
-	default:
+	d := lookupDirective(c.args[2])
+	if d == nil || !d.mutable {
 		c.replyError("Unsupported CONFIG parameter: " + c.args[2])
 		return
-	case "requirepass":
-		c.s.cfg.kvm["requirepass"] = c.args[3]
-		c.s.cfg.requirepass = c.args[3]
-	case "protected-mode":
-		switch strings.ToLower(c.args[3]) {
-		default:
-			c.replyError("Invalid argument '" + c.args[3] + "' for CONFIG SET '" + c.args[2] + "'")
+	}
+	v, val, ok := d.parse(c.args[3])
+	if !ok {
+		c.replyError("Invalid argument '" + c.args[3] + "' for CONFIG SET '" + c.args[2] + "'")
+		return
+	}
+	if d.check != nil {
+		if err := d.check(v); err != nil {
+			c.replyError(err.Error())
 			return
-		case "yes":
-			c.s.cfg.kvm["protected-mode"] = "yes"
-			c.s.cfg.protectedMode = true
-		case "no":
-			c.s.cfg.kvm["protected-mode"] = "no"
-			c.s.cfg.protectedMode = false
 		}
 	}
+	old := *c.s.cfg
+	d.set(c.s.cfg, val)
+	if d.apply != nil && !d.apply(c) {
+		*c.s.cfg = old
+		return
+	}
+	c.s.cfg.kvm[d.name] = v
 	c.replyString("OK")
 }
 func configResetStatCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyError("Wrong number of arguments for CONFIG " + c.args[1])
+		return
+	}
+	c.s.resetStats()
 	c.replyString("OK")
 }
 func configRewriteCommand(c *client) {
@@ -762,7 +1252,7 @@ func configRewriteCommand(c *client) {
 		c.replyError("The server is running without a config file")
 		return
 	}
-	if err := mergeConfigFile(c.s.cfg.file, c.s.cfg.kvm); err != nil {
+	if err := rewriteConfigFile(c.s.cfg.file, c.s.cfg.kvm); err != nil {
 		c.replyError(fmt.Sprintf("Rewriting config: %v", err))
 		return
 	}
@@ -770,14 +1260,25 @@ func configRewriteCommand(c *client) {
 }
 
 func authCommand(c *client) {
-	if len(c.args) != 2 {
+	if len(c.args) != 2 && len(c.args) != 3 {
 		c.replyAritryError()
 		return
 	}
-	if c.s.cfg.requirepass != c.args[1] {
-		c.replyError("invalid password")
+	name, pass := "default", c.args[1]
+	if len(c.args) == 3 {
+		name, pass = c.args[1], c.args[2]
+	} else if c.s.defaultNoPass() {
+		c.replyError("AUTH <password> called without any password " +
+			"configured for the default user. Are you sure your " +
+			"configuration is correct?")
+		return
+	}
+	u := c.s.aclAuth(name, pass)
+	if u == nil {
+		c.replyUniqueError("WRONGPASS invalid username-password pair or user is disabled.")
 		return
 	}
+	c.user.Store(u)
 	c.authd = 2
 	c.replyString("OK")
 }
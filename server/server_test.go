@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer is a server that runs on a free port, with its files in a
+// temporary directory, until the test ends.
+type testServer struct {
+	t          testing.TB
+	dir        string
+	dbfilename string // the snapshot file, in the working directory
+	conf       string // the config file, if any
+	args       []string
+	log        io.Writer // the log, which is discarded when nil
+	port       int
+	done       chan error // receives the error of Start
+}
+
+// testStartServer starts a server with the args, which are passed like
+// command line flags.
+func testStartServer(t testing.TB, args ...string) *testServer {
+	ts := &testServer{t: t, dir: t.TempDir(), args: args}
+	ts.start()
+	t.Cleanup(ts.shutdown)
+	return ts
+}
+
+func (ts *testServer) start() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.port = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if ts.dbfilename == "" {
+		ts.dbfilename = "test-" + strconv.Itoa(ts.port) + ".rdb"
+		ts.t.Cleanup(func() { os.Remove(ts.dbfilename) })
+	}
+	var args []string
+	if ts.conf != "" {
+		args = append(args, ts.conf)
+	}
+	args = append(args, "--port", strconv.Itoa(ts.port), "--dbfilename", ts.dbfilename)
+	args = append(args, ts.args...)
+	logw := ts.log
+	if logw == nil {
+		logw = ioutil.Discard
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Start(&Options{
+			Args:           args,
+			AppendOnlyPath: path.Join(ts.dir, "appendonly.aof"),
+			LogWriter:      logw,
+		})
+	}()
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		select {
+		case err := <-done:
+			ts.t.Fatalf("expected the server to start, got '%v'", err)
+		default:
+		}
+		conn, err := net.Dial("tcp", ts.addr())
+		if err == nil {
+			conn.Close()
+			ts.done = done
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.t.Fatalf("expected the server to start")
+}
+
+func (ts *testServer) addr() string {
+	return "127.0.0.1:" + strconv.Itoa(ts.port)
+}
+
+// shutdown stops the server without saving and waits for it to exit.
+func (ts *testServer) shutdown() {
+	if ts.done == nil {
+		return
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		// the server may still have the clients of the test, which are
+		// closed, when its maxclients is reached
+		if conn, err := net.Dial("tcp", ts.addr()); err == nil {
+			testWrapConn(ts.t, conn).do("SHUTDOWN", "NOSAVE")
+			conn.Close()
+		}
+		select {
+		case <-ts.done:
+			ts.done = nil
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Since(start) > 5*time.Second {
+			ts.t.Fatalf("expected the server to shutdown")
+		}
+	}
+}
+
+// restart restarts the server, which loads the data that it persisted.
+func (ts *testServer) restart() {
+	ts.shutdown()
+	ts.start()
+}
+
+// testConn is a client connection that formats the replies as strings.
+type testConn struct {
+	t    testing.TB
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (ts *testServer) dial() *testConn {
+	conn, err := net.Dial("tcp", ts.addr())
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	c := testWrapConn(ts.t, conn)
+	ts.t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+func testWrapConn(t testing.TB, conn net.Conn) *testConn {
+	return &testConn{t: t, conn: conn, rd: bufio.NewReader(conn)}
+}
+
+func (c *testConn) send(args ...string) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read reads a reply. Simple strings, errors and integers are returned as
+// they're sent, like "+OK" and ":1", bulk strings are returned as the
+// string, nulls as "(nil)", and aggregates as their type followed by the
+// elements, like "*[a,:1]". A read that fails returns "ERR:<error>".
+func (c *testConn) read() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return "ERR:" + err.Error()
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "ERR:empty line"
+	}
+	switch line[0] {
+	case '$', '=':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return "ERR:" + err.Error()
+		}
+		if line[0] == '=' {
+			return "=" + string(buf[:n])
+		}
+		return string(buf[:n])
+	case '*', '%', '~', '>':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		elems := make([]string, n)
+		for i := range elems {
+			elems[i] = c.read()
+		}
+		return line[:1] + "[" + strings.Join(elems, ",") + "]"
+	}
+	return line
+}
+
+func (c *testConn) do(args ...string) string {
+	c.send(args...)
+	return c.read()
+}
+
+func (c *testConn) expect(expect string, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); got != expect {
+		c.t.Fatalf("%v: expected '%v', got '%v'", strings.Join(args, " "), expect, got)
+	}
+}
+
+// wait runs the command until the reply is the expected one.
+func (c *testConn) wait(expect string, args ...string) {
+	c.t.Helper()
+	var got string
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if got = c.do(args...); got == expect {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("%v: expected '%v', got '%v'", strings.Join(args, " "), expect, got)
+}
+
+// rewriteAOF starts a rewrite of the aof and waits for it to finish.
+func (c *testConn) rewriteAOF() {
+	c.t.Helper()
+	c.expect("+Background append only file rewriting started", "BGREWRITEAOF")
+	c.waitInfo("persistence", "aof_rewrite_in_progress", "0")
+}
+
+// testInfoField returns the value of a field of an INFO reply.
+func testInfoField(info, name string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, name+":") {
+			return strings.TrimSpace(line[len(name)+1:])
+		}
+	}
+	return ""
+}
+
+// waitInfo waits for a field of an INFO section to be the expected value.
+func (c *testConn) waitInfo(section, name, expect string) {
+	c.t.Helper()
+	var got string
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if got = testInfoField(c.do("INFO", section), name); got == expect {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("%v: expected '%v', got '%v'", name, expect, got)
+}
+
+func testDialUnix(t testing.TB, sock string) *testConn {
+	var conn net.Conn
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if conn, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return testWrapConn(t, conn)
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := path.Join(t.TempDir(), "sider.sock")
+	// a stale file is replaced
+	if err := ioutil.WriteFile(sock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts := testStartServer(t, "--unixsocket", sock, "--unixsocketperm", "700")
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0700 {
+		t.Fatalf("expected a socket with the mode 0700, got '%v'", fi.Mode())
+	}
+	c := testDialUnix(t, sock)
+	c.expect("+OK", "SET", "k", "v")
+	ts.dial().expect("v", "GET", "k")
+	c.expect("*[unixsocket,"+sock+"]", "CONFIG", "GET", "unixsocket")
+	info := c.do("CLIENT", "INFO")
+	for name, expect := range map[string]string{
+		"addr": sock + ":0", "laddr": sock + ":0", "flags": "U",
+	} {
+		if got := testClientField(info, name); got != expect {
+			t.Fatalf("%v: expected '%v', got '%v'", name, expect, got)
+		}
+	}
+}
+
+func TestUnixSocketOnly(t *testing.T) {
+	dir := t.TempDir()
+	sock := path.Join(dir, "sider.sock")
+	done := make(chan error, 1)
+	go func() {
+		done <- Start(&Options{
+			Args:           []string{"--port", "0", "--unixsocket", sock},
+			AppendOnlyPath: path.Join(dir, "appendonly.aof"),
+			LogWriter:      ioutil.Discard,
+		})
+	}()
+
+	// protected mode doesn't apply to the socket
+	c := testDialUnix(t, sock)
+	c.expect("+PONG", "PING")
+	c.do("SHUTDOWN", "NOSAVE")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed, got '%v'", err)
+	}
+}
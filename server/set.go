@@ -1,19 +1,27 @@
 package server
 
-import "strconv"
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
 
 type set struct {
 	m map[string]bool
+	t scanTable // the members for SSCAN
 }
 
 func newSet() *set {
-	s := &set{make(map[string]bool)}
+	s := &set{m: make(map[string]bool)}
 	return s
 }
 
 func (s *set) add(member string) bool {
 	if !s.m[member] {
 		s.m[member] = true
+		s.t.add(member)
 		return true
 	}
 	return false
@@ -22,6 +30,7 @@ func (s *set) add(member string) bool {
 func (s *set) del(member string) bool {
 	if s.m[member] {
 		delete(s.m, member)
+		s.t.remove(member)
 		return true
 	}
 	return false
@@ -46,7 +55,7 @@ func (s1 *set) diff(s2 *set) *set {
 			}
 		}
 		if !found {
-			s3.m[v1] = true
+			s3.add(v1)
 		}
 	}
 	return s3
@@ -63,7 +72,7 @@ func (s1 *set) inter(s2 *set) *set {
 			}
 		}
 		if found {
-			s3.m[v1] = true
+			s3.add(v1)
 		}
 	}
 	return s3
@@ -72,10 +81,10 @@ func (s1 *set) inter(s2 *set) *set {
 func (s1 *set) union(s2 *set) *set {
 	s3 := newSet()
 	for v := range s1.m {
-		s3.m[v] = true
+		s3.add(v)
 	}
 	for v := range s2.m {
-		s3.m[v] = true
+		s3.add(v)
 	}
 	return s3
 }
@@ -102,7 +111,7 @@ func (s *set) popRand(count int, pop bool) []string {
 				break
 			}
 			if pop {
-				delete(s.m, key)
+				s.del(key)
 			}
 			res = append(res, key)
 			count--
@@ -200,10 +209,10 @@ func smembersCommand(c *client) {
 		return
 	}
 	if st == nil {
-		c.replyMultiBulkLen(0)
+		c.replySetLen(0)
 		return
 	}
-	c.replyMultiBulkLen(st.len())
+	c.replySetLen(st.len())
 	st.ascend(func(s string) bool {
 		c.replyBulk(s)
 		return true
@@ -280,10 +289,10 @@ func sdiffinterunionGenericCommand(c *client, diff, union bool, store bool) {
 		}
 	} else {
 		if st == nil {
-			c.replyMultiBulkLen(0)
+			c.replySetLen(0)
 			return
 		}
-		c.replyMultiBulkLen(st.len())
+		c.replySetLen(st.len())
 		st.ascend(func(s string) bool {
 			c.replyBulk(s)
 			return true
@@ -335,7 +344,9 @@ func srandmemberpopGenericCommand(c *client, pop bool) {
 		return
 	}
 	if st == nil {
-		if countSpecified {
+		if countSpecified && pop {
+			c.replySetLen(0)
+		} else if countSpecified {
 			c.replyMultiBulkLen(0)
 		} else {
 			c.replyNull()
@@ -349,7 +360,9 @@ func srandmemberpopGenericCommand(c *client, pop bool) {
 	} else {
 		res = st.rand(count)
 	}
-	if countSpecified {
+	if countSpecified && pop {
+		c.replySetLen(len(res))
+	} else if countSpecified {
 		c.replyMultiBulkLen(len(res))
 	} else if len(res) == 0 {
 		c.replyNull()
@@ -435,3 +448,1164 @@ func smoveCommand(c *client) {
 	c.replyInt(1)
 	c.dirty++
 }
+
+const (
+	zsetMaxLevel = 32
+	zsetP        = 0.25
+)
+
+type zsetLevel struct {
+	forward *zsetNode
+	span    int
+}
+
+type zsetNode struct {
+	member   string
+	score    float64
+	backward *zsetNode
+	level    []zsetLevel
+}
+
+// zset is a sorted set. Members are ordered by score, and then by member for
+// equal scores, using a skiplist which tracks the span of each link so that
+// rank lookups don't need to walk the entire list. The map provides a quick
+// score lookup by member.
+type zset struct {
+	m      map[string]float64
+	header *zsetNode
+	tail   *zsetNode
+	length int
+	level  int
+}
+
+func newZSet() *zset {
+	return &zset{
+		m:      make(map[string]float64),
+		header: &zsetNode{level: make([]zsetLevel, zsetMaxLevel)},
+		level:  1,
+	}
+}
+
+func zsetRandomLevel() int {
+	level := 1
+	for level < zsetMaxLevel && rand.Float64() < zsetP {
+		level++
+	}
+	return level
+}
+
+// zsetLess returns true if the score/member pair a is ordered before b.
+func zsetLess(ascore float64, amember string, bscore float64, bmember string) bool {
+	return ascore < bscore || (ascore == bscore && amember < bmember)
+}
+
+func (z *zset) insert(member string, score float64) {
+	var update [zsetMaxLevel]*zsetNode
+	var rank [zsetMaxLevel]int
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		if i != z.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil &&
+			zsetLess(x.level[i].forward.score, x.level[i].forward.member,
+				score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := zsetRandomLevel()
+	if level > z.level {
+		for i := z.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = z.header
+			update[i].level[i].span = z.length
+		}
+		z.level = level
+	}
+	x = &zsetNode{member: member, score: score, level: make([]zsetLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+	for i := level; i < z.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != z.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		z.tail = x
+	}
+	z.length++
+}
+
+func (z *zset) remove(member string, score float64) {
+	var update [zsetMaxLevel]*zsetNode
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			zsetLess(x.level[i].forward.score, x.level[i].forward.member,
+				score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return
+	}
+	for i := 0; i < z.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		z.tail = x.backward
+	}
+	for z.level > 1 && z.header.level[z.level-1].forward == nil {
+		z.level--
+	}
+	z.length--
+}
+
+// add sets the score of a member. Returns true if the member is new.
+func (z *zset) add(member string, score float64) bool {
+	if old, ok := z.m[member]; ok {
+		if old != score {
+			z.remove(member, old)
+			z.insert(member, score)
+			z.m[member] = score
+		}
+		return false
+	}
+	z.insert(member, score)
+	z.m[member] = score
+	return true
+}
+
+func (z *zset) del(member string) bool {
+	score, ok := z.m[member]
+	if !ok {
+		return false
+	}
+	z.remove(member, score)
+	delete(z.m, member)
+	return true
+}
+
+func (z *zset) score(member string) (float64, bool) {
+	score, ok := z.m[member]
+	return score, ok
+}
+
+func (z *zset) len() int {
+	return z.length
+}
+
+// rank returns the zero-based rank of the member.
+func (z *zset) rank(member string, reverse bool) (int, bool) {
+	score, ok := z.m[member]
+	if !ok {
+		return 0, false
+	}
+	rank := 0
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			!zsetLess(score, member, x.level[i].forward.score,
+				x.level[i].forward.member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+	}
+	if reverse {
+		return z.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// byRank returns the node at the zero-based rank.
+func (z *zset) byRank(rank int) *zsetNode {
+	rank++
+	traversed := 0
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// rangeByRank iterates over the members between the zero-based start and
+// stop ranks, inclusive. Negative ranks are resolved from the end.
+func (z *zset) rangeByRank(start, stop int, reverse bool,
+	iterator func(member string, score float64) bool) {
+	if start < 0 {
+		start = z.length + start
+	}
+	if stop < 0 {
+		stop = z.length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= z.length {
+		return
+	}
+	if stop >= z.length {
+		stop = z.length - 1
+	}
+	var x *zsetNode
+	if reverse {
+		x = z.byRank(z.length - 1 - start)
+	} else {
+		x = z.byRank(start)
+	}
+	for n := stop - start + 1; n > 0 && x != nil; n-- {
+		if !iterator(x.member, x.score) {
+			return
+		}
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+}
+
+// zscoreRange is a parsed min/max score range such as "(1 +inf".
+type zscoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func parseScoreBound(s string) (float64, bool, bool) {
+	var ex bool
+	if strings.HasPrefix(s, "(") {
+		ex = true
+		s = s[1:]
+	}
+	n, err := parseScore(s)
+	if err != nil {
+		return 0, false, false
+	}
+	return n, ex, true
+}
+
+func parseScoreRange(min, max string) (*zscoreRange, bool) {
+	var r zscoreRange
+	var ok bool
+	if r.min, r.minex, ok = parseScoreBound(min); !ok {
+		return nil, false
+	}
+	if r.max, r.maxex, ok = parseScoreBound(max); !ok {
+		return nil, false
+	}
+	return &r, true
+}
+
+func (r *zscoreRange) gteMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r *zscoreRange) lteMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+// zlexRange is a parsed min/max lex range such as "[a (c", where "-" and "+"
+// are the smallest and largest possible strings.
+type zlexRange struct {
+	min, max       string
+	minex, maxex   bool
+	mininf, maxinf int // -1 for "-", 1 for "+"
+}
+
+func parseLexBound(s string) (value string, ex bool, inf int, ok bool) {
+	switch {
+	case s == "-":
+		return "", false, -1, true
+	case s == "+":
+		return "", false, 1, true
+	case strings.HasPrefix(s, "("):
+		return s[1:], true, 0, true
+	case strings.HasPrefix(s, "["):
+		return s[1:], false, 0, true
+	}
+	return "", false, 0, false
+}
+
+func parseLexRange(min, max string) (*zlexRange, bool) {
+	var r zlexRange
+	var ok bool
+	if r.min, r.minex, r.mininf, ok = parseLexBound(min); !ok {
+		return nil, false
+	}
+	if r.max, r.maxex, r.maxinf, ok = parseLexBound(max); !ok {
+		return nil, false
+	}
+	return &r, true
+}
+
+func (r *zlexRange) gteMin(member string) bool {
+	switch r.mininf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	if r.minex {
+		return member > r.min
+	}
+	return member >= r.min
+}
+
+func (r *zlexRange) lteMax(member string) bool {
+	switch r.maxinf {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	if r.maxex {
+		return member < r.max
+	}
+	return member <= r.max
+}
+
+// rangeByFunc iterates over the members that are between gteMin and lteMax.
+// It's used for both the score and lex ranges.
+func (z *zset) rangeByFunc(gteMin, lteMax func(x *zsetNode) bool, reverse bool,
+	iterator func(member string, score float64) bool) {
+	x := z.header
+	if reverse {
+		for i := z.level - 1; i >= 0; i-- {
+			for x.level[i].forward != nil && lteMax(x.level[i].forward) {
+				x = x.level[i].forward
+			}
+		}
+		for x != nil && x != z.header && gteMin(x) {
+			if !iterator(x.member, x.score) {
+				return
+			}
+			x = x.backward
+		}
+		return
+	}
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !gteMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	for x != nil && lteMax(x) {
+		if !iterator(x.member, x.score) {
+			return
+		}
+		x = x.level[0].forward
+	}
+}
+
+func (z *zset) rangeByScore(r *zscoreRange, reverse bool,
+	iterator func(member string, score float64) bool) {
+	z.rangeByFunc(
+		func(x *zsetNode) bool { return r.gteMin(x.score) },
+		func(x *zsetNode) bool { return r.lteMax(x.score) },
+		reverse, iterator)
+}
+
+func (z *zset) rangeByLex(r *zlexRange, reverse bool,
+	iterator func(member string, score float64) bool) {
+	z.rangeByFunc(
+		func(x *zsetNode) bool { return r.gteMin(x.member) },
+		func(x *zsetNode) bool { return r.lteMax(x.member) },
+		reverse, iterator)
+}
+
+func (z *zset) ascend(iterator func(member string, score float64) bool) {
+	x := z.header.level[0].forward
+	for x != nil {
+		if !iterator(x.member, x.score) {
+			return
+		}
+		x = x.level[0].forward
+	}
+}
+
+func (z *zset) strArr() []string {
+	i := 0
+	arr := make([]string, z.length)
+	z.ascend(func(member string, score float64) bool {
+		arr[i] = member
+		i++
+		return true
+	})
+	return arr
+}
+
+func parseScore(s string) (float64, error) {
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(n) {
+		return 0, errors.New("invalid float")
+	}
+	return n, nil
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func (c *client) replyFloatError() {
+	c.replyError("value is not a valid float")
+}
+
+type zsetResult struct {
+	member string
+	score  float64
+}
+
+// replyZSetResults replies with the members, and with the scores when
+// withscores is set. The members and the scores are pairs in RESP3.
+func replyZSetResults(c *client, res []zsetResult, withscores bool) {
+	if withscores && c.resp != 3 {
+		c.replyMultiBulkLen(len(res) * 2)
+	} else {
+		c.replyMultiBulkLen(len(res))
+	}
+	for _, r := range res {
+		if withscores && c.resp == 3 {
+			c.replyMultiBulkLen(2)
+		}
+		c.replyBulk(r.member)
+		if withscores {
+			c.replyDouble(r.score)
+		}
+	}
+}
+
+func zaddCommand(c *client) {
+	if len(c.args) < 4 {
+		c.replyAritryError()
+		return
+	}
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+	for ; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			goto scores
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		case "ch":
+			ch = true
+		case "incr":
+			incr = true
+		}
+	}
+scores:
+	if len(c.args)-i == 0 || (len(c.args)-i)%2 != 0 {
+		c.replySyntaxError()
+		return
+	}
+	if nx && xx {
+		c.replyError("XX and NX options at the same time are not compatible")
+		return
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		c.replyError("GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	if incr && len(c.args)-i != 2 {
+		c.replyError("INCR option supports a single increment-element pair")
+		return
+	}
+	scores := make([]float64, 0, (len(c.args)-i)/2)
+	for j := i; j < len(c.args); j += 2 {
+		score, err := parseScore(c.args[j])
+		if err != nil {
+			c.replyFloatError()
+			return
+		}
+		scores = append(scores, score)
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		if xx {
+			if incr {
+				c.replyNull()
+			} else {
+				c.replyInt(0)
+			}
+			return
+		}
+		z = newZSet()
+		c.db.set(c.args[1], z)
+	}
+	var added, changed int
+	var incrScore float64
+	var incrOK bool
+	for j, score := range scores {
+		member := c.args[i+j*2+1]
+		old, exists := z.score(member)
+		if (exists && nx) || (!exists && xx) {
+			continue
+		}
+		if incr && exists {
+			score += old
+			if math.IsNaN(score) {
+				c.replyError("resulting score is not a number (NaN)")
+				return
+			}
+		}
+		if exists && ((gt && score <= old) || (lt && score >= old)) {
+			continue
+		}
+		incrScore, incrOK = score, true
+		if !exists {
+			added++
+		} else if score != old {
+			changed++
+		}
+		z.add(member, score)
+	}
+	if z.len() == 0 {
+		c.db.del(c.args[1])
+	}
+	c.dirty += added + changed
+	if incr {
+		if incrOK {
+			c.replyDouble(incrScore)
+		} else {
+			c.replyNull()
+		}
+		return
+	}
+	if ch {
+		c.replyInt(added + changed)
+	} else {
+		c.replyInt(added)
+	}
+}
+
+func zincrbyCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	delta, err := parseScore(c.args[2])
+	if err != nil {
+		c.replyFloatError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], true)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	score, _ := z.score(c.args[3])
+	score += delta
+	if math.IsNaN(score) {
+		c.replyError("resulting score is not a number (NaN)")
+		return
+	}
+	z.add(c.args[3], score)
+	c.replyDouble(score)
+	c.dirty++
+}
+
+func zcardCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyInt(0)
+		return
+	}
+	c.replyInt(z.len())
+}
+
+func zscoreCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyNull()
+		return
+	}
+	score, ok := z.score(c.args[2])
+	if !ok {
+		c.replyNull()
+		return
+	}
+	c.replyDouble(score)
+}
+
+func zremCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyInt(0)
+		return
+	}
+	var count int
+	for i := 2; i < len(c.args); i++ {
+		if z.del(c.args[i]) {
+			count++
+			c.dirty++
+		}
+	}
+	if z.len() == 0 {
+		c.db.del(c.args[1])
+	}
+	c.replyInt(count)
+}
+
+func zrankGenericCommand(c *client, reverse bool) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyNull()
+		return
+	}
+	rank, ok := z.rank(c.args[2], reverse)
+	if !ok {
+		c.replyNull()
+		return
+	}
+	c.replyInt(rank)
+}
+
+func zrankCommand(c *client) {
+	zrankGenericCommand(c, false)
+}
+
+func zrevrankCommand(c *client) {
+	zrankGenericCommand(c, true)
+}
+
+func zrangeGenericCommand(c *client, reverse bool) {
+	if len(c.args) != 4 && len(c.args) != 5 {
+		c.replyAritryError()
+		return
+	}
+	withscores := false
+	if len(c.args) == 5 {
+		if strings.ToLower(c.args[4]) != "withscores" {
+			c.replySyntaxError()
+			return
+		}
+		withscores = true
+	}
+	start, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	stop, err := strconv.ParseInt(c.args[3], 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var res []zsetResult
+	if z != nil {
+		z.rangeByRank(int(start), int(stop), reverse,
+			func(member string, score float64) bool {
+				res = append(res, zsetResult{member, score})
+				return true
+			})
+	}
+	replyZSetResults(c, res, withscores)
+}
+
+func zrangeCommand(c *client) {
+	zrangeGenericCommand(c, false)
+}
+
+func zrevrangeCommand(c *client) {
+	zrangeGenericCommand(c, true)
+}
+
+// zrangebyGenericCommand handles ZRANGEBYSCORE, ZREVRANGEBYSCORE, ZRANGEBYLEX
+// and ZREVRANGEBYLEX. The reverse variants take max before min.
+func zrangebyGenericCommand(c *client, lex, reverse bool) {
+	if len(c.args) < 4 {
+		c.replyAritryError()
+		return
+	}
+	min, max := c.args[2], c.args[3]
+	if reverse {
+		min, max = max, min
+	}
+	withscores := false
+	limit := false
+	offset, count := 0, -1
+	for i := 4; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replySyntaxError()
+			return
+		case "withscores":
+			if lex {
+				c.replySyntaxError()
+				return
+			}
+			withscores = true
+		case "limit":
+			if i+2 >= len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			n1, err1 := strconv.ParseInt(c.args[i+1], 10, 64)
+			n2, err2 := strconv.ParseInt(c.args[i+2], 10, 64)
+			if err1 != nil || err2 != nil {
+				c.replyInvalidIntError()
+				return
+			}
+			offset, count = int(n1), int(n2)
+			limit = true
+			i += 2
+		}
+	}
+	var sr *zscoreRange
+	var lr *zlexRange
+	var ok bool
+	if lex {
+		if lr, ok = parseLexRange(min, max); !ok {
+			c.replyError("min or max not valid string range item")
+			return
+		}
+	} else {
+		if sr, ok = parseScoreRange(min, max); !ok {
+			c.replyError("min or max is not a float")
+			return
+		}
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var res []zsetResult
+	if z != nil && !(limit && offset < 0) {
+		iterator := func(member string, score float64) bool {
+			if offset > 0 {
+				offset--
+				return true
+			}
+			if count == 0 {
+				return false
+			}
+			res = append(res, zsetResult{member, score})
+			if count > 0 {
+				count--
+			}
+			return true
+		}
+		if lex {
+			z.rangeByLex(lr, reverse, iterator)
+		} else {
+			z.rangeByScore(sr, reverse, iterator)
+		}
+	}
+	replyZSetResults(c, res, withscores)
+}
+
+func zrangebyscoreCommand(c *client) {
+	zrangebyGenericCommand(c, false, false)
+}
+
+func zrevrangebyscoreCommand(c *client) {
+	zrangebyGenericCommand(c, false, true)
+}
+
+func zrangebylexCommand(c *client) {
+	zrangebyGenericCommand(c, true, false)
+}
+
+func zrevrangebylexCommand(c *client) {
+	zrangebyGenericCommand(c, true, true)
+}
+
+func zcountGenericCommand(c *client, lex bool) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	var sr *zscoreRange
+	var lr *zlexRange
+	var ok bool
+	if lex {
+		if lr, ok = parseLexRange(c.args[2], c.args[3]); !ok {
+			c.replyError("min or max not valid string range item")
+			return
+		}
+	} else {
+		if sr, ok = parseScoreRange(c.args[2], c.args[3]); !ok {
+			c.replyError("min or max is not a float")
+			return
+		}
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var count int
+	if z != nil {
+		iterator := func(member string, score float64) bool {
+			count++
+			return true
+		}
+		if lex {
+			z.rangeByLex(lr, false, iterator)
+		} else {
+			z.rangeByScore(sr, false, iterator)
+		}
+	}
+	c.replyInt(count)
+}
+
+func zcountCommand(c *client) {
+	zcountGenericCommand(c, false)
+}
+
+func zlexcountCommand(c *client) {
+	zcountGenericCommand(c, true)
+}
+
+// zremrangeGenericCommand handles ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX. The kind param is one of "rank", "score" or "lex".
+func zremrangeGenericCommand(c *client, kind string) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	var start, stop int64
+	var sr *zscoreRange
+	var lr *zlexRange
+	var ok bool
+	switch kind {
+	case "rank":
+		var err1, err2 error
+		start, err1 = strconv.ParseInt(c.args[2], 10, 64)
+		stop, err2 = strconv.ParseInt(c.args[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			c.replyInvalidIntError()
+			return
+		}
+	case "score":
+		if sr, ok = parseScoreRange(c.args[2], c.args[3]); !ok {
+			c.replyError("min or max is not a float")
+			return
+		}
+	case "lex":
+		if lr, ok = parseLexRange(c.args[2], c.args[3]); !ok {
+			c.replyError("min or max not valid string range item")
+			return
+		}
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyInt(0)
+		return
+	}
+	var members []string
+	iterator := func(member string, score float64) bool {
+		members = append(members, member)
+		return true
+	}
+	switch kind {
+	case "rank":
+		z.rangeByRank(int(start), int(stop), false, iterator)
+	case "score":
+		z.rangeByScore(sr, false, iterator)
+	case "lex":
+		z.rangeByLex(lr, false, iterator)
+	}
+	for _, member := range members {
+		z.del(member)
+	}
+	if z.len() == 0 {
+		c.db.del(c.args[1])
+	}
+	c.dirty += len(members)
+	c.replyInt(len(members))
+}
+
+func zremrangebyrankCommand(c *client) {
+	zremrangeGenericCommand(c, "rank")
+}
+
+func zremrangebyscoreCommand(c *client) {
+	zremrangeGenericCommand(c, "score")
+}
+
+func zremrangebylexCommand(c *client) {
+	zremrangeGenericCommand(c, "lex")
+}
+
+// zunioninterGenericCommand handles ZUNIONSTORE and ZINTERSTORE. Plain sets
+// are accepted as inputs, where each member has a score of 1.
+func zunioninterGenericCommand(c *client, union bool) {
+	if len(c.args) < 4 {
+		c.replyAritryError()
+		return
+	}
+	numkeys, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	if numkeys < 1 {
+		c.replyError("at least 1 input key is needed for " +
+			strings.ToUpper(c.args[0]) + "/store")
+		return
+	}
+	if int(numkeys) > len(c.args)-3 {
+		c.replySyntaxError()
+		return
+	}
+	keys := c.args[3 : 3+numkeys]
+	weights := make([]float64, len(keys))
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "sum"
+	for i := 3 + int(numkeys); i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replySyntaxError()
+			return
+		case "weights":
+			if i+len(keys) >= len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			for j := range weights {
+				i++
+				weights[j], err = parseScore(c.args[i])
+				if err != nil {
+					c.replyError("weight value is not a float")
+					return
+				}
+			}
+		case "aggregate":
+			if i+1 >= len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			i++
+			aggregate = strings.ToLower(c.args[i])
+			switch aggregate {
+			default:
+				c.replySyntaxError()
+				return
+			case "sum", "min", "max":
+			}
+		}
+	}
+	// collect the inputs before changing anything
+	inputs := make([]map[string]float64, len(keys))
+	for i, key := range keys {
+		value, ok := c.db.get(key)
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		default:
+			c.replyTypeError()
+			return
+		case *zset:
+			inputs[i] = v.m
+		case *set:
+			m := make(map[string]float64, v.len())
+			v.ascend(func(member string) bool {
+				m[member] = 1
+				return true
+			})
+			inputs[i] = m
+		}
+	}
+	agg := func(a, b float64) float64 {
+		switch aggregate {
+		case "min":
+			return math.Min(a, b)
+		case "max":
+			return math.Max(a, b)
+		}
+		n := a + b
+		if math.IsNaN(n) {
+			return 0
+		}
+		return n
+	}
+	weigh := func(score, weight float64) float64 {
+		n := score * weight
+		if math.IsNaN(n) {
+			return 0
+		}
+		return n
+	}
+	res := make(map[string]float64)
+	if union {
+		for i, m := range inputs {
+			for member, score := range m {
+				score = weigh(score, weights[i])
+				if cur, ok := res[member]; ok {
+					res[member] = agg(cur, score)
+				} else {
+					res[member] = score
+				}
+			}
+		}
+	} else if inputs[0] != nil {
+	nextmember:
+		for member, score := range inputs[0] {
+			score = weigh(score, weights[0])
+			for i := 1; i < len(inputs); i++ {
+				other, ok := inputs[i][member]
+				if !ok {
+					continue nextmember
+				}
+				score = agg(score, weigh(other, weights[i]))
+			}
+			res[member] = score
+		}
+	}
+	if len(res) == 0 {
+		if _, ok := c.db.del(c.args[1]); ok {
+			c.dirty++
+		}
+		c.replyInt(0)
+		return
+	}
+	z := newZSet()
+	for member, score := range res {
+		z.add(member, score)
+	}
+	c.db.set(c.args[1], z)
+	c.dirty++
+	c.replyInt(z.len())
+}
+
+// zstoreKeys returns the destination and the numkeys source keys of
+// ZUNIONSTORE and ZINTERSTORE.
+func zstoreKeys(args []string) ([]string, bool) {
+	if len(args) < 3 {
+		return args[1:], true
+	}
+	numkeys, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || numkeys < 1 || int(numkeys) > len(args)-3 {
+		// the command fails, the keys can't be known
+		return []string{args[1]}, false
+	}
+	return append([]string{args[1]}, args[3:3+numkeys]...), true
+}
+
+func zunionstoreCommand(c *client) {
+	zunioninterGenericCommand(c, true)
+}
+
+func zinterstoreCommand(c *client) {
+	zunioninterGenericCommand(c, false)
+}
+
+func sscanCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	opts, ok := c.parseScanArgs(2, false)
+	if !ok {
+		return
+	}
+	value, ok := c.db.peek(c.args[1])
+	if !ok {
+		c.replyScan(0, nil)
+		return
+	}
+	st, ok := value.(*set)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var members []string
+	cursor := st.t.scan(opts.cursor, opts.count, func(member string) {
+		if opts.pattern.match(member) {
+			members = append(members, member)
+		}
+	})
+	c.replyScan(cursor, members)
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// slowlogMaxArgs is the number of arguments that are kept in an entry.
+	slowlogMaxArgs = 32
+	// slowlogMaxString is the number of bytes that are kept of an argument.
+	slowlogMaxString = 128
+)
+
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+}
+
+// slowlog keeps the commands that ran longer than slowlog-log-slower-than.
+// Commands run concurrently, some without the server lock, so it has its own
+// lock and its own copy of the settings.
+type slowlog struct {
+	mu      sync.Mutex
+	entries []slowlogEntry // the newest entry first
+	nextID  int64
+	slower  int64 // slowlog-log-slower-than
+	maxLen  int   // slowlog-max-len
+}
+
+// configure copies the settings of cfg, and trims the entries for the new
+// slowlog-max-len.
+func (sl *slowlog) configure(cfg *config) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.slower = cfg.slowlogLogSlowerThan
+	sl.maxLen = cfg.slowlogMaxLen
+	sl.trim(sl.maxLen)
+}
+
+// slowlogArgs copies the arguments of a command for an entry, keeping at
+// most slowlogMaxArgs arguments of slowlogMaxString bytes, like Redis.
+func slowlogArgs(args []string) []string {
+	n := len(args)
+	if n > slowlogMaxArgs {
+		n = slowlogMaxArgs
+	}
+	sargs := make([]string, n)
+	for i := 0; i < n; i++ {
+		if i == slowlogMaxArgs-1 && len(args) > slowlogMaxArgs {
+			sargs[i] = fmt.Sprintf("... (%d more arguments)", len(args)-i)
+		} else if len(args[i]) > slowlogMaxString {
+			sargs[i] = args[i][:slowlogMaxString] +
+				fmt.Sprintf("... (%d more bytes)", len(args[i])-slowlogMaxString)
+		} else {
+			sargs[i] = string(append([]byte(nil), args[i]...))
+		}
+	}
+	return sargs
+}
+
+// slowlogRedact returns the arguments with the passwords hidden, like Redis.
+// The arguments aren't changed.
+func slowlogRedact(args []string) []string {
+	var redacted []string
+	redact := func(i int) {
+		if i < len(args) {
+			if redacted == nil {
+				redacted = append([]string(nil), args...)
+			}
+			redacted[i] = "(redacted)"
+		}
+	}
+	switch strings.ToLower(args[0]) {
+	case "auth":
+		for i := 1; i < len(args); i++ {
+			redact(i)
+		}
+	case "hello":
+		// HELLO protover AUTH username password SETNAME name
+		for i := 2; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "auth":
+				redact(i + 2)
+				i += 2
+			case "setname":
+				i++
+			}
+		}
+	case "acl":
+		if len(args) > 2 && strings.ToLower(args[1]) == "setuser" {
+			// the name and the rules
+			for i := 2; i < len(args); i++ {
+				redact(i)
+			}
+		}
+	case "config":
+		if len(args) > 3 && strings.ToLower(args[1]) == "set" &&
+			strings.ToLower(args[2]) == "requirepass" {
+			redact(3)
+		}
+	}
+	if redacted == nil {
+		return args
+	}
+	return redacted
+}
+
+// slowlogPush adds the command of the client to the slowlog when it ran
+// longer than slowlog-log-slower-than.
+func (c *client) slowlogPush(duration time.Duration) {
+	sl := &c.s.slowlog
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.slower < 0 || duration < time.Duration(sl.slower)*time.Microsecond {
+		return
+	}
+	entry := slowlogEntry{
+		id:       sl.nextID,
+		time:     time.Now(),
+		duration: duration,
+		args:     slowlogArgs(slowlogRedact(c.args)),
+		addr:     c.addr,
+		name:     c.name,
+	}
+	sl.nextID++
+	sl.entries = append(sl.entries, slowlogEntry{})
+	copy(sl.entries[1:], sl.entries)
+	sl.entries[0] = entry
+	sl.trim(sl.maxLen)
+}
+
+// trim removes the oldest entries to keep at most n entries. The caller must
+// hold the slowlog lock.
+func (sl *slowlog) trim(n int) {
+	if len(sl.entries) > n {
+		for i := n; i < len(sl.entries); i++ {
+			sl.entries[i] = slowlogEntry{}
+		}
+		sl.entries = sl.entries[:n]
+	}
+}
+
+func slowlogCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	sl := &c.s.slowlog
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("SLOWLOG subcommand must be one of GET, LEN, RESET")
+	case "get":
+		if len(c.args) > 3 {
+			c.replyError("Wrong number of arguments for SLOWLOG " + c.args[1])
+			return
+		}
+		count := 10
+		if len(c.args) == 3 {
+			n, err := strconv.Atoi(c.args[2])
+			if err != nil {
+				c.replyInvalidIntError()
+				return
+			}
+			if n < -1 {
+				c.replyError("count should be greater than or equal to -1")
+				return
+			}
+			count = n
+		}
+		sl.mu.Lock()
+		defer sl.mu.Unlock()
+		if count == -1 || count > len(sl.entries) {
+			count = len(sl.entries)
+		}
+		c.replyMultiBulkLen(count)
+		for _, entry := range sl.entries[:count] {
+			c.replyMultiBulkLen(6)
+			c.replyInt(int(entry.id))
+			c.replyInt(int(entry.time.Unix()))
+			c.replyInt(int(entry.duration / time.Microsecond))
+			c.replyMultiBulkLen(len(entry.args))
+			for _, arg := range entry.args {
+				c.replyBulk(arg)
+			}
+			c.replyBulk(entry.addr)
+			c.replyBulk(entry.name)
+		}
+	case "len":
+		if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for SLOWLOG " + c.args[1])
+			return
+		}
+		sl.mu.Lock()
+		defer sl.mu.Unlock()
+		c.replyInt(len(sl.entries))
+	case "reset":
+		if len(c.args) != 2 {
+			c.replyError("Wrong number of arguments for SLOWLOG " + c.args[1])
+			return
+		}
+		sl.mu.Lock()
+		defer sl.mu.Unlock()
+		sl.entries = nil
+		c.replyString("OK")
+	}
+}
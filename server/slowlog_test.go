@@ -0,0 +1,87 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlowlog(t *testing.T) {
+	ts := testStartServer(t, "--slowlog-log-slower-than", "0", "--slowlog-max-len", "3")
+	c := ts.dial()
+	c.expect("*[slowlog-log-slower-than,0]", "CONFIG", "GET", "slowlog-log-slower-than")
+	c.expect("+OK", "SLOWLOG", "RESET")
+	c.expect("+OK", "SET", "a", strings.Repeat("x", 200))
+	args := []string{"DEL"}
+	for i := 0; i < 40; i++ {
+		args = append(args, "k")
+	}
+	c.expect(":0", args...)
+
+	// the long arguments and the many arguments are cut
+	got := c.do("SLOWLOG", "GET")
+	for _, expect := range []string{
+		"*[*[:3,",
+		"*[DEL,k,k,",
+		",... (10 more arguments)],",
+		"*[SET,a," + strings.Repeat("x", 128) + "... (72 more bytes)]",
+		",127.0.0.1:",
+	} {
+		if !strings.Contains(got, expect) {
+			t.Fatalf("expected '%v' in '%v'", expect, got)
+		}
+	}
+	c.expect(":3", "SLOWLOG", "LEN")
+	c.expect("+OK", "CONFIG", "SET", "slowlog-max-len", "1")
+	c.expect(":1", "SLOWLOG", "LEN")
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "PING")
+	c.expect("*[+PONG]", "EXEC")
+	if got := c.do("SLOWLOG", "GET", "-1"); !strings.Contains(got, "*[EXEC]") {
+		t.Fatalf("expected '%v' in '%v'", "*[EXEC]", got)
+	}
+	c.expect("-ERR count should be greater than or equal to -1", "SLOWLOG", "GET", "-2")
+	c.expect("+OK", "CONFIG", "SET", "slowlog-log-slower-than", "-1")
+	c.expect("+OK", "SLOWLOG", "RESET")
+	c.expect("+PONG", "PING")
+	c.expect(":0", "SLOWLOG", "LEN")
+	c.expect("+OK", "CONFIG", "SET", "slowlog-log-slower-than", "1000000")
+	c.expect("+PONG", "PING")
+	c.expect(":0", "SLOWLOG", "LEN")
+	c.expect("-ERR SLOWLOG subcommand must be one of GET, LEN, RESET", "SLOWLOG", "x")
+}
+
+func TestSlowlogRedact(t *testing.T) {
+	for _, tt := range []struct {
+		args   string
+		expect string
+	}{
+		{"GET secret", "GET secret"},
+		{"AUTH secret", "AUTH (redacted)"},
+		{"auth user secret", "auth (redacted) (redacted)"},
+		{"CONFIG SET requirepass secret", "CONFIG SET requirepass (redacted)"},
+		{"CONFIG SET maxmemory 1", "CONFIG SET maxmemory 1"},
+		{"HELLO 3 AUTH user secret", "HELLO 3 AUTH user (redacted)"},
+		{"HELLO 3 SETNAME auth AUTH user secret", "HELLO 3 SETNAME auth AUTH user (redacted)"},
+		{"ACL SETUSER user on >secret", "ACL SETUSER (redacted) (redacted) (redacted)"},
+	} {
+		args := strings.Fields(tt.args)
+		got := strings.Join(slowlogRedact(args), " ")
+		if got != tt.expect {
+			t.Fatalf("expected '%v', got '%v'", tt.expect, got)
+		}
+		if strings.Join(args, " ") != tt.args {
+			t.Fatalf("expected the args to not change, got '%v'", args)
+		}
+	}
+}
+
+func TestSlowlogPasswords(t *testing.T) {
+	ts := testStartServer(t, "--slowlog-log-slower-than", "0")
+	c := ts.dial()
+	c.expect("+OK", "CONFIG", "SET", "requirepass", "secret")
+	c.expect("+OK", "AUTH", "secret")
+	c.expect("+OK", "CONFIG", "SET", "requirepass", "")
+	if got := c.do("SLOWLOG", "GET"); strings.Contains(got, "secret") {
+		t.Fatalf("expected no passwords, got '%v'", got)
+	}
+}
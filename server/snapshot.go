@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// snapshotChunk is the number of keys that are encoded each time the
+// snapshot holds the lock.
+const snapshotChunk = 100
+
+// snapshot is a point-in-time copy of the databases that is encoded without
+// holding the lock for the whole dataset. The keys are encoded in chunks, and
+// the keys that are about to change are encoded first by preserve, with their
+// values at the start of the snapshot.
+type snapshot struct {
+	start    time.Time // the time that the snapshot was taken
+	dbs      []*snapshotDB
+	selectDB func(buf *bytes.Buffer, sd *snapshotDB)
+	entry    func(buf *bytes.Buffer, key string, value interface{}, expires time.Time) error
+}
+
+// snapshotDB is the part of a snapshot for one database.
+type snapshotDB struct {
+	snap    *snapshot
+	db      *database
+	items   map[string]dbItem    // the items of the database, flush replaces them
+	expires map[string]time.Time // the expires of the database
+	keys    []string             // the keys at the start of the snapshot
+	pending map[string]bool      // the keys that aren't encoded yet
+	saved   bytes.Buffer         // the keys that were encoded by preserve
+	err     error                // the first error of preserve
+}
+
+// newSnapshot takes a snapshot of the non-empty databases, which is then
+// written by streamSnapshot. The caller must hold the write lock.
+func (s *Server) newSnapshot(
+	selectDB func(buf *bytes.Buffer, sd *snapshotDB),
+	entry func(buf *bytes.Buffer, key string, value interface{}, expires time.Time) error,
+) *snapshot {
+	snap := &snapshot{start: time.Now(), selectDB: selectDB, entry: entry}
+	dbs := make([]*database, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Sort(dbsByNumber(dbs))
+	for _, db := range dbs {
+		if db.len() == 0 {
+			continue
+		}
+		sd := &snapshotDB{
+			snap:    snap,
+			db:      db,
+			items:   db.items,
+			expires: db.expires,
+			keys:    make([]string, 0, len(db.items)),
+			pending: make(map[string]bool, len(db.items)),
+		}
+		for key := range db.items {
+			sd.keys = append(sd.keys, key)
+			sd.pending[key] = true
+		}
+		db.snapshots = append(db.snapshots, sd)
+		snap.dbs = append(snap.dbs, sd)
+	}
+	return snap
+}
+
+// encode writes the key to buf, unless it expired before the snapshot was
+// taken.
+func (sd *snapshotDB) encode(buf *bytes.Buffer, key string) error {
+	delete(sd.pending, key)
+	item := sd.items[key]
+	var expires time.Time
+	if item.expires {
+		if t, ok := sd.expires[key]; ok {
+			if sd.snap.start.After(t) {
+				return nil
+			}
+			expires = t
+		}
+	}
+	return sd.snap.entry(buf, key, item.value, expires)
+}
+
+// preserve encodes the key, when it's pending, before it's changed. The
+// caller must hold the write lock.
+func (sd *snapshotDB) preserve(key string) {
+	if sd.pending[key] {
+		if err := sd.encode(&sd.saved, key); err != nil && sd.err == nil {
+			sd.err = err
+		}
+	}
+}
+
+// detach stops preserving the keys of the database. The caller must hold the
+// write lock.
+func (sd *snapshotDB) detach() {
+	for i, other := range sd.db.snapshots {
+		if other == sd {
+			sd.db.snapshots = append(sd.db.snapshots[:i], sd.db.snapshots[i+1:]...)
+			break
+		}
+	}
+}
+
+// preserve encodes the key into the snapshots in progress before it's
+// changed. The caller must hold the write lock.
+func (db *database) preserve(key string) {
+	for _, sd := range db.snapshots {
+		sd.preserve(key)
+	}
+}
+
+// streamSnapshot encodes the snapshot in chunks and passes them to write,
+// which is called without the lock. The lock is only held while a chunk is
+// encoded, so other clients may run commands meanwhile.
+func (s *Server) streamSnapshot(snap *snapshot, write func(p []byte) error) (err error) {
+	defer s.releaseSnapshot(snap)
+	var buf bytes.Buffer
+	for _, sd := range snap.dbs {
+		// the keys are only used by this goroutine
+		sort.Strings(sd.keys)
+		buf.Reset()
+		snap.selectDB(&buf, sd)
+		for i := 0; i < len(sd.keys); i += snapshotChunk {
+			end := i + snapshotChunk
+			if end > len(sd.keys) {
+				end = len(sd.keys)
+			}
+			s.mu.RLock()
+			for _, key := range sd.keys[i:end] {
+				if sd.pending[key] {
+					if err = sd.encode(&buf, key); err != nil {
+						break
+					}
+				}
+			}
+			s.mu.RUnlock()
+			if err != nil {
+				return err
+			}
+			if err = write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		// every key was encoded, nothing is preserved anymore
+		s.mu.Lock()
+		sd.detach()
+		s.mu.Unlock()
+		if sd.err != nil {
+			return sd.err
+		}
+		if err = write(sd.saved.Bytes()); err != nil {
+			return err
+		}
+		sd.saved = bytes.Buffer{}
+	}
+	return nil
+}
+
+// releaseSnapshot stops preserving the keys for the snapshot, which is done
+// when it's written or when it won't be written.
+func (s *Server) releaseSnapshot(snap *snapshot) {
+	s.mu.Lock()
+	for _, sd := range snap.dbs {
+		sd.detach()
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// opsSamples is the number of samples that instantaneous_ops_per_sec is the
+// average of, taken every opsSamplePeriod.
+const (
+	opsSamples      = 16
+	opsSamplePeriod = time.Millisecond * 100
+)
+
+// commandStats are the counters of a command for INFO commandstats. Read
+// commands run concurrently, so the fields are accessed atomically.
+type commandStats struct {
+	calls    atomic.Int64 // the number of calls
+	usec     atomic.Int64 // the total time of the calls, in microseconds
+	rejected atomic.Int64 // calls that were refused before running
+	failed   atomic.Int64 // calls that replied with an error
+}
+
+func (st *commandStats) record(elapsed time.Duration, failed bool) {
+	st.calls.Add(1)
+	st.usec.Add(int64(elapsed / time.Microsecond))
+	if failed {
+		st.failed.Add(1)
+	}
+}
+
+func (st *commandStats) reset() {
+	st.calls.Store(0)
+	st.usec.Store(0)
+	st.rejected.Store(0)
+	st.failed.Store(0)
+}
+
+// statConn counts the bytes that are read from and written to a client
+// connection.
+type statConn struct {
+	net.Conn
+	s *Server
+}
+
+func (conn *statConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.s.statNetInputBytes.Add(int64(n))
+	return n, err
+}
+
+func (conn *statConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	conn.s.statNetOutputBytes.Add(int64(n))
+	return n, err
+}
+
+// trackOps samples the number of processed commands for
+// instantaneous_ops_per_sec. Called from the expire loop, under the write
+// lock.
+func (s *Server) trackOps() {
+	now := time.Now()
+	elapsed := now.Sub(s.opsSampleTime)
+	if elapsed < opsSamplePeriod {
+		return
+	}
+	ops := s.statNumCommands.Load()
+	if !s.opsSampleTime.IsZero() {
+		s.opsSamples[s.opsSampleIdx] = float64(ops-s.opsSampleCount) /
+			elapsed.Seconds()
+		s.opsSampleIdx = (s.opsSampleIdx + 1) % opsSamples
+	}
+	s.opsSampleTime = now
+	s.opsSampleCount = ops
+}
+
+// instantaneousOps returns the average of the ops samples.
+func (s *Server) instantaneousOps() int64 {
+	var sum float64
+	for _, ops := range s.opsSamples {
+		sum += ops
+	}
+	return int64(sum / opsSamples)
+}
+
+// keyspaceStats returns the number of key lookups that found the key, and
+// the number that didn't.
+func (s *Server) keyspaceStats() (hits, misses int64) {
+	for _, db := range s.dbs {
+		hits += db.hits.Load()
+		misses += db.misses.Load()
+	}
+	return hits, misses
+}
+
+// resetStats resets the counters that are shown by INFO, for CONFIG
+// RESETSTAT. The caller must hold the write lock.
+func (s *Server) resetStats() {
+	for _, cmd := range s.cmds {
+		cmd.stats.reset()
+	}
+	for _, db := range s.dbs {
+		db.hits.Store(0)
+		db.misses.Store(0)
+	}
+	s.statNumCommands.Store(0)
+	s.statNetInputBytes.Store(0)
+	s.statNetOutputBytes.Store(0)
+	s.statNumConnections = 0
+	s.statRejectedConn = 0
+	s.statExpiredKeys = 0
+	s.statExpiredStalePerc = 0
+	s.statExpiredTimeCapReached = 0
+	s.statExpireCycleTime = 0
+	s.statEvictedKeys = 0
+	s.opsSamples = [opsSamples]float64{}
+	s.opsSampleTime = time.Time{}
+}
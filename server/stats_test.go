@@ -0,0 +1,115 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandStats(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "SET", "a", "1")
+	c.expect("+OK", "SET", "b", "1", "EX", "100")
+	c.expect("1", "GET", "a")
+	c.expect("(nil)", "GET", "x")
+	c.expect("-WRONGTYPE Operation against a key holding the wrong kind of value",
+		"LPUSH", "a", "1")
+	c.expect("+OK", "MULTI")
+	c.expect("+QUEUED", "INCR", "a")
+	c.expect("+QUEUED", "LPUSH", "a", "x")
+	c.expect("*[:2,-WRONGTYPE Operation against a key holding the wrong kind of value]", "EXEC")
+	info := c.do("INFO", "commandstats")
+	for name, expect := range map[string]string{
+		"set":   "calls=2,",
+		"get":   "calls=2,",
+		"incr":  "calls=1,",
+		"lpush": "calls=2,",
+		"exec":  "calls=1,",
+	} {
+		if got := testInfoField(info, "cmdstat_"+name); !strings.HasPrefix(got, expect) {
+			t.Fatalf("%v: expected '%v', got '%v'", name, expect, got)
+		}
+	}
+	if got := testInfoField(info, "cmdstat_lpush"); !strings.HasSuffix(got, ",failed_calls=2") {
+		t.Fatalf("expected '%v', got '%v'", "failed_calls=2", got)
+	}
+	if got := testInfoField(info, "cmdstat_exec"); !strings.HasSuffix(got, ",failed_calls=0") {
+		t.Fatalf("expected '%v', got '%v'", "failed_calls=0", got)
+	}
+	keyspace := c.do("INFO", "keyspace")
+	if got := testInfoField(keyspace, "db0"); !strings.HasPrefix(got, "keys=2,expires=1,avg_ttl=") {
+		t.Fatalf("expected '%v', got '%v'", "keys=2,expires=1", got)
+	}
+	if got := testInfoField(c.do("INFO"), "db0"); !strings.HasPrefix(got, "keys=2,") {
+		t.Fatalf("expected '%v', got '%v'", "keys=2", got)
+	}
+	c.expect("+OK", "CONFIG", "RESETSTAT")
+	c.do("INFO", "commandstats")
+	info = c.do("INFO", "commandstats")
+	if got := testInfoField(info, "cmdstat_set"); got != "" {
+		t.Fatalf("expected no stats, got '%v'", got)
+	}
+	if got := testInfoField(info, "cmdstat_info"); !strings.HasPrefix(got, "calls=1,") {
+		t.Fatalf("expected '%v', got '%v'", "calls=1,", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect("+OK", "SET", "a", "1")
+	c.expect(":2", "INCR", "a")
+	c.expect(":1", "SADD", "s", "m")
+	c.expect("*[0,*[a]]", "SCAN", "0", "TYPE", "string")
+	c.expect("*[0,*[m]]", "SSCAN", "s", "0")
+	c.expect("+string", "TYPE", "a")
+
+	// only the reads of keys are hits or misses
+	stats := c.do("INFO", "stats")
+	for _, name := range []string{"keyspace_hits", "keyspace_misses"} {
+		if got := testInfoField(stats, name); got != "0" {
+			t.Fatalf("%v: expected '%v', got '%v'", name, "0", got)
+		}
+	}
+	c.expect("2", "GET", "a")
+	c.expect("(nil)", "GET", "b")
+	stats = c.do("INFO", "stats")
+	for _, name := range []string{"keyspace_hits", "keyspace_misses"} {
+		if got := testInfoField(stats, name); got != "1" {
+			t.Fatalf("%v: expected '%v', got '%v'", name, "1", got)
+		}
+	}
+
+	other := ts.dial()
+	for start := time.Now(); testInfoField(stats, "instantaneous_ops_per_sec") == "0"; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected ops per second, got '%v'", stats)
+		}
+		for i := 0; i < 100; i++ {
+			other.send("PING")
+		}
+		for i := 0; i < 100; i++ {
+			other.read()
+		}
+		stats = c.do("INFO", "stats")
+	}
+	for name, min := range map[string]int{
+		"total_connections_received": 2,
+		"total_commands_processed":   110,
+		"total_net_input_bytes":      100 * 14,
+		"total_net_output_bytes":     100 * 7,
+	} {
+		if n, _ := strconv.Atoi(testInfoField(stats, name)); n < min {
+			t.Fatalf("%v: expected at least %v, got %v", name, min, n)
+		}
+	}
+	c.expect("+OK", "CONFIG", "RESETSTAT")
+	stats = c.do("INFO", "stats")
+	for _, name := range []string{"total_connections_received", "keyspace_hits"} {
+		if got := testInfoField(stats, name); got != "0" {
+			t.Fatalf("%v: expected '%v', got '%v'", name, "0", got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"strconv"
 	"strings"
 	"time"
 )
@@ -122,11 +123,13 @@ func setCommand(c *client) {
 		return
 	}
 	var nx, xx bool
-	var ex, px time.Time
 	var expires bool
-	var when time.Time
+	var ms int64
 	for i := 3; i < len(c.args); i++ {
 		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replySyntaxError()
+			return
 		case "nx":
 			if xx {
 				c.replySyntaxError()
@@ -139,34 +142,29 @@ func setCommand(c *client) {
 				return
 			}
 			xx = true
-		case "ex":
-			if !px.IsZero() || i == len(c.args)-1 {
+		case "ex", "px", "exat", "pxat":
+			if expires || i == len(c.args)-1 {
 				c.replySyntaxError()
 				return
 			}
+			opt := strings.ToLower(c.args[i])
 			i++
-			n, err := atoi(c.args[i])
+			n, err := strconv.ParseInt(c.args[i], 10, 64)
 			if err != nil {
-				c.replySyntaxError()
+				c.replyInvalidIntError()
 				return
 			}
-			ex = time.Now().Add(time.Duration(n) * time.Second)
-			expires = true
-			when = ex
-		case "px":
-			if !ex.IsZero() || i == len(c.args)-1 {
-				c.replySyntaxError()
-				return
+			unit := time.Second
+			if opt[0] == 'p' {
+				unit = time.Millisecond
 			}
-			i++
-			n, err := atoi(c.args[i])
-			if err != nil {
-				c.replySyntaxError()
+			var ok bool
+			ms, ok = expireMillis(n, unit, strings.HasSuffix(opt, "at"))
+			if n <= 0 || !ok {
+				c.replyError("invalid expire time in 'set' command")
 				return
 			}
-			px = time.Now().Add(time.Duration(n) * time.Millisecond)
 			expires = true
-			when = px
 		}
 	}
 	if nx || xx {
@@ -176,14 +174,50 @@ func setCommand(c *client) {
 			return
 		}
 	}
-	c.db.set(c.args[1], c.args[2])
+	setGeneric(c, c.args[1], c.args[2], expires, ms)
+	c.replyString("OK")
+}
+
+// setGeneric sets the key to a string value, with an optional expiration in
+// unix milliseconds. An expiring key is written to the aof as a SET with an
+// absolute PXAT.
+func setGeneric(c *client, key, value string, expires bool, ms int64) {
+	c.db.set(key, value)
 	if expires {
-		c.db.expire(c.args[1], when)
+		c.db.expire(key, time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)))
+		c.rewriteRaw("SET", key, value, "PXAT", ms)
 	}
-	c.replyString("OK")
 	c.dirty++
 }
 
+func setexCommand(c *client) {
+	setexGeneric(c, time.Second)
+}
+
+func psetexCommand(c *client) {
+	setexGeneric(c, time.Millisecond)
+}
+
+// setexGeneric is the implementation of SETEX and PSETEX.
+func setexGeneric(c *client, unit time.Duration) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	n, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	ms, ok := expireMillis(n, unit, false)
+	if n <= 0 || !ok {
+		c.replyError("invalid expire time in '" + strings.ToLower(c.args[0]) + "' command")
+		return
+	}
+	setGeneric(c, c.args[1], c.args[3], true, ms)
+	c.replyString("OK")
+}
+
 func setnxCommand(c *client) {
 	if len(c.args) != 3 {
 		c.replyAritryError()
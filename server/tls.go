@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// The TLS listener gets the certificates from s.tlsConfig for each new
+// connection, so CONFIG SET of a tls option reloads the files without a
+// restart and without touching the connected clients.
+
+// loadTLSConfig reads the certificate, the key and the ca certificate of the
+// configuration.
+func loadTLSConfig(cfg *config) (*tls.Config, error) {
+	if cfg.tlsCertFile == "" || cfg.tlsKeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.tlsCertFile, cfg.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load certificate: %v", err)
+	}
+	tcfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load CA certificate(s): %v", err)
+		}
+		tcfg.ClientCAs = x509.NewCertPool()
+		if !tcfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to load CA certificate(s): "+
+				"no certificates in %s", cfg.tlsCAFile)
+		}
+	}
+	switch cfg.tlsAuthClients {
+	case "yes":
+		tcfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tcfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		tcfg.ClientAuth = tls.NoClientCert
+	}
+	if tcfg.ClientAuth != tls.NoClientCert && tcfg.ClientCAs == nil {
+		return nil, errors.New("tls-ca-cert-file is required to " +
+			"authenticate the clients, or set tls-auth-clients to no")
+	}
+	return tcfg, nil
+}
+
+// listenTLS starts the TLS listener on tls-port.
+func (s *Server) listenTLS() (net.Listener, error) {
+	tcfg, err := loadTLSConfig(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.tlsConfig.Store(tcfg)
+	l, err := net.Listen("tcp", s.cfg.kvm["bind"]+":"+s.cfg.kvm["tls-port"])
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.tlsConfig.Load(), nil
+		},
+	}), nil
+}
+
+// applyTLS reloads the certificates for CONFIG SET of a tls directive, when
+// the TLS listener is running.
+func applyTLS(c *client) bool {
+	s := c.s
+	if s.cfg.tlsPort == 0 {
+		return true
+	}
+	tcfg, err := loadTLSConfig(s.cfg)
+	if err != nil {
+		s.lwarningf("Failed applying new configuration: %v", err)
+		c.replyError("Unable to update TLS configuration. Check server logs.")
+		return false
+	}
+	s.tlsConfig.Store(tcfg)
+	return true
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMakeCert writes a certificate and its key to name.crt and name.key in
+// the directory. The certificate is signed by the parent, or by itself when
+// the parent is nil.
+func testMakeCert(t testing.TB, dir, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ext, block := range map[string]*pem.Block{
+		".crt": {Type: "CERTIFICATE", Bytes: der},
+		".key": {Type: "EC PRIVATE KEY", Bytes: kder},
+	} {
+		err := ioutil.WriteFile(path.Join(dir, name+ext), pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cert, key
+}
+
+func testDialTLS(t testing.TB, port int, cfg *tls.Config) (*testConn, error) {
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// testFreePort returns a port that is free to listen on.
+func testFreePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testMakeCert(t, dir, "ca", nil, nil)
+	testMakeCert(t, dir, "server", ca, caKey)
+	testMakeCert(t, dir, "client", ca, caKey)
+	tlsPort := testFreePort(t)
+	ts := testStartServer(t, "--tls-port", strconv.Itoa(tlsPort),
+		"--tls-cert-file", path.Join(dir, "server.crt"),
+		"--tls-key-file", path.Join(dir, "server.key"),
+		"--tls-ca-cert-file", path.Join(dir, "ca.crt"))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(path.Join(dir, "client.crt"),
+		path.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}
+	a, err := testDialTLS(t, tlsPort, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.expect("+OK", "SET", "k", "v")
+	c := ts.dial()
+	c.expect("v", "GET", "k")
+	c.expect("*[tls-auth-clients,yes]", "CONFIG", "GET", "tls-auth-clients")
+
+	// a client without a certificate is refused, unless it's optional
+	if b, err := testDialTLS(t, tlsPort, &tls.Config{RootCAs: pool}); err == nil {
+		if got := b.do("PING"); !strings.HasPrefix(got, "ERR:") {
+			t.Fatalf("expected the client to be refused, got '%v'", got)
+		}
+	}
+	c.expect("+OK", "CONFIG", "SET", "tls-auth-clients", "optional")
+	b, err := testDialTLS(t, tlsPort, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.expect("+PONG", "PING")
+
+	// the certificate is reloaded for the new connections
+	cert, _ := testMakeCert(t, dir, "server", ca, caKey)
+	certFile := path.Join(dir, "server.crt")
+	c.expect("+OK", "CONFIG", "SET", "tls-cert-file", certFile)
+	b, err = testDialTLS(t, tlsPort, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := b.conn.(*tls.Conn).ConnectionState()
+	if serial := state.PeerCertificates[0].SerialNumber; serial.Cmp(cert.SerialNumber) != 0 {
+		t.Fatalf("expected the serial %v, got %v", cert.SerialNumber, serial)
+	}
+	b.expect("v", "GET", "k")
+	a.expect("v", "GET", "k")
+	c.expect("-ERR Unable to update TLS configuration. Check server logs.",
+		"CONFIG", "SET", "tls-cert-file", path.Join(dir, "missing.crt"))
+	c.expect("*[tls-cert-file,"+certFile+"]", "CONFIG", "GET", "tls-cert-file")
+	c.expect("-ERR Invalid argument 'x' for CONFIG SET 'tls-auth-clients'",
+		"CONFIG", "SET", "tls-auth-clients", "x")
+}
+
+func TestTLSOnly(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testMakeCert(t, dir, "ca", nil, nil)
+	testMakeCert(t, dir, "server", ca, caKey)
+	tlsPort := testFreePort(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- Start(&Options{
+			Args: []string{"--port", "0", "--tls-port", strconv.Itoa(tlsPort),
+				"--tls-cert-file", path.Join(dir, "server.crt"),
+				"--tls-key-file", path.Join(dir, "server.key"),
+				"--tls-auth-clients", "no"},
+			AppendOnlyPath: path.Join(dir, "appendonly.aof"),
+			LogWriter:      ioutil.Discard,
+		})
+	}()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	var c *testConn
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if c, err = testDialTLS(t, tlsPort, &tls.Config{RootCAs: pool}); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.expect("+PONG", "PING")
+	if got := testInfoField(c.do("INFO", "server"), "tcp_port"); got != "0" {
+		t.Fatalf("expected '%v', got '%v'", "0", got)
+	}
+	c.do("SHUTDOWN", "NOSAVE")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func testMakeSimpleZSet(t testing.TB) *zset {
+	z := newZSet()
+	z.add("a", 1)
+	z.add("b", 2)
+	z.add("c", 3)
+	z.add("d", 3)
+	z.add("e", 5)
+	if z.len() != 5 {
+		t.Fatalf("expected %v, got %v", 5, z.len())
+	}
+	return z
+}
+
+func testZSetCollect(iter func(func(member string, score float64) bool)) string {
+	var members []string
+	iter(func(member string, score float64) bool {
+		members = append(members, member)
+		return true
+	})
+	return strings.Join(members, " ")
+}
+
+func testZSetRank(t *testing.T, z *zset, member string, reverse bool, expect int, ok bool) {
+	rank, tok := z.rank(member, reverse)
+	if tok != ok || rank != expect {
+		t.Fatalf("expected rank='%v', ok='%v', got rank='%v', ok='%v'", expect, ok, rank, tok)
+	}
+}
+
+func TestZSetRank(t *testing.T) {
+	z := testMakeSimpleZSet(t)
+	testZSetRank(t, z, "a", false, 0, true)
+	testZSetRank(t, z, "c", false, 2, true)
+	testZSetRank(t, z, "d", false, 3, true)
+	testZSetRank(t, z, "e", false, 4, true)
+	testZSetRank(t, z, "a", true, 4, true)
+	testZSetRank(t, z, "e", true, 0, true)
+	testZSetRank(t, z, "x", false, 0, false)
+	z.del("c")
+	testZSetRank(t, z, "c", false, 0, false)
+	testZSetRank(t, z, "d", false, 2, true)
+	z.add("a", 10)
+	testZSetRank(t, z, "a", false, 3, true)
+	testZSetRank(t, z, "a", true, 0, true)
+}
+
+func TestZSetRangeByRank(t *testing.T) {
+	z := testMakeSimpleZSet(t)
+	for _, tt := range []struct {
+		start, stop int
+		reverse     bool
+		expect      string
+	}{
+		{0, -1, false, "a b c d e"},
+		{0, -1, true, "e d c b a"},
+		{1, 2, false, "b c"},
+		{1, 2, true, "d c"},
+		{-2, -1, false, "d e"},
+		{-100, 0, false, "a"},
+		{3, 100, false, "d e"},
+		{3, 1, false, ""},
+		{5, 10, false, ""},
+	} {
+		got := testZSetCollect(func(iter func(string, float64) bool) {
+			z.rangeByRank(tt.start, tt.stop, tt.reverse, iter)
+		})
+		if got != tt.expect {
+			t.Fatalf("range %d %d %v: expected '%v', got '%v'",
+				tt.start, tt.stop, tt.reverse, tt.expect, got)
+		}
+	}
+}
+
+func TestZSetRangeByScore(t *testing.T) {
+	z := testMakeSimpleZSet(t)
+	for _, tt := range []struct {
+		min, max string
+		reverse  bool
+		expect   string
+	}{
+		{"-inf", "+inf", false, "a b c d e"},
+		{"-inf", "+inf", true, "e d c b a"},
+		{"2", "3", false, "b c d"},
+		{"(2", "3", false, "c d"},
+		{"2", "(3", false, "b"},
+		{"(1", "(5", true, "d c b"},
+		{"4", "4", false, ""},
+		{"5", "1", false, ""},
+	} {
+		r, ok := parseScoreRange(tt.min, tt.max)
+		if !ok {
+			t.Fatalf("expected valid range '%v %v'", tt.min, tt.max)
+		}
+		got := testZSetCollect(func(iter func(string, float64) bool) {
+			z.rangeByScore(r, tt.reverse, iter)
+		})
+		if got != tt.expect {
+			t.Fatalf("range %v %v %v: expected '%v', got '%v'",
+				tt.min, tt.max, tt.reverse, tt.expect, got)
+		}
+	}
+	if _, ok := parseScoreRange("x", "1"); ok {
+		t.Fatalf("expected invalid range")
+	}
+}
+
+func TestZSetRangeByLex(t *testing.T) {
+	z := newZSet()
+	for _, member := range []string{"a", "b", "c", "d", "e"} {
+		z.add(member, 0)
+	}
+	for _, tt := range []struct {
+		min, max string
+		reverse  bool
+		expect   string
+	}{
+		{"-", "+", false, "a b c d e"},
+		{"-", "+", true, "e d c b a"},
+		{"[b", "[d", false, "b c d"},
+		{"(b", "[d", false, "c d"},
+		{"[b", "(d", false, "b c"},
+		{"-", "(c", false, "a b"},
+		{"(c", "+", true, "e d"},
+		{"[bb", "[cc", false, "c"},
+		{"+", "-", false, ""},
+		{"[d", "[b", false, ""},
+	} {
+		r, ok := parseLexRange(tt.min, tt.max)
+		if !ok {
+			t.Fatalf("expected valid range '%v %v'", tt.min, tt.max)
+		}
+		got := testZSetCollect(func(iter func(string, float64) bool) {
+			z.rangeByLex(r, tt.reverse, iter)
+		})
+		if got != tt.expect {
+			t.Fatalf("range %v %v %v: expected '%v', got '%v'",
+				tt.min, tt.max, tt.reverse, tt.expect, got)
+		}
+	}
+	for _, bounds := range [][2]string{{"a", "[c"}, {"[a", "c"}, {"", "+"}} {
+		if _, ok := parseLexRange(bounds[0], bounds[1]); ok {
+			t.Fatalf("expected invalid range '%v %v'", bounds[0], bounds[1])
+		}
+	}
+}
+
+func TestZSetCommands(t *testing.T) {
+	ts := testStartServer(t)
+	c := ts.dial()
+	c.expect(":3", "ZADD", "z", "1", "a", "2", "b", "3", "c")
+	c.expect(":3", "ZCARD", "z")
+	c.expect("2", "ZSCORE", "z", "b")
+	c.expect("*[a,1,b,2,c,3]", "ZRANGE", "z", "0", "-1", "WITHSCORES")
+	c.expect("*[c,b]", "ZREVRANGE", "z", "0", "1")
+	c.expect("*[b,c]", "ZRANGEBYSCORE", "z", "(1", "+inf")
+	c.expect("*[c,b]", "ZREVRANGEBYSCORE", "z", "+inf", "(1")
+	c.expect("*[b]", "ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "1", "1")
+	c.expect(":2", "ZCOUNT", "z", "2", "3")
+	c.expect(":2", "ZRANK", "z", "c")
+	c.expect(":0", "ZREVRANK", "z", "c")
+	c.expect("(nil)", "ZRANK", "z", "d")
+	c.expect("4.5", "ZINCRBY", "z", "2.5", "b")
+	c.expect(":0", "ZADD", "z", "NX", "9", "a")
+	c.expect(":1", "ZADD", "z", "CH", "0", "c")
+	c.expect("-ERR XX and NX options at the same time are not compatible",
+		"ZADD", "z", "NX", "XX", "1", "a")
+	c.expect(":3", "ZADD", "l", "0", "a", "0", "b", "0", "c")
+	c.expect("*[b,c]", "ZRANGEBYLEX", "l", "(a", "+")
+	c.expect("*[c,b]", "ZREVRANGEBYLEX", "l", "+", "(a")
+	c.expect(":2", "ZLEXCOUNT", "l", "[b", "[c")
+	c.expect(":3", "ZUNIONSTORE", "u", "2", "z", "l", "WEIGHTS", "1", "2")
+	c.expect("*[c,0,a,1,b,4.5]", "ZRANGE", "u", "0", "-1", "WITHSCORES")
+	c.expect(":3", "ZINTERSTORE", "i", "2", "z", "l", "AGGREGATE", "MAX")
+	c.expect("*[c,0,a,1,b,4.5]", "ZRANGE", "i", "0", "-1", "WITHSCORES")
+	c.expect(":1", "ZREM", "i", "a", "x")
+	c.expect(":1", "ZREMRANGEBYSCORE", "z", "4", "5")
+	c.expect(":1", "ZREMRANGEBYRANK", "u", "0", "0")
+	c.expect(":1", "ZREMRANGEBYLEX", "l", "[a", "[a")
+	c.expect("+zset", "TYPE", "z")
+	c.rewriteAOF()
+	c.expect(":1", "ZADD", "z", "-inf", "m")
+	ts.restart()
+	c = ts.dial()
+	c.expect("*[a,1,b,4.5]", "ZRANGE", "u", "0", "-1", "WITHSCORES")
+	c.expect("*[m,-inf,c,0,a,1]", "ZRANGE", "z", "0", "-1", "WITHSCORES")
+	c.expect("*[b,c]", "ZRANGE", "l", "0", "-1")
+}